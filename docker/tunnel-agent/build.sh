@@ -10,6 +10,7 @@ cd "$SCRIPT_DIR"
 OUTPUT_NAME="${OUTPUT_NAME:-tunnel-agent}"
 GOOS="${GOOS:-linux}"
 GOARCH="${GOARCH:-amd64}"
+VERSION="${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}"
 
 # Parse arguments
 while [[ $# -gt 0 ]]; do
@@ -22,6 +23,10 @@ while [[ $# -gt 0 ]]; do
             GOARCH="$2"
             shift 2
             ;;
+        --version)
+            VERSION="$2"
+            shift 2
+            ;;
         -o|--output)
             OUTPUT_NAME="$2"
             shift 2
@@ -32,6 +37,7 @@ while [[ $# -gt 0 ]]; do
             echo "Options:"
             echo "  --os OS        Target OS (default: linux)"
             echo "  --arch ARCH    Target architecture (default: amd64)"
+            echo "  --version VER  Agent version reported to the bridge (default: git describe)"
             echo "  -o, --output   Output binary name (default: tunnel-agent)"
             echo "  -h, --help     Show this help"
             exit 0
@@ -43,10 +49,10 @@ while [[ $# -gt 0 ]]; do
     esac
 done
 
-echo "Building tunnel-agent for ${GOOS}/${GOARCH}..."
+echo "Building tunnel-agent ${VERSION} for ${GOOS}/${GOARCH}..."
 
 CGO_ENABLED=0 GOOS="$GOOS" GOARCH="$GOARCH" go build \
-    -ldflags="-s -w" \
+    -ldflags="-s -w -X docker-bridge-tunnel-agent/internal/tunnel.AgentVersion=${VERSION}" \
     -o "$OUTPUT_NAME" \
     .
 
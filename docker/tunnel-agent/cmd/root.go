@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
@@ -13,9 +14,12 @@ import (
 	"time"
 
 	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/discovery"
 	"docker-bridge-tunnel-agent/internal/health"
+	"docker-bridge-tunnel-agent/internal/probe"
 	"docker-bridge-tunnel-agent/internal/transport"
 	"docker-bridge-tunnel-agent/internal/tunnel"
+	"docker-bridge-tunnel-agent/internal/upstream"
 
 	"github.com/spf13/cobra"
 )
@@ -23,9 +27,12 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "tunnel-agent",
 	Short: "Stdin/stdout tunnel agent for Docker containers",
-	Long: `tunnel-agent reads framed messages from stdin, proxies HTTP and WebSocket
+	Long: `tunnel-agent reads framed messages from stdin, proxies HTTP, WebSocket and TCP
 traffic to local dev server ports, and writes framed responses to stdout.
-It is invoked as a Docker exec process by the bridge service.`,
+It is invoked as a Docker exec process by the bridge service.
+
+With --transport unix or tcp it instead runs as a long-lived process that
+the bridge connects to on --listen, one session per connection.`,
 	RunE: runAgent,
 }
 
@@ -35,11 +42,33 @@ func Execute() error {
 }
 
 func init() {
-	rootCmd.Flags().StringSlice("ports", nil, "Comma-separated list of local ports to proxy (required)")
+	rootCmd.Flags().StringSlice("ports", nil, "Comma-separated list of local ports to proxy (required). The first port is the default target for messages that do not name one.")
 	rootCmd.Flags().String("log-level", "info", "Log level: debug, info, warn, error")
 	rootCmd.Flags().Duration("proxy-timeout", 30*time.Second, "Maximum time to wait for upstream response headers; does not bound streamed response bodies")
+	rootCmd.Flags().Duration("port-grace", 5*time.Second, "How long a request or WebSocket upgrade waits for a port that refuses connections (e.g. a restarting dev server) before answering 502. 0 fails at once")
+	rootCmd.Flags().String("error-page", "", "Path of an HTML template (Go html/template) shown to browsers when a port is unreachable; fields: .Port, .Method, .Path, .RefreshSeconds")
 	rootCmd.Flags().Int("max-body-chunk", 1048576, "Max body chunk size in bytes (default 1MB)")
-	rootCmd.Flags().Int("health-port", 0, "Health endpoint port (loopback only). 0 disables the health server.")
+	rootCmd.Flags().Int("compress-threshold", 1024, "Smallest response body chunk or WebSocket message in bytes to gzip when the bridge enables compress_gzip; already-compressed content is never gzipped. Negative disables compression")
+	rootCmd.Flags().Int64("stream-window", 4*1048576, "Per-stream receive window in bytes advertised to the bridge for flow control (default 4MB)")
+	rootCmd.Flags().Int("max-streams", 0, "Maximum concurrent HTTP, WebSocket, TCP, exec and file streams; requests over the limit get a 503 and other streams a failed ack. 0 means no limit")
+	rootCmd.Flags().Int("max-streams-per-port", 0, "Maximum concurrent HTTP, WebSocket and TCP streams to any one port, and exec or file streams of each kind. 0 means no limit")
+	rootCmd.Flags().Duration("stream-idle-timeout", 0, "Close WebSocket streams and HTTP streams with a body in flight after this long without data in either direction, with stream_close reason idle_timeout. 0 disables the timeout")
+	rootCmd.Flags().StringSlice("upstream", nil, "Comma-separated per-port upstream addresses, PORT=HOST:PORT or PORT=unix:/path/to.sock, for ports not served on loopback")
+	rootCmd.Flags().StringSlice("h2c-ports", nil, "Comma-separated subset of --ports whose upstream speaks HTTP/2 cleartext (h2c), e.g. gRPC servers")
+	rootCmd.Flags().StringSlice("exec-allow", nil, "Comma-separated programs (names looked up in PATH, or absolute paths) the bridge may run with exec_start, e.g. bash,sh. Arguments are not restricted, so allowing a shell or interpreter lets the bridge run anything. Empty disables exec")
+	rootCmd.Flags().StringSlice("file-roots", nil, "Comma-separated absolute directories the bridge may read, write and list files in (file_read, file_write, file_list). Empty disables file transfer")
+	rootCmd.Flags().String("transport", "stdio", "Bridge transport: stdio, unix (Unix domain socket) or tcp (TCP listener)")
+	rootCmd.Flags().String("listen", "", "Socket path (unix) or host:port (tcp) to accept bridge connections on. A tcp address without a host, e.g. :7000, listens on loopback only")
+	rootCmd.Flags().String("auth-token-file", "", "Path of a file holding the shared secret a bridge must present in its hello before anything is served (required with --transport unix or tcp)")
+	rootCmd.Flags().Duration("heartbeat-interval", tunnel.DefaultHeartbeatInterval, "How often to send a heartbeat, or a ping once the bridge enables ping; the bridge's hello may ask for another interval")
+	rootCmd.Flags().Duration("heartbeat-timeout", 30*time.Second, "How long to wait for a bridge that enabled ping to send anything before closing all streams and exiting; never less than two heartbeat intervals. 0 disables the timeout")
+	rootCmd.Flags().Int("health-port", 0, "Health endpoint port (loopback only) serving /healthz, /readyz and /metrics. 0 disables the health server.")
+	rootCmd.Flags().Duration("probe-interval", 2*time.Second, "How often to probe the ports in the background for /readyz and port_status messages. 0 disables probing.")
+	rootCmd.Flags().Bool("discover-ports", false, "Watch /proc/net/tcp and /proc/net/tcp6 for loopback and wildcard listeners and announce them to the bridge")
+	rootCmd.Flags().Duration("discover-interval", 2*time.Second, "How often to scan for listening ports with --discover-ports")
+	rootCmd.Flags().StringSlice("discover-include", []string{"1024-65535"}, "Comma-separated port ranges (e.g. 3000-9999,5173) that discovery may announce")
+	rootCmd.Flags().StringSlice("discover-exclude", nil, "Comma-separated port ranges that discovery never announces")
+	rootCmd.Flags().Bool("discover-route", false, "Make discovered ports routable in addition to --ports")
 	_ = rootCmd.MarkFlagRequired("ports")
 }
 
@@ -50,8 +79,30 @@ func runAgent(cmd *cobra.Command, args []string) error {
 	portsStr, _ := cmd.Flags().GetStringSlice("ports")
 	logLevel, _ := cmd.Flags().GetString("log-level")
 	proxyTimeout, _ := cmd.Flags().GetDuration("proxy-timeout")
+	portGrace, _ := cmd.Flags().GetDuration("port-grace")
+	errorPagePath, _ := cmd.Flags().GetString("error-page")
 	maxBodyChunk, _ := cmd.Flags().GetInt("max-body-chunk")
 	healthPort, _ := cmd.Flags().GetInt("health-port")
+	streamWindow, _ := cmd.Flags().GetInt64("stream-window")
+	compressThreshold, _ := cmd.Flags().GetInt("compress-threshold")
+	maxStreams, _ := cmd.Flags().GetInt("max-streams")
+	maxStreamsPerPort, _ := cmd.Flags().GetInt("max-streams-per-port")
+	streamIdleTimeout, _ := cmd.Flags().GetDuration("stream-idle-timeout")
+	h2cPortsStr, _ := cmd.Flags().GetStringSlice("h2c-ports")
+	upstreamsStr, _ := cmd.Flags().GetStringSlice("upstream")
+	execAllow, _ := cmd.Flags().GetStringSlice("exec-allow")
+	fileRootsStr, _ := cmd.Flags().GetStringSlice("file-roots")
+	transportKind, _ := cmd.Flags().GetString("transport")
+	listenAddr, _ := cmd.Flags().GetString("listen")
+	authTokenFile, _ := cmd.Flags().GetString("auth-token-file")
+	heartbeatInterval, _ := cmd.Flags().GetDuration("heartbeat-interval")
+	heartbeatTimeout, _ := cmd.Flags().GetDuration("heartbeat-timeout")
+	probeInterval, _ := cmd.Flags().GetDuration("probe-interval")
+	discoverPorts, _ := cmd.Flags().GetBool("discover-ports")
+	discoverInterval, _ := cmd.Flags().GetDuration("discover-interval")
+	discoverIncludeStr, _ := cmd.Flags().GetStringSlice("discover-include")
+	discoverExcludeStr, _ := cmd.Flags().GetStringSlice("discover-exclude")
+	discoverRoute, _ := cmd.Flags().GetBool("discover-route")
 
 	// Parse ports from string slice to int slice.
 	ports, err := config.ParsePorts(portsStr)
@@ -59,12 +110,106 @@ func runAgent(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("invalid ports: %w", err)
 	}
 
+	var h2cPorts []int
+	if len(h2cPortsStr) > 0 {
+		h2cPorts, err = config.ParsePorts(h2cPortsStr)
+		if err != nil {
+			return fmt.Errorf("invalid h2c ports: %w", err)
+		}
+	}
+
+	upstreams, err := config.ParseUpstreams(upstreamsStr)
+	if err != nil {
+		return err
+	}
+
+	fileRoots, err := config.ParseFileRoots(fileRootsStr)
+	if err != nil {
+		return err
+	}
+
+	discoverInclude, err := config.ParsePortRanges(discoverIncludeStr)
+	if err != nil {
+		return fmt.Errorf("invalid discover include ranges: %w", err)
+	}
+	discoverExclude, err := config.ParsePortRanges(discoverExcludeStr)
+	if err != nil {
+		return fmt.Errorf("invalid discover exclude ranges: %w", err)
+	}
+	errorPage, err := tunnel.LoadErrorPage(errorPagePath)
+	if err != nil {
+		return err
+	}
+	if maxStreams < 0 || maxStreamsPerPort < 0 {
+		return fmt.Errorf("--max-streams and --max-streams-per-port must not be negative")
+	}
+	if streamIdleTimeout < 0 {
+		return fmt.Errorf("--stream-idle-timeout must not be negative")
+	}
+	if heartbeatInterval <= 0 {
+		return fmt.Errorf("--heartbeat-interval must be positive")
+	}
+	if heartbeatTimeout < 0 {
+		return fmt.Errorf("--heartbeat-timeout must not be negative")
+	}
+	if discoverPorts && discoverInterval <= 0 {
+		return fmt.Errorf("--discover-interval must be positive")
+	}
+
+	var authToken string
+	switch transportKind {
+	case "stdio":
+		if listenAddr != "" || authTokenFile != "" {
+			return fmt.Errorf("--listen and --auth-token-file require --transport unix or tcp")
+		}
+	case "unix", "tcp":
+		if listenAddr == "" || authTokenFile == "" {
+			return fmt.Errorf("--transport %s requires --listen and --auth-token-file", transportKind)
+		}
+		authToken, err = config.ReadAuthToken(authTokenFile)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid transport %q: must be stdio, unix or tcp", transportKind)
+	}
+
 	cfg := &config.Config{
-		Ports:            ports,
-		LogLevel:         logLevel,
-		ProxyTimeout:     proxyTimeout,
-		MaxBodyChunkSize: int64(maxBodyChunk),
-		HealthPort:       healthPort,
+		Ports:             ports,
+		LogLevel:          logLevel,
+		ProxyTimeout:      proxyTimeout,
+		PortGrace:         portGrace,
+		ErrorPage:         errorPage,
+		MaxBodyChunkSize:  int64(maxBodyChunk),
+		HealthPort:        healthPort,
+		StreamWindow:      streamWindow,
+		CompressThreshold: compressThreshold,
+		MaxStreams:        maxStreams,
+		MaxStreamsPerPort: maxStreamsPerPort,
+		StreamIdleTimeout: streamIdleTimeout,
+		H2CPorts:          h2cPorts,
+		Upstreams:         upstreams,
+		ExecAllow:         execAllow,
+		FileRoots:         fileRoots,
+		HeartbeatInterval: heartbeatInterval,
+		HeartbeatTimeout:  heartbeatTimeout,
+		AuthToken:         authToken,
+		ProbeInterval:     probeInterval,
+		DiscoverPorts:     discoverPorts,
+		DiscoverInterval:  discoverInterval,
+		DiscoverInclude:   discoverInclude,
+		DiscoverExclude:   discoverExclude,
+		DiscoverRoute:     discoverRoute,
+	}
+	for _, port := range cfg.H2CPorts {
+		if !cfg.AllowsPort(port) {
+			return fmt.Errorf("h2c port %d is not in --ports", port)
+		}
+	}
+	for port := range cfg.Upstreams {
+		if !cfg.AllowsPort(port) {
+			return fmt.Errorf("upstream port %d is not in --ports", port)
+		}
 	}
 
 	initLogger(cfg.LogLevel)
@@ -74,32 +219,93 @@ func runAgent(cmd *cobra.Command, args []string) error {
 	defer stop()
 
 	slog.Info("tunnel-agent starting",
+		"version", tunnel.AgentVersion,
+		"protocol_version", tunnel.ProtocolVersion,
 		"ports", cfg.Ports,
 		"proxy_timeout", cfg.ProxyTimeout,
+		"port_grace", cfg.PortGrace,
 		"max_body_chunk", cfg.MaxBodyChunkSize,
+		"stream_window", cfg.StreamWindow,
+		"compress_threshold", cfg.CompressThreshold,
+		"max_streams", cfg.MaxStreams,
+		"max_streams_per_port", cfg.MaxStreamsPerPort,
+		"stream_idle_timeout", cfg.StreamIdleTimeout,
+		"h2c_ports", cfg.H2CPorts,
+		"upstreams", cfg.Upstreams,
+		"exec_allow", cfg.ExecAllow,
+		"file_roots", cfg.FileRoots,
+		"transport", transportKind,
+		"heartbeat_interval", cfg.HeartbeatInterval,
+		"heartbeat_timeout", cfg.HeartbeatTimeout,
+		"probe_interval", cfg.ProbeInterval,
+		"discover_ports", cfg.DiscoverPorts,
 	)
 
-	tr := transport.NewStdioTransport()
-	agent := tunnel.NewAgent(cfg, tr)
+	// Listen before discovery starts so the agent's own port, which may be
+	// chosen by the system, is known not to be a dev server.
+	var ln *transport.Listener
+	if transportKind != "stdio" {
+		ln, err = transport.Listen(transportKind, listenAddr)
+		if err != nil {
+			return err
+		}
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			cfg.ListenPort = addr.Port
+		}
+	}
+
+	var prober *probe.Prober
+	if cfg.ProbeInterval > 0 {
+		prober = probe.NewProber(cfg.Ports, cfg.ProbeInterval, upstream.NewDialer(cfg, probe.DialTimeout))
+		go prober.Run(ctx)
+	}
 
-	// Start health endpoint (loopback only). Disabled when HealthPort == 0
-	// to avoid bind collisions when multiple agents run in the same container.
-	if cfg.HealthPort > 0 {
-		go func() {
-			if err := health.StartHealthServer(ctx, cfg.HealthPort, agent); err != nil {
-				slog.Warn("health server error", "error", err)
-			}
-		}()
+	var watcher *discovery.Watcher
+	if cfg.DiscoverPorts {
+		watcher = discovery.NewWatcher(cfg)
+		go watcher.Run(ctx)
 	}
 
-	if err := agent.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
-		return fmt.Errorf("agent exited: %w", err)
+	if transportKind == "stdio" {
+		agent := tunnel.NewAgent(cfg, transport.NewStdioTransport())
+		agent.WatchPorts(prober)
+		agent.WatchListeners(watcher)
+		startHealthServer(ctx, cfg, agent, prober)
+		if err := agent.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			return fmt.Errorf("agent exited: %w", err)
+		}
+	} else {
+		server := tunnel.NewServer(cfg, ln)
+		server.WatchPorts(prober)
+		server.WatchListeners(watcher)
+		startHealthServer(ctx, cfg, server, prober)
+		if err := server.Serve(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			return fmt.Errorf("server exited: %w", err)
+		}
 	}
 
 	slog.Info("tunnel-agent shutting down")
 	return nil
 }
 
+// startHealthServer starts the health endpoint (loopback only). It is disabled
+// when HealthPort == 0 to avoid bind collisions when multiple agents run in
+// the same container. Without a prober, /readyz only checks the agent.
+func startHealthServer(ctx context.Context, cfg *config.Config, status health.AgentStatus, prober *probe.Prober) {
+	if cfg.HealthPort <= 0 {
+		return
+	}
+	var readiness health.Readiness
+	if prober != nil {
+		readiness = prober
+	}
+	go func() {
+		if err := health.StartHealthServer(ctx, cfg.HealthPort, status, readiness); err != nil {
+			slog.Warn("health server error", "error", err)
+		}
+	}()
+}
+
 // initLogger initializes the default structured JSON logger writing to stderr.
 func initLogger(levelStr string) {
 	var level slog.Level
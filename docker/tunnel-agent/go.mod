@@ -1,11 +1,13 @@
 module docker-bridge-tunnel-agent
 
-go 1.22
+go 1.24
 
-require github.com/spf13/cobra v1.10.1
+require (
+	github.com/spf13/cobra v1.10.1
+	nhooyr.io/websocket v1.8.17
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.9 // indirect
-	nhooyr.io/websocket v1.8.17 // indirect
 )
@@ -1,9 +1,16 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"html/template"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,6 +21,231 @@ type Config struct {
 	LogLevel         string
 	MaxBodyChunkSize int64
 	ProxyTimeout     time.Duration
+	// StreamWindow is the receive window advertised to the bridge for each
+	// flow-controlled stream, and the buffering limit for legacy streams.
+	StreamWindow int64
+	// H2CPorts lists the ports whose upstream speaks HTTP/2 over cleartext
+	// (h2c with prior knowledge), such as gRPC dev servers.
+	H2CPorts []int
+	// Upstreams overrides where a port's traffic is sent. Ports without an
+	// entry go to the loopback interface, over IPv4 or IPv6.
+	Upstreams map[int]Upstream
+	// PortGrace is how long a request or upgrade waits for a port that
+	// refuses connections, such as a dev server restarting, before it fails.
+	PortGrace time.Duration
+	// ErrorPage is the template shown to browsers when a port is
+	// unreachable, as loaded from --error-page. Nil selects the built-in page.
+	ErrorPage *template.Template
+	// CompressThreshold is the smallest body chunk or WebSocket message, in
+	// bytes, that is gzipped when the bridge enables compress_gzip. A
+	// negative value disables compression.
+	CompressThreshold int
+	// ExecAllow lists the commands the bridge may run via exec_start, as
+	// program names looked up in PATH or absolute paths. Empty disables exec.
+	ExecAllow []string
+	// FileRoots are the directories the bridge may read, write and list
+	// files in, with symlinks resolved. Empty disables file transfer.
+	FileRoots []string
+	// MaxStreams bounds the streams of every kind open at once, and
+	// MaxStreamsPerPort those open to any one port; exec and file streams
+	// are each limited as if to a port of their own. Zero means no limit.
+	MaxStreams        int
+	MaxStreamsPerPort int
+	// StreamIdleTimeout closes a WebSocket stream, or an HTTP stream with a
+	// request or response body in flight, that carries no data in either
+	// direction for this long. Zero disables it.
+	StreamIdleTimeout time.Duration
+	// HeartbeatInterval is how often the agent sends a heartbeat, or a ping
+	// once the bridge enables ping, unless the bridge's hello asks for
+	// another interval.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is how long the agent waits for any message from a
+	// bridge that enabled ping before it closes every stream and ends the
+	// session. It is never shorter than two heartbeat intervals; zero waits
+	// forever.
+	HeartbeatTimeout time.Duration
+	// AuthToken is the shared secret a bridge connecting to a Unix socket or
+	// TCP listener must present in its hello before anything is served.
+	AuthToken string
+	// ListenPort is the port of the TCP listener bridges connect to, or zero
+	// without one. It is never discovered.
+	ListenPort int
+	// ProbeInterval is how often the ports are probed in the background to
+	// report their readiness. Zero disables probing.
+	ProbeInterval time.Duration
+
+	// DiscoverPorts enables discovery of loopback and wildcard listeners from
+	// /proc/net/tcp and /proc/net/tcp6, polled every DiscoverInterval.
+	DiscoverPorts    bool
+	DiscoverInterval time.Duration
+	// DiscoverInclude and DiscoverExclude select the discovered ports that are
+	// reported: those in an include range and in no exclude range.
+	DiscoverInclude []PortRange
+	DiscoverExclude []PortRange
+	// DiscoverRoute makes reported ports routable in addition to Ports.
+	DiscoverRoute bool
+
+	// discovered holds the ports made routable by discovery (int -> struct{}).
+	discovered sync.Map
+}
+
+// Upstream is the address of a local service: a TCP "host:port" or the path
+// of a Unix socket.
+type Upstream struct {
+	Network string // "tcp" or "unix"
+	Address string
+}
+
+// String formats u as it is written on the command line.
+func (u Upstream) String() string {
+	if u.Network == "unix" {
+		return "unix:" + u.Address
+	}
+	return u.Address
+}
+
+// UpstreamFor returns the upstream configured for port, if any.
+func (c *Config) UpstreamFor(port int) (Upstream, bool) {
+	u, ok := c.Upstreams[port]
+	return u, ok
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First, Last int
+}
+
+// Contains reports whether port is within r.
+func (r PortRange) Contains(port int) bool {
+	return port >= r.First && port <= r.Last
+}
+
+// String formats r as "first-last", or as a single port.
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(r.First)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// Discoverable reports whether a discovered port should be reported: it is
+// within DiscoverInclude, outside DiscoverExclude, and neither a configured
+// port, the health port nor the agent's own listener.
+func (c *Config) Discoverable(port int) bool {
+	if slices.Contains(c.Ports, port) || port == c.HealthPort || port == c.ListenPort {
+		return false
+	}
+	inRange := func(r PortRange) bool { return r.Contains(port) }
+	return slices.ContainsFunc(c.DiscoverInclude, inRange) &&
+		!slices.ContainsFunc(c.DiscoverExclude, inRange)
+}
+
+// AddDiscoveredPort makes port routable.
+func (c *Config) AddDiscoveredPort(port int) {
+	c.discovered.Store(port, struct{}{})
+}
+
+// RemoveDiscoveredPort makes a port added by AddDiscoveredPort unroutable again.
+func (c *Config) RemoveDiscoveredPort(port int) {
+	c.discovered.Delete(port)
+}
+
+// ErrPortNotAllowed is returned by ResolvePort when a message targets a port
+// that is not in the configured allow-list.
+var ErrPortNotAllowed = errors.New("port not allowed")
+
+// AllowsPort reports whether port is one of the configured proxy ports or a
+// port added by discovery.
+func (c *Config) AllowsPort(port int) bool {
+	for _, p := range c.Ports {
+		if p == port {
+			return true
+		}
+	}
+	_, ok := c.discovered.Load(port)
+	return ok
+}
+
+// ErrCommandNotAllowed is returned when the bridge asks to run a command
+// that is not in the exec allow-list.
+var ErrCommandNotAllowed = errors.New("command not allowed")
+
+// AllowsCommand reports whether name, the program of an exec_start command,
+// is in the exec allow-list. It must match an entry exactly: "bash" does not
+// allow "/bin/bash". The arguments are not restricted, so allowing a shell or
+// another interpreter allows running anything.
+func (c *Config) AllowsCommand(name string) bool {
+	return name != "" && slices.Contains(c.ExecAllow, name)
+}
+
+// ErrEnvNotAllowed is returned when the bridge sets an environment variable
+// for an exec_start command that is malformed or could make the program load
+// or run other code.
+var ErrEnvNotAllowed = errors.New("environment variable not allowed")
+
+// deniedExecEnv lists the variables the bridge may not set for a command:
+// those that change which program runs or make a shell or interpreter run
+// code at startup.
+var deniedExecEnv = []string{
+	"PATH", "IFS", "CDPATH",
+	"BASH_ENV", "ENV", "SHELLOPTS", "BASHOPTS", "PROMPT_COMMAND", "PS4",
+	"NODE_OPTIONS", "PYTHONSTARTUP", "PYTHONPATH", "PERL5OPT", "PERL5LIB", "RUBYOPT", "GCONV_PATH",
+}
+
+// AllowsExecEnv reports whether entry, a "KEY=value" environment entry from
+// an exec_start message, may be passed to the command. Dynamic loader
+// variables (LD_*, DYLD_*), exported bash functions and those in
+// deniedExecEnv are refused.
+//
+// This only keeps an allowed program from being subverted through its
+// environment; a program that runs what its arguments say, such as a shell,
+// still gives the bridge arbitrary execution.
+func AllowsExecEnv(entry string) bool {
+	name, _, ok := strings.Cut(entry, "=")
+	if !ok || name == "" {
+		return false
+	}
+	if strings.HasPrefix(name, "LD_") || strings.HasPrefix(name, "DYLD_") || strings.HasPrefix(name, "BASH_FUNC_") {
+		return false
+	}
+	return !slices.Contains(deniedExecEnv, name)
+}
+
+// ErrPathNotAllowed is returned when the bridge names a file outside the
+// file roots.
+var ErrPathNotAllowed = errors.New("path not allowed")
+
+// AllowsFilePath reports whether path, an absolute path with symlinks
+// resolved, is one of the file roots or lies below one.
+func (c *Config) AllowsFilePath(path string) bool {
+	for _, root := range c.FileRoots {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesH2C reports whether the upstream on port is proxied over h2c.
+func (c *Config) UsesH2C(port int) bool {
+	return slices.Contains(c.H2CPorts, port)
+}
+
+// ResolvePort returns the upstream port for a message that requested the given
+// port. A requested port of 0 selects the first configured port, which keeps
+// bridges that predate per-message ports working.
+func (c *Config) ResolvePort(requested int) (int, error) {
+	if requested == 0 {
+		if len(c.Ports) == 0 {
+			return 0, fmt.Errorf("no ports configured: %w", ErrPortNotAllowed)
+		}
+		return c.Ports[0], nil
+	}
+	if !c.AllowsPort(requested) {
+		return 0, fmt.Errorf("port %d: %w", requested, ErrPortNotAllowed)
+	}
+	return requested, nil
 }
 
 // ParsePorts parses a string slice of port numbers (from cobra StringSlice flag).
@@ -42,3 +274,113 @@ func ParsePorts(parts []string) ([]int, error) {
 	return ports, nil
 }
 
+// ParsePortRanges parses port ranges such as "3000-3999" or "8080" (from a
+// cobra StringSlice flag).
+func ParsePortRanges(parts []string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		bounds, err := ParsePorts([]string{first})
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range %q: %w", part, err)
+		}
+		r := PortRange{First: bounds[0], Last: bounds[0]}
+		if isRange {
+			bounds, err = ParsePorts([]string{last})
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range %q: %w", part, err)
+			}
+			r.Last = bounds[0]
+		}
+		if r.First > r.Last {
+			return nil, fmt.Errorf("invalid port range %q: first port is greater than last", part)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// ParseUpstreams parses per-port upstream addresses such as
+// "3000=unix:/run/app.sock" or "8080=10.0.0.5:8080" (from a cobra StringSlice
+// flag).
+func ParseUpstreams(parts []string) (map[int]Upstream, error) {
+	upstreams := make(map[int]Upstream)
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		portStr, addr, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid upstream %q: expected PORT=ADDRESS", part)
+		}
+		ports, err := ParsePorts([]string{portStr})
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %w", part, err)
+		}
+		var u Upstream
+		if path, isUnix := strings.CutPrefix(addr, "unix:"); isUnix {
+			if path == "" {
+				return nil, fmt.Errorf("invalid upstream %q: empty socket path", part)
+			}
+			u = Upstream{Network: "unix", Address: path}
+		} else {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("invalid upstream %q: %w", part, err)
+			}
+			u = Upstream{Network: "tcp", Address: addr}
+		}
+		if _, dup := upstreams[ports[0]]; dup {
+			return nil, fmt.Errorf("invalid upstream %q: port %d given twice", part, ports[0])
+		}
+		upstreams[ports[0]] = u
+	}
+	return upstreams, nil
+}
+
+// ParseFileRoots parses the --file-roots flag: existing directories, given as
+// absolute paths. Each is returned cleaned and with symlinks resolved, so
+// that AllowsFilePath can compare resolved paths against it.
+func ParseFileRoots(parts []string) ([]string, error) {
+	var roots []string
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !filepath.IsAbs(part) {
+			return nil, fmt.Errorf("invalid file root %q: must be an absolute path", part)
+		}
+		root, err := filepath.EvalSymlinks(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file root %q: %w", part, err)
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file root %q: %w", part, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("invalid file root %q: not a directory", part)
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// ReadAuthToken reads the shared secret from the --auth-token-file flag: the
+// file's contents without surrounding whitespace, which must not be empty.
+func ReadAuthToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read auth token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("auth token file %s is empty", path)
+	}
+	return token, nil
+}
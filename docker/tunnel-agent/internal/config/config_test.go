@@ -1,6 +1,11 @@
 package config
 
 import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 )
 
@@ -117,3 +122,317 @@ func searchStr(s, sub string) bool {
 	}
 	return false
 }
+
+func TestResolvePort(t *testing.T) {
+	cfg := &Config{Ports: []int{3000, 5173}}
+
+	tests := []struct {
+		name      string
+		requested int
+		want      int
+		wantErr   bool
+	}{
+		{name: "zero selects first port", requested: 0, want: 3000},
+		{name: "first port", requested: 3000, want: 3000},
+		{name: "second port", requested: 5173, want: 5173},
+		{name: "port not in allow-list", requested: 8080, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cfg.ResolvePort(tt.requested)
+			if tt.wantErr {
+				if !errors.Is(err, ErrPortNotAllowed) {
+					t.Fatalf("expected ErrPortNotAllowed, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ResolvePort(%d) = %d, want %d", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		want    []PortRange
+		wantErr string
+	}{
+		{
+			name:  "range and single port",
+			input: []string{"3000-3999", " 8080 "},
+			want:  []PortRange{{3000, 3999}, {8080, 8080}},
+		},
+		{
+			name:  "skips empty strings",
+			input: []string{"", "1024-65535"},
+			want:  []PortRange{{1024, 65535}},
+		},
+		{
+			name:  "empty slice",
+			input: []string{},
+			want:  nil,
+		},
+		{
+			name:    "reversed range",
+			input:   []string{"4000-3000"},
+			wantErr: "first port is greater than last",
+		},
+		{
+			name:    "out of range bound",
+			input:   []string{"3000-70000"},
+			wantErr: "port 70000 out of valid range",
+		},
+		{
+			name:    "non-numeric bound",
+			input:   []string{"web-3000"},
+			wantErr: "invalid port",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePortRanges(tt.input)
+			if tt.wantErr != "" {
+				if err == nil || !containsStr(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ParsePortRanges(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverable(t *testing.T) {
+	cfg := &Config{
+		Ports:           []int{3000},
+		HealthPort:      9090,
+		ListenPort:      7000,
+		DiscoverInclude: []PortRange{{1024, 65535}},
+		DiscoverExclude: []PortRange{{5432, 5432}, {6000, 6999}},
+	}
+
+	tests := []struct {
+		port int
+		want bool
+	}{
+		{5173, true},
+		{3000, false}, // already configured
+		{9090, false}, // health port
+		{7000, false}, // agent's listener
+		{22, false},   // outside include
+		{5432, false}, // excluded
+		{6500, false}, // excluded range
+	}
+	for _, tt := range tests {
+		if got := cfg.Discoverable(tt.port); got != tt.want {
+			t.Errorf("Discoverable(%d) = %v, want %v", tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestDiscoveredPortsAreRoutable(t *testing.T) {
+	cfg := &Config{Ports: []int{3000}}
+	if cfg.AllowsPort(5173) {
+		t.Fatal("port 5173 allowed before discovery")
+	}
+	cfg.AddDiscoveredPort(5173)
+	if got, err := cfg.ResolvePort(5173); err != nil || got != 5173 {
+		t.Errorf("ResolvePort(5173) = %d, %v after discovery", got, err)
+	}
+	cfg.RemoveDiscoveredPort(5173)
+	if cfg.AllowsPort(5173) {
+		t.Error("port 5173 still allowed after removal")
+	}
+}
+
+func TestParseUpstreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		want    map[int]Upstream
+		wantErr string
+	}{
+		{
+			name:  "unix socket and tcp address",
+			input: []string{"3000=unix:/run/app.sock", " 8080=10.0.0.5:80 "},
+			want: map[int]Upstream{
+				3000: {Network: "unix", Address: "/run/app.sock"},
+				8080: {Network: "tcp", Address: "10.0.0.5:80"},
+			},
+		},
+		{
+			name:  "ipv6 address",
+			input: []string{"5173=[::1]:5173"},
+			want:  map[int]Upstream{5173: {Network: "tcp", Address: "[::1]:5173"}},
+		},
+		{
+			name:    "missing address",
+			input:   []string{"3000"},
+			wantErr: "expected PORT=ADDRESS",
+		},
+		{
+			name:    "empty socket path",
+			input:   []string{"3000=unix:"},
+			wantErr: "empty socket path",
+		},
+		{
+			name:    "address without port",
+			input:   []string{"3000=localhost"},
+			wantErr: "missing port",
+		},
+		{
+			name:    "invalid port",
+			input:   []string{"0=localhost:3000"},
+			wantErr: "out of valid range",
+		},
+		{
+			name:    "duplicate port",
+			input:   []string{"3000=unix:/a.sock", "3000=unix:/b.sock"},
+			wantErr: "given twice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUpstreams(tt.input)
+			if tt.wantErr != "" {
+				if err == nil || !containsStr(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("ParseUpstreams(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowsCommand(t *testing.T) {
+	cfg := &Config{ExecAllow: []string{"bash", "/usr/bin/node"}}
+	for name, want := range map[string]bool{
+		"bash":          true,
+		"/usr/bin/node": true,
+		"/bin/bash":     false,
+		"node":          false,
+		"sh":            false,
+		"":              false,
+	} {
+		if got := cfg.AllowsCommand(name); got != want {
+			t.Errorf("AllowsCommand(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if (&Config{}).AllowsCommand("bash") {
+		t.Error("an empty allow-list must allow nothing")
+	}
+}
+
+func TestAllowsExecEnv(t *testing.T) {
+	for entry, want := range map[string]bool{
+		"GREETING=hello":         true,
+		"TERM=xterm":             true,
+		"EMPTY=":                 true,
+		"LD_PRELOAD=/tmp/x.so":   false,
+		"LD_LIBRARY_PATH=/tmp":   false,
+		"DYLD_INSERT_LIBRARIES=": false,
+		"PATH=/tmp":              false,
+		"BASH_ENV=/tmp/x.sh":     false,
+		"BASH_FUNC_ls%%=() { :}": false,
+		"NODE_OPTIONS=-r x":      false,
+		"NOEQUALS":               false,
+		"=value":                 false,
+	} {
+		if got := AllowsExecEnv(entry); got != want {
+			t.Errorf("AllowsExecEnv(%q) = %v, want %v", entry, got, want)
+		}
+	}
+}
+
+func TestAllowsFilePath(t *testing.T) {
+	cfg := &Config{FileRoots: []string{"/srv/app", "/var/log"}}
+	for path, want := range map[string]bool{
+		"/srv/app":             true,
+		"/srv/app/dist/a.js":   true,
+		"/var/log/app.log":     true,
+		"/srv/application":     false,
+		"/srv":                 false,
+		"/etc/passwd":          false,
+		"/srv/app/../app2/x":   false,
+		"/srv/app/..hidden/ok": true,
+	} {
+		// Callers resolve paths before checking them.
+		if got := cfg.AllowsFilePath(filepath.Clean(path)); got != want {
+			t.Errorf("AllowsFilePath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestParseFileRoots(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots, err := ParseFileRoots([]string{" " + link + " ", ""})
+	if err != nil {
+		t.Fatalf("ParseFileRoots: %v", err)
+	}
+	if !slices.Equal(roots, []string{real}) {
+		t.Errorf("roots = %v, want [%s]", roots, real)
+	}
+	for _, bad := range []string{"relative/dir", file, filepath.Join(dir, "missing")} {
+		if _, err := ParseFileRoots([]string{bad}); err == nil {
+			t.Errorf("ParseFileRoots(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestReadAuthToken(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	if err := os.WriteFile(path, []byte("  s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	token, err := ReadAuthToken(path)
+	if err != nil {
+		t.Fatalf("ReadAuthToken: %v", err)
+	}
+	if token != "s3cret" {
+		t.Errorf("token = %q, want %q", token, "s3cret")
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{empty, filepath.Join(dir, "missing")} {
+		if _, err := ReadAuthToken(bad); err == nil {
+			t.Errorf("ReadAuthToken(%q) succeeded", bad)
+		}
+	}
+}
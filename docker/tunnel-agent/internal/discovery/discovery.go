@@ -0,0 +1,218 @@
+// Package discovery finds the TCP ports that processes inside the container
+// listen on, by polling /proc/net/tcp and /proc/net/tcp6, so dev servers
+// started on ports missing from --ports can still be reached.
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/config"
+)
+
+// ProcNetTCP lists the kernel's socket tables read by a Watcher.
+var ProcNetTCP = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+
+// tcpListen is the socket state of a listening socket in /proc/net/tcp.
+const tcpListen = "0A"
+
+// Listener is a listening socket found in a socket table.
+type Listener struct {
+	Addr netip.Addr
+	Port int
+}
+
+// reachable reports whether the agent can connect to l over loopback: it is
+// bound to a loopback or wildcard address.
+func (l Listener) reachable() bool {
+	addr := l.Addr.Unmap()
+	return addr.IsLoopback() || addr.IsUnspecified()
+}
+
+// ParseProcNetTCP returns the listening sockets in a /proc/net/tcp or
+// /proc/net/tcp6 table.
+func ParseProcNetTCP(r io.Reader) ([]Listener, error) {
+	var listeners []Listener
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpListen {
+			continue
+		}
+		l, err := parseLocalAddress(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, scanner.Err()
+}
+
+// parseLocalAddress parses an "ADDR:PORT" column, where ADDR is the address
+// in hex as 32-bit words in host byte order and PORT is big-endian hex.
+func parseLocalAddress(field string) (Listener, error) {
+	addrHex, portHex, ok := strings.Cut(field, ":")
+	if !ok {
+		return Listener{}, fmt.Errorf("discovery: malformed address %q", field)
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return Listener{}, fmt.Errorf("discovery: malformed port in %q: %w", field, err)
+	}
+	raw, err := hex.DecodeString(addrHex)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return Listener{}, fmt.Errorf("discovery: malformed address %q", field)
+	}
+	// Each 32-bit word is in host byte order, which is little-endian on
+	// every platform the agent ships for.
+	for i := 0; i < len(raw); i += 4 {
+		slices.Reverse(raw[i : i+4])
+	}
+	addr, _ := netip.AddrFromSlice(raw)
+	return Listener{Addr: addr, Port: int(port)}, nil
+}
+
+// Watcher polls the socket tables and tracks the ports that cfg allows to be
+// discovered. Subscribers are notified whenever a port opens or closes. When
+// cfg.DiscoverRoute is set, open ports are made routable in cfg. A nil
+// *Watcher reports no ports.
+type Watcher struct {
+	cfg   *config.Config
+	paths []string
+
+	mu   sync.Mutex
+	open map[int]bool
+	subs map[chan struct{}]struct{}
+}
+
+// NewWatcher creates a Watcher that reads the tables in ProcNetTCP.
+func NewWatcher(cfg *config.Config) *Watcher {
+	return &Watcher{
+		cfg:   cfg,
+		paths: ProcNetTCP,
+		open:  make(map[int]bool),
+		subs:  make(map[chan struct{}]struct{}),
+	}
+}
+
+// Run scans immediately and then every cfg.DiscoverInterval until ctx is
+// cancelled.
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.DiscoverInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.Scan(); err != nil {
+			slog.Warn("port discovery scan failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan reads the socket tables once and records which ports opened or closed
+// since the previous scan. A missing table, such as tcp6 on a host without
+// IPv6, is skipped.
+func (w *Watcher) Scan() error {
+	found := make(map[int]bool)
+	for _, path := range w.paths {
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		listeners, err := ParseProcNetTCP(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, l := range listeners {
+			if l.reachable() && w.cfg.Discoverable(l.Port) {
+				found[l.Port] = true
+			}
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	changed := false
+	for port := range found {
+		if w.open[port] {
+			continue
+		}
+		w.open[port] = true
+		changed = true
+		if w.cfg.DiscoverRoute {
+			w.cfg.AddDiscoveredPort(port)
+		}
+		slog.Info("discovered listening port", "port", port, "routable", w.cfg.DiscoverRoute)
+	}
+	for port := range w.open {
+		if found[port] {
+			continue
+		}
+		delete(w.open, port)
+		changed = true
+		w.cfg.RemoveDiscoveredPort(port)
+		slog.Info("discovered port closed", "port", port)
+	}
+	if changed {
+		for ch := range w.subs {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// Ports returns the open discovered ports in ascending order.
+func (w *Watcher) Ports() []int {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ports := make([]int, 0, len(w.open))
+	for port := range w.open {
+		ports = append(ports, port)
+	}
+	slices.Sort(ports)
+	return ports
+}
+
+// Subscribe returns a channel that receives a signal after one or more ports
+// open or close, and a function that ends the subscription. Signals coalesce,
+// so a subscriber reads Ports after each one.
+func (w *Watcher) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	if w == nil {
+		return ch, func() {}
+	}
+	w.mu.Lock()
+	w.subs[ch] = struct{}{}
+	w.mu.Unlock()
+	return ch, func() {
+		w.mu.Lock()
+		delete(w.subs, ch)
+		w.mu.Unlock()
+	}
+}
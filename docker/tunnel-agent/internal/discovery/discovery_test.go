@@ -0,0 +1,157 @@
+package discovery
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/config"
+)
+
+const tcpHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+// tcpLine formats a /proc/net/tcp entry with the given local address and state.
+func tcpLine(local, state string) string {
+	return "   0: " + local + " 00000000:0000 " + state + " 00000000:00000000 00:00000000 00000000  1000        0 12345 1 0000000000000000 100 0 0 10 0\n"
+}
+
+func TestParseProcNetTCP(t *testing.T) {
+	table := tcpHeader +
+		tcpLine("0100007F:0BB8", "0A") + // 127.0.0.1:3000 listening
+		tcpLine("00000000:1435", "0A") + // 0.0.0.0:5173 listening
+		tcpLine("0100007F:0BB8", "01") + // established connection
+		tcpLine("0200A8C0:1F90", "0A") //   192.168.0.2:8080 listening
+
+	listeners, err := ParseProcNetTCP(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("ParseProcNetTCP: %v", err)
+	}
+	want := []Listener{
+		{Addr: netip.MustParseAddr("127.0.0.1"), Port: 3000},
+		{Addr: netip.MustParseAddr("0.0.0.0"), Port: 5173},
+		{Addr: netip.MustParseAddr("192.168.0.2"), Port: 8080},
+	}
+	if !slices.Equal(listeners, want) {
+		t.Errorf("listeners = %v, want %v", listeners, want)
+	}
+}
+
+func TestParseProcNetTCP6(t *testing.T) {
+	table := tcpHeader +
+		tcpLine("00000000000000000000000001000000:0BB8", "0A") + // [::1]:3000
+		tcpLine("00000000000000000000000000000000:1435", "0A") + // [::]:5173
+		tcpLine("0000000000000000FFFF00000100007F:1F90", "0A") //   [::ffff:127.0.0.1]:8080
+
+	listeners, err := ParseProcNetTCP(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("ParseProcNetTCP: %v", err)
+	}
+	want := []Listener{
+		{Addr: netip.MustParseAddr("::1"), Port: 3000},
+		{Addr: netip.MustParseAddr("::"), Port: 5173},
+		{Addr: netip.MustParseAddr("::ffff:127.0.0.1"), Port: 8080},
+	}
+	if !slices.Equal(listeners, want) {
+		t.Errorf("listeners = %v, want %v", listeners, want)
+	}
+	for _, l := range listeners {
+		if !l.reachable() {
+			t.Errorf("%v should be reachable over loopback", l)
+		}
+	}
+}
+
+func TestParseProcNetTCPMalformed(t *testing.T) {
+	if _, err := ParseProcNetTCP(strings.NewReader(tcpHeader + tcpLine("XYZ:0BB8", "0A"))); err == nil {
+		t.Error("expected an error for a malformed address")
+	}
+}
+
+// newTestWatcher returns a Watcher reading a temporary tcp table.
+func newTestWatcher(t *testing.T, cfg *config.Config) (*Watcher, func(entries ...string)) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tcp")
+	write := func(entries ...string) {
+		if err := os.WriteFile(path, []byte(tcpHeader+strings.Join(entries, "")), 0o644); err != nil {
+			t.Fatalf("write table: %v", err)
+		}
+	}
+	write()
+	w := NewWatcher(cfg)
+	w.paths = []string{path, filepath.Join(t.TempDir(), "missing")}
+	return w, write
+}
+
+func TestWatcherTracksPorts(t *testing.T) {
+	cfg := &config.Config{
+		Ports:            []int{3000},
+		DiscoverInterval: time.Hour,
+		DiscoverInclude:  []config.PortRange{{First: 1024, Last: 65535}},
+		DiscoverExclude:  []config.PortRange{{First: 5432, Last: 5432}},
+		DiscoverRoute:    true,
+	}
+	w, write := newTestWatcher(t, cfg)
+	changes, unsubscribe := w.Subscribe()
+	defer unsubscribe()
+
+	write(
+		tcpLine("0100007F:0BB8", "0A"), // 3000, already configured
+		tcpLine("00000000:1435", "0A"), // 5173
+		tcpLine("0100007F:1538", "0A"), // 5432, excluded
+		tcpLine("0200A8C0:1F90", "0A"), // 8080 on a non-loopback address
+		tcpLine("0100007F:0016", "0A"), // 22, outside the include range
+	)
+	if err := w.Scan(); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if got := w.Ports(); !slices.Equal(got, []int{5173}) {
+		t.Errorf("Ports() = %v, want [5173]", got)
+	}
+	if !cfg.AllowsPort(5173) {
+		t.Error("discovered port 5173 should be routable")
+	}
+	select {
+	case <-changes:
+	default:
+		t.Error("expected a signal when 5173 opened")
+	}
+
+	write()
+	if err := w.Scan(); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if got := w.Ports(); len(got) != 0 {
+		t.Errorf("Ports() = %v after close, want none", got)
+	}
+	if cfg.AllowsPort(5173) {
+		t.Error("closed port 5173 should no longer be routable")
+	}
+	select {
+	case <-changes:
+	default:
+		t.Error("expected a signal when 5173 closed")
+	}
+}
+
+func TestWatcherWithoutRouting(t *testing.T) {
+	cfg := &config.Config{
+		Ports:           []int{3000},
+		DiscoverInclude: []config.PortRange{{First: 1024, Last: 65535}},
+	}
+	w, write := newTestWatcher(t, cfg)
+
+	write(tcpLine("00000000:1435", "0A"))
+	if err := w.Scan(); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if got := w.Ports(); !slices.Equal(got, []int{5173}) {
+		t.Errorf("Ports() = %v, want [5173]", got)
+	}
+	if cfg.AllowsPort(5173) {
+		t.Error("port 5173 should only be announced when routing is disabled")
+	}
+}
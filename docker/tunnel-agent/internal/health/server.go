@@ -9,14 +9,20 @@ import (
 	"net"
 	"net/http"
 	"time"
+
+	"docker-bridge-tunnel-agent/internal/metrics"
+	"docker-bridge-tunnel-agent/internal/probe"
 )
 
 // AgentStatus is the interface used by the health server to query the agent's
-// current state. It is satisfied by *tunnel.Agent.
+// current state. It is satisfied by *tunnel.Agent and *tunnel.Server.
 type AgentStatus interface {
 	IsRunning() bool
 	Uptime() time.Duration
 	ActiveStreams() int
+	// BridgeLatency returns the round trip of the last ping the bridge
+	// answered and when the answer arrived, or a zero time without one.
+	BridgeLatency() (time.Duration, time.Time)
 }
 
 // healthResponse is the JSON body returned by GET /healthz.
@@ -24,11 +30,29 @@ type healthResponse struct {
 	Status        string  `json:"status"`
 	UptimeSeconds float64 `json:"uptime_seconds"`
 	ActiveStreams  int     `json:"active_streams"`
+	// BridgeRTTMillis and LastPong are omitted until the bridge answers a ping.
+	BridgeRTTMillis float64    `json:"bridge_rtt_ms,omitempty"`
+	LastPong        *time.Time `json:"last_pong,omitempty"`
+}
+
+// Readiness reports the state of the upstream ports. It is satisfied by
+// *probe.Prober.
+type Readiness interface {
+	States() []probe.PortState
+}
+
+// readyResponse is the JSON body returned by GET /readyz.
+type readyResponse struct {
+	Ready bool              `json:"ready"`
+	Ports []probe.PortState `json:"ports"`
 }
 
-// StartHealthServer listens on 127.0.0.1:{port} and serves GET /healthz.
+// StartHealthServer listens on 127.0.0.1:{port} and serves GET /healthz,
+// GET /readyz and the Prometheus metrics on GET /metrics. /readyz answers 200
+// once the agent is running and every port in readiness is up, and 503 until
+// then; a nil readiness only checks the agent.
 // It shuts down gracefully when ctx is cancelled.
-func StartHealthServer(ctx context.Context, port int, status AgentStatus) error {
+func StartHealthServer(ctx context.Context, port int, status AgentStatus, readiness Readiness) error {
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
 
 	mux := http.NewServeMux()
@@ -43,6 +67,10 @@ func StartHealthServer(ctx context.Context, port int, status AgentStatus) error
 			UptimeSeconds: status.Uptime().Seconds(),
 			ActiveStreams:  status.ActiveStreams(),
 		}
+		if rtt, at := status.BridgeLatency(); !at.IsZero() {
+			resp.BridgeRTTMillis = float64(rtt) / float64(time.Millisecond)
+			resp.LastPong = &at
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -51,6 +79,30 @@ func StartHealthServer(ctx context.Context, port int, status AgentStatus) error
 		}
 	})
 
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		resp := readyResponse{Ready: status.IsRunning(), Ports: []probe.PortState{}}
+		if readiness != nil {
+			resp.Ports = append(resp.Ports, readiness.States()...)
+		}
+		for _, p := range resp.Ports {
+			if p.Status != probe.StatusUp {
+				resp.Ready = false
+			}
+		}
+
+		code := http.StatusOK
+		if !resp.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Warn("health: failed to encode response", "error", err)
+		}
+	})
+
+	mux.Handle("/metrics", metrics.Default.Handler())
+
 	srv := &http.Server{
 		Addr:    addr,
 		Handler: mux,
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
+
+	"docker-bridge-tunnel-agent/internal/probe"
 )
 
 // mockAgent satisfies AgentStatus for testing.
@@ -15,11 +18,14 @@ type mockAgent struct {
 	running       bool
 	uptime        time.Duration
 	activeStreams int
+	rtt           time.Duration
+	lastPong      time.Time
 }
 
 func (m *mockAgent) IsRunning() bool    { return m.running }
 func (m *mockAgent) Uptime() time.Duration { return m.uptime }
 func (m *mockAgent) ActiveStreams() int  { return m.activeStreams }
+func (m *mockAgent) BridgeLatency() (time.Duration, time.Time) { return m.rtt, m.lastPong }
 
 func getFreePort(t *testing.T) int {
 	t.Helper()
@@ -34,13 +40,14 @@ func getFreePort(t *testing.T) int {
 
 func TestHealthEndpointRunning(t *testing.T) {
 	port := getFreePort(t)
-	agent := &mockAgent{running: true, uptime: 42 * time.Second, activeStreams: 3}
+	lastPong := time.Now().Add(-time.Second).UTC().Truncate(time.Millisecond)
+	agent := &mockAgent{running: true, uptime: 42 * time.Second, activeStreams: 3, rtt: 2500 * time.Microsecond, lastPong: lastPong}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	errCh := make(chan error, 1)
-	go func() { errCh <- StartHealthServer(ctx, port, agent) }()
+	go func() { errCh <- StartHealthServer(ctx, port, agent, nil) }()
 
 	// Wait for server to start
 	waitForServer(t, port)
@@ -71,6 +78,12 @@ func TestHealthEndpointRunning(t *testing.T) {
 	if body.UptimeSeconds < 42 {
 		t.Errorf("expected uptime >= 42s, got %f", body.UptimeSeconds)
 	}
+	if body.BridgeRTTMillis != 2.5 {
+		t.Errorf("expected bridge_rtt_ms=2.5, got %f", body.BridgeRTTMillis)
+	}
+	if body.LastPong == nil || !body.LastPong.Equal(lastPong) {
+		t.Errorf("expected last_pong=%v, got %v", lastPong, body.LastPong)
+	}
 
 	cancel()
 	if err := <-errCh; err != nil {
@@ -86,7 +99,7 @@ func TestHealthEndpointStopped(t *testing.T) {
 	defer cancel()
 
 	errCh := make(chan error, 1)
-	go func() { errCh <- StartHealthServer(ctx, port, agent) }()
+	go func() { errCh <- StartHealthServer(ctx, port, agent, nil) }()
 
 	waitForServer(t, port)
 
@@ -103,6 +116,9 @@ func TestHealthEndpointStopped(t *testing.T) {
 	if body.Status != "stopped" {
 		t.Errorf("expected status=stopped, got %q", body.Status)
 	}
+	if body.LastPong != nil {
+		t.Errorf("expected no last_pong before a ping is answered, got %v", body.LastPong)
+	}
 
 	cancel()
 	<-errCh
@@ -116,7 +132,7 @@ func TestHealthEndpoint404(t *testing.T) {
 	defer cancel()
 
 	errCh := make(chan error, 1)
-	go func() { errCh <- StartHealthServer(ctx, port, agent) }()
+	go func() { errCh <- StartHealthServer(ctx, port, agent, nil) }()
 
 	waitForServer(t, port)
 
@@ -141,7 +157,7 @@ func TestHealthGracefulShutdown(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	errCh := make(chan error, 1)
-	go func() { errCh <- StartHealthServer(ctx, port, agent) }()
+	go func() { errCh <- StartHealthServer(ctx, port, agent, nil) }()
 
 	waitForServer(t, port)
 
@@ -170,3 +186,85 @@ func waitForServer(t *testing.T, port int) {
 	}
 	t.Fatal("server did not start in time")
 }
+
+func TestMetricsEndpoint(t *testing.T) {
+	port := getFreePort(t)
+	agent := &mockAgent{running: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() { _ = StartHealthServer(ctx, port, agent, nil) }()
+	waitForServer(t, port)
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", port))
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected Prometheus text format, got %q", ct)
+	}
+}
+
+// mockReadiness satisfies Readiness for testing.
+type mockReadiness struct {
+	states []probe.PortState
+}
+
+func (m *mockReadiness) States() []probe.PortState { return m.states }
+
+func TestReadyEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		running  bool
+		ports    []probe.PortState
+		wantCode int
+	}{
+		{"all ports up", true, []probe.PortState{{Port: 3000, Status: probe.StatusUp}, {Port: 5173, Status: probe.StatusUp}}, 200},
+		{"one port down", true, []probe.PortState{{Port: 3000, Status: probe.StatusUp}, {Port: 5173, Status: probe.StatusDown}}, 503},
+		{"not probed yet", true, []probe.PortState{{Port: 3000, Status: probe.StatusUnknown}}, 503},
+		{"agent stopped", false, []probe.PortState{{Port: 3000, Status: probe.StatusUp}}, 503},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			port := getFreePort(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go func() {
+				_ = StartHealthServer(ctx, port, &mockAgent{running: tc.running}, &mockReadiness{states: tc.ports})
+			}()
+			waitForServer(t, port)
+
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/readyz", port))
+			if err != nil {
+				t.Fatalf("GET /readyz: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.wantCode {
+				t.Errorf("expected %d, got %d", tc.wantCode, resp.StatusCode)
+			}
+			var body readyResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if body.Ready != (tc.wantCode == 200) {
+				t.Errorf("expected ready=%v, got %v", tc.wantCode == 200, body.Ready)
+			}
+			if len(body.Ports) != len(tc.ports) {
+				t.Fatalf("expected %d ports, got %d", len(tc.ports), len(body.Ports))
+			}
+			for i, p := range body.Ports {
+				if p.Port != tc.ports[i].Port || p.Status != tc.ports[i].Status {
+					t.Errorf("port %d: got %+v, want %+v", i, p, tc.ports[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("test_requests_total", "Requests served.", "port", "code")
+	streams := r.NewGaugeVec("test_streams", "Open streams.", "protocol")
+	latency := r.NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "port")
+
+	requests.WithLabelValues("3000", "2xx").Inc()
+	requests.WithLabelValues("3000", "2xx").Add(2)
+	requests.WithLabelValues("3000", "5xx").Inc()
+	streams.WithLabelValues("ws").Inc()
+	streams.WithLabelValues("ws").Inc()
+	streams.WithLabelValues("ws").Dec()
+	latency.WithLabelValues("3000").Observe(0.05)
+	latency.WithLabelValues("3000").Observe(0.5)
+	latency.WithLabelValues("3000").Observe(5)
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	want := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{port="3000",le="0.1"} 1
+test_latency_seconds_bucket{port="3000",le="1"} 2
+test_latency_seconds_bucket{port="3000",le="+Inf"} 3
+test_latency_seconds_sum{port="3000"} 5.55
+test_latency_seconds_count{port="3000"} 3
+# HELP test_requests_total Requests served.
+# TYPE test_requests_total counter
+test_requests_total{port="3000",code="2xx"} 3
+test_requests_total{port="3000",code="5xx"} 1
+# HELP test_streams Open streams.
+# TYPE test_streams gauge
+test_streams{protocol="ws"} 1
+`
+	if got := b.String(); got != want {
+		t.Errorf("WriteText() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_total", "Help with \\ and\nnewline.", "reason")
+	c.WithLabelValues("say \"hi\"\n").Inc()
+
+	var b strings.Builder
+	_ = r.WriteText(&b)
+	for _, want := range []string{
+		`# HELP test_total Help with \\ and\nnewline.`,
+		`test_total{reason="say \"hi\"\n"} 1`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestMetricWithoutLabels(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Total.").WithLabelValues().Inc()
+
+	var b strings.Builder
+	_ = r.WriteText(&b)
+	if !strings.Contains(b.String(), "\ntest_total 1\n") {
+		t.Errorf("expected unlabelled sample, got:\n%s", b.String())
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Total.")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected duplicate registration to panic")
+		}
+	}()
+	r.NewGaugeVec("test_total", "Total.")
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeVec("test_up", "Up.").WithLabelValues().Set(1)
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "test_up 1") {
+		t.Errorf("body missing sample:\n%s", rec.Body.String())
+	}
+}
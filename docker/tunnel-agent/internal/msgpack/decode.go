@@ -0,0 +1,504 @@
+package msgpack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// decoder reads MessagePack values from data starting at off.
+type decoder struct {
+	data  []byte
+	off   int
+	depth int // arrays and maps open at off
+}
+
+// enter records the start of an array or map, failing past MaxDepth. Every
+// successful enter is paired with a leave once the container ends.
+func (d *decoder) enter() error {
+	if d.depth >= MaxDepth {
+		return ErrTooDeep
+	}
+	d.depth++
+	return nil
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+// next returns the next n bytes.
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.off < n {
+		return nil, ErrTruncated
+	}
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// length reads a big-endian length of size bytes.
+func (d *decoder) length(size int) (int, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+// kind classifies a MessagePack value by its format byte.
+type kind int
+
+const (
+	kindNil kind = iota
+	kindBool
+	kindInt
+	kindUint
+	kindFloat
+	kindStr
+	kindBin
+	kindArray
+	kindMap
+)
+
+// token is the head of a value: its kind and, for scalars, its value. For
+// str and bin n is the byte length; for arrays and maps the element count.
+type token struct {
+	kind kind
+	b    bool
+	i    int64
+	u    uint64
+	f    float64
+	n    int
+}
+
+func (d *decoder) token() (token, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return token{}, err
+	}
+	switch {
+	case c <= 0x7f:
+		return token{kind: kindUint, u: uint64(c)}, nil
+	case c >= 0xe0:
+		return token{kind: kindInt, i: int64(int8(c))}, nil
+	case c&0xf0 == 0x80:
+		return token{kind: kindMap, n: int(c & 0x0f)}, nil
+	case c&0xf0 == 0x90:
+		return token{kind: kindArray, n: int(c & 0x0f)}, nil
+	case c&0xe0 == 0xa0:
+		return token{kind: kindStr, n: int(c & 0x1f)}, nil
+	}
+
+	var t token
+	switch c {
+	case codeNil:
+		t.kind = kindNil
+	case codeFalse, codeTrue:
+		t.kind, t.b = kindBool, c == codeTrue
+	case codeUint8, codeUint16, codeUint32, codeUint64:
+		b, err := d.next(1 << (c - codeUint8))
+		if err != nil {
+			return t, err
+		}
+		t.kind, t.u = kindUint, beUint(b)
+	case codeInt8, codeInt16, codeInt32, codeInt64:
+		b, err := d.next(1 << (c - codeInt8))
+		if err != nil {
+			return t, err
+		}
+		t.kind = kindInt
+		switch len(b) {
+		case 1:
+			t.i = int64(int8(b[0]))
+		case 2:
+			t.i = int64(int16(binary.BigEndian.Uint16(b)))
+		case 4:
+			t.i = int64(int32(binary.BigEndian.Uint32(b)))
+		default:
+			t.i = int64(binary.BigEndian.Uint64(b))
+		}
+	case codeFloat32:
+		b, err := d.next(4)
+		if err != nil {
+			return t, err
+		}
+		t.kind, t.f = kindFloat, float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case codeFloat64:
+		b, err := d.next(8)
+		if err != nil {
+			return t, err
+		}
+		t.kind, t.f = kindFloat, math.Float64frombits(binary.BigEndian.Uint64(b))
+	case codeStr8, codeStr16, codeStr32:
+		t.kind = kindStr
+		t.n, err = d.length(1 << (c - codeStr8))
+	case codeBin8, codeBin16, codeBin32:
+		t.kind = kindBin
+		t.n, err = d.length(1 << (c - codeBin8))
+	case codeArray16, codeArray32:
+		t.kind = kindArray
+		t.n, err = d.length(2 << (c - codeArray16))
+	case codeMap16, codeMap32:
+		t.kind = kindMap
+		t.n, err = d.length(2 << (c - codeMap16))
+	default:
+		return t, fmt.Errorf("msgpack: unsupported format 0x%02x at offset %d", c, d.off-1)
+	}
+	return t, err
+}
+
+func beUint(b []byte) uint64 {
+	var u uint64
+	for _, x := range b {
+		u = u<<8 | uint64(x)
+	}
+	return u
+}
+
+// value decodes the next value into v.
+func (d *decoder) value(v reflect.Value) error {
+	t, err := d.token()
+	if err != nil {
+		return err
+	}
+	return d.into(t, v)
+}
+
+// into decodes the value headed by t into v.
+func (d *decoder) into(t token, v reflect.Value) error {
+	if t.kind == kindNil {
+		v.SetZero()
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.into(t, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("msgpack: cannot decode into %s", v.Type())
+		}
+		x, err := d.anyValue(t)
+		if err != nil {
+			return err
+		}
+		if x != nil {
+			v.Set(reflect.ValueOf(x))
+		}
+		return nil
+	}
+
+	switch t.kind {
+	case kindBool:
+		if v.Kind() != reflect.Bool {
+			return mismatch("bool", v)
+		}
+		v.SetBool(t.b)
+	case kindInt, kindUint:
+		return setNumber(t, v)
+	case kindFloat:
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return mismatch("float", v)
+		}
+		v.SetFloat(t.f)
+	case kindStr, kindBin:
+		b, err := d.next(t.n)
+		if err != nil {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(b))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte(nil), b...))
+		default:
+			return mismatch("string", v)
+		}
+	case kindArray:
+		return d.array(t.n, v)
+	case kindMap:
+		switch v.Kind() {
+		case reflect.Struct:
+			return d.structMap(t.n, v)
+		case reflect.Map:
+			return d.mapValue(t.n, v)
+		}
+		return mismatch("map", v)
+	}
+	return nil
+}
+
+func mismatch(what string, v reflect.Value) error {
+	return fmt.Errorf("msgpack: cannot decode %s into %s", what, v.Type())
+}
+
+func setNumber(t token, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := t.i
+		if t.kind == kindUint {
+			if t.u > math.MaxInt64 {
+				return fmt.Errorf("msgpack: %d overflows %s", t.u, v.Type())
+			}
+			n = int64(t.u)
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if t.kind == kindInt && t.i < 0 {
+			return fmt.Errorf("msgpack: %d overflows %s", t.i, v.Type())
+		}
+		n := t.u
+		if t.kind == kindInt {
+			n = uint64(t.i)
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		if t.kind == kindInt {
+			v.SetFloat(float64(t.i))
+		} else {
+			v.SetFloat(float64(t.u))
+		}
+	default:
+		return mismatch("integer", v)
+	}
+	return nil
+}
+
+func (d *decoder) array(n int, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	switch v.Kind() {
+	case reflect.Slice:
+		// Each element takes at least one byte, which bounds the allocation.
+		if n > len(d.data)-d.off {
+			return ErrTruncated
+		}
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := range n {
+			if err := d.value(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		for i := range n {
+			if i < v.Len() {
+				if err := d.value(v.Index(i)); err != nil {
+					return err
+				}
+			} else if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch("array", v)
+	}
+	return nil
+}
+
+// key reads a map key, which must be a string.
+func (d *decoder) key() (string, error) {
+	t, err := d.token()
+	if err != nil {
+		return "", err
+	}
+	if t.kind != kindStr {
+		return "", fmt.Errorf("msgpack: map key is not a string")
+	}
+	b, err := d.next(t.n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *decoder) mapValue(n int, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	if v.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("msgpack: unsupported map key type %s", v.Type().Key())
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	elem := reflect.New(v.Type().Elem()).Elem()
+	for range n {
+		k, err := d.key()
+		if err != nil {
+			return err
+		}
+		elem.SetZero()
+		if err := d.value(elem); err != nil {
+			return err
+		}
+		v.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), elem)
+	}
+	return nil
+}
+
+// structMap decodes a map into the fields of struct v. Unknown keys are
+// skipped, as encoding/json does.
+func (d *decoder) structMap(n int, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	fields := fieldsOf(v.Type())
+	for range n {
+		k, err := d.key()
+		if err != nil {
+			return err
+		}
+		f := lookupField(fields, k)
+		if f == nil {
+			if err := d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		fv := v
+		for i, x := range f.index {
+			if i > 0 && fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(x)
+		}
+		if err := d.value(fv); err != nil {
+			return fmt.Errorf("%w (field %q)", err, k)
+		}
+	}
+	return nil
+}
+
+func lookupField(fields []field, name string) *field {
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// skip discards the next value.
+func (d *decoder) skip() error {
+	t, err := d.token()
+	if err != nil {
+		return err
+	}
+	switch t.kind {
+	case kindStr, kindBin:
+		_, err = d.next(t.n)
+		return err
+	case kindArray, kindMap:
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+	}
+	switch t.kind {
+	case kindArray:
+		for range t.n {
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	case kindMap:
+		for range 2 * t.n {
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// anyValue decodes the value headed by t into the types encoding/json uses for an
+// interface{}: maps become map[string]any and arrays []any. Integers are kept
+// as int64 or uint64, and bin values as []byte.
+func (d *decoder) anyValue(t token) (any, error) {
+	switch t.kind {
+	case kindNil:
+		return nil, nil
+	case kindBool:
+		return t.b, nil
+	case kindInt:
+		return t.i, nil
+	case kindUint:
+		return t.u, nil
+	case kindFloat:
+		return t.f, nil
+	case kindStr:
+		b, err := d.next(t.n)
+		return string(b), err
+	case kindBin:
+		b, err := d.next(t.n)
+		return append([]byte(nil), b...), err
+	}
+
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	if t.kind == kindArray {
+		if t.n > len(d.data)-d.off {
+			return nil, ErrTruncated
+		}
+		s := make([]any, t.n)
+		for i := range s {
+			et, err := d.token()
+			if err != nil {
+				return nil, err
+			}
+			if s[i], err = d.anyValue(et); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	m := make(map[string]any, min(t.n, len(d.data)-d.off))
+	for range t.n {
+		k, err := d.key()
+		if err != nil {
+			return nil, err
+		}
+		et, err := d.token()
+		if err != nil {
+			return nil, err
+		}
+		if m[k], err = d.anyValue(et); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,370 @@
+// Package msgpack encodes and decodes the MessagePack subset used for compact
+// tunnel envelopes. Structs are encoded as maps keyed by their json tags, so
+// one set of message types serves both encodings: the same field names,
+// omitempty and omitzero rules and embedded-struct flattening as
+// encoding/json. Maps must have string keys, and custom json.Marshaler
+// implementations are not consulted.
+package msgpack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Format bytes from the MessagePack specification.
+const (
+	codeNil     = 0xc0
+	codeFalse   = 0xc2
+	codeTrue    = 0xc3
+	codeBin8    = 0xc4
+	codeBin16   = 0xc5
+	codeBin32   = 0xc6
+	codeFloat32 = 0xca
+	codeFloat64 = 0xcb
+	codeUint8   = 0xcc
+	codeUint16  = 0xcd
+	codeUint32  = 0xce
+	codeUint64  = 0xcf
+	codeInt8    = 0xd0
+	codeInt16   = 0xd1
+	codeInt32   = 0xd2
+	codeInt64   = 0xd3
+	codeStr8    = 0xd9
+	codeStr16   = 0xda
+	codeStr32   = 0xdb
+	codeArray16 = 0xdc
+	codeArray32 = 0xdd
+	codeMap16   = 0xde
+	codeMap32   = 0xdf
+)
+
+// ErrTruncated is returned when the input ends inside a value.
+var ErrTruncated = errors.New("msgpack: unexpected end of data")
+
+// MaxDepth is how deeply arrays and maps may nest in decoded input.
+const MaxDepth = 64
+
+// ErrTooDeep is returned when arrays and maps in the input nest deeper than
+// MaxDepth, which would otherwise let a small input exhaust the stack.
+var ErrTooDeep = errors.New("msgpack: nesting too deep")
+
+// Marshal returns the MessagePack encoding of v.
+func Marshal(v any) ([]byte, error) {
+	return Append(nil, v)
+}
+
+// Append appends the MessagePack encoding of v to dst.
+func Append(dst []byte, v any) ([]byte, error) {
+	return appendValue(dst, reflect.ValueOf(v))
+}
+
+// Unmarshal decodes the single MessagePack value in data into v, which must
+// be a non-nil pointer.
+func Unmarshal(data []byte, v any) error {
+	rest, err := UnmarshalPrefix(data, v)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("msgpack: %d bytes after value", len(rest))
+	}
+	return nil
+}
+
+// UnmarshalPrefix decodes the MessagePack value at the start of data into v
+// and returns the bytes that follow it.
+func UnmarshalPrefix(data []byte, v any) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return nil, fmt.Errorf("msgpack: Unmarshal requires a non-nil pointer, got %T", v)
+	}
+	d := decoder{data: data}
+	if err := d.value(rv.Elem()); err != nil {
+		return nil, err
+	}
+	return d.data[d.off:], nil
+}
+
+// field describes how one struct field is encoded.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	omitZero  bool
+}
+
+var fieldCache sync.Map // reflect.Type -> []field
+
+// fieldsOf returns the encoded fields of struct type t, following the
+// encoding/json rules for tags and embedded structs.
+func fieldsOf(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	var fields []field
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := range t.NumField() {
+			sf := t.Field(i)
+			tag := sf.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			idx := append(slices.Clone(index), i)
+			if sf.Anonymous && name == "" {
+				ft := sf.Type
+				if ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					walk(ft, idx)
+					continue
+				}
+			}
+			if !sf.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+			fields = append(fields, field{
+				name:      name,
+				index:     idx,
+				omitEmpty: hasOption(opts, "omitempty"),
+				omitZero:  hasOption(opts, "omitzero"),
+			})
+		}
+	}
+	walk(t, nil)
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+func hasOption(opts, name string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldByIndex returns the field of v at index, or false when it is inside a
+// nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isEmpty reports whether v is empty in the sense of json's omitempty.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+func appendValue(dst []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(dst, codeNil), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(dst, codeTrue), nil
+		}
+		return append(dst, codeFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return AppendInt(dst, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendUint(dst, v.Uint()), nil
+	case reflect.Float32:
+		dst = append(dst, codeFloat32)
+		return binary.BigEndian.AppendUint32(dst, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		dst = append(dst, codeFloat64)
+		return binary.BigEndian.AppendUint64(dst, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return AppendString(dst, v.String()), nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(dst, codeNil), nil
+		}
+		return appendValue(dst, v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(dst, codeNil), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return AppendBytes(dst, v.Bytes()), nil
+		}
+		fallthrough
+	case reflect.Array:
+		dst = AppendArrayHeader(dst, v.Len())
+		for i := range v.Len() {
+			var err error
+			if dst, err = appendValue(dst, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return dst, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(dst, codeNil), nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("msgpack: unsupported map key type %s", v.Type().Key())
+		}
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+		dst = AppendMapHeader(dst, len(keys))
+		for _, k := range keys {
+			dst = AppendString(dst, k.String())
+			var err error
+			if dst, err = appendValue(dst, v.MapIndex(k)); err != nil {
+				return nil, err
+			}
+		}
+		return dst, nil
+	case reflect.Struct:
+		return appendStruct(dst, v)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type %s", v.Type())
+}
+
+func appendStruct(dst []byte, v reflect.Value) ([]byte, error) {
+	fields := fieldsOf(v.Type())
+	values := make([]reflect.Value, 0, len(fields))
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || (f.omitEmpty && isEmpty(fv)) || (f.omitZero && fv.IsZero()) {
+			continue
+		}
+		values = append(values, fv)
+		names = append(names, f.name)
+	}
+	dst = AppendMapHeader(dst, len(values))
+	for i, fv := range values {
+		dst = AppendString(dst, names[i])
+		var err error
+		if dst, err = appendValue(dst, fv); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// AppendInt appends the shortest encoding of n.
+func AppendInt(dst []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return appendUint(dst, uint64(n))
+	case n >= -32:
+		return append(dst, byte(n))
+	case n >= math.MinInt8:
+		return append(dst, codeInt8, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(dst, codeInt16), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(dst, codeInt32), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, codeInt64), uint64(n))
+}
+
+// appendUint appends the shortest encoding of n.
+func appendUint(dst []byte, n uint64) []byte {
+	switch {
+	case n <= 0x7f:
+		return append(dst, byte(n))
+	case n <= math.MaxUint8:
+		return append(dst, codeUint8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, codeUint16), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, codeUint32), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, codeUint64), n)
+}
+
+// AppendString appends s as a MessagePack str.
+func AppendString(dst []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		dst = append(dst, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		dst = append(dst, codeStr8, byte(n))
+	case n <= math.MaxUint16:
+		dst = binary.BigEndian.AppendUint16(append(dst, codeStr16), uint16(n))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, codeStr32), uint32(n))
+	}
+	return append(dst, s...)
+}
+
+// AppendBytes appends b as a MessagePack bin.
+func AppendBytes(dst []byte, b []byte) []byte {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		dst = append(dst, codeBin8, byte(n))
+	case n <= math.MaxUint16:
+		dst = binary.BigEndian.AppendUint16(append(dst, codeBin16), uint16(n))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, codeBin32), uint32(n))
+	}
+	return append(dst, b...)
+}
+
+// AppendBool appends b.
+func AppendBool(dst []byte, b bool) []byte {
+	if b {
+		return append(dst, codeTrue)
+	}
+	return append(dst, codeFalse)
+}
+
+// AppendArrayHeader appends the header of an array of n elements.
+func AppendArrayHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, codeArray16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(dst, codeArray32), uint32(n))
+}
+
+// AppendMapHeader appends the header of a map of n key/value pairs.
+func AppendMapHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, codeMap16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(dst, codeMap32), uint32(n))
+}
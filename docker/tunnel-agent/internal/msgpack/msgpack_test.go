@@ -0,0 +1,200 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type inner struct {
+	Type     string `json:"type"`
+	StreamID string `json:"stream_id,omitempty"`
+}
+
+type message struct {
+	inner
+	Port     int                 `json:"port,omitempty"`
+	Window   int64               `json:"window"`
+	Negative int32               `json:"negative"`
+	Ratio    float64             `json:"ratio,omitempty"`
+	Success  bool                `json:"success"`
+	Headers  map[string]string   `json:"headers"`
+	Multi    map[string][]string `json:"multi,omitempty"`
+	Names    []string            `json:"names,omitempty"`
+	Data     []byte              `json:"data,omitempty"`
+	Skipped  string              `json:"-"`
+	Untagged string
+	hidden   string
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := message{
+		inner:    inner{Type: "http_request", StreamID: "stream-1"},
+		Port:     5173,
+		Window:   1 << 40,
+		Negative: -40000,
+		Ratio:    0.5,
+		Success:  true,
+		Headers:  map[string]string{"host": "localhost", "accept": strings.Repeat("x", 300)},
+		Multi:    map[string][]string{"set-cookie": {"a=1", "b=2"}},
+		Names:    []string{"one", "two"},
+		Data:     []byte{0, 1, 2, 0xff},
+		Skipped:  "not sent",
+		Untagged: "kept",
+		hidden:   "not sent",
+	}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var out message
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	in.Skipped, in.hidden = "", ""
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", out, in)
+	}
+}
+
+func TestOmitEmpty(t *testing.T) {
+	b, err := Marshal(inner{Type: "heartbeat"})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	// fixmap(1) "type" "heartbeat"
+	want := append([]byte{0x81, 0xa4}, "type"...)
+	want = append(append(want, 0xa9), "heartbeat"...)
+	if !bytes.Equal(b, want) {
+		t.Errorf("Marshal = % x, want % x", b, want)
+	}
+}
+
+func TestIntegerEncodings(t *testing.T) {
+	for _, tc := range []struct {
+		n    int64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0xcc, 0x80}},
+		{65535, []byte{0xcd, 0xff, 0xff}},
+		{1 << 16, []byte{0xce, 0, 1, 0, 0}},
+		{-1, []byte{0xff}},
+		{-32, []byte{0xe0}},
+		{-33, []byte{0xd0, 0xdf}},
+		{-129, []byte{0xd1, 0xff, 0x7f}},
+	} {
+		b, err := Marshal(tc.n)
+		if err != nil {
+			t.Fatalf("Marshal(%d): %v", tc.n, err)
+		}
+		if !bytes.Equal(b, tc.want) {
+			t.Errorf("Marshal(%d) = % x, want % x", tc.n, b, tc.want)
+		}
+		var got int64
+		if err := Unmarshal(b, &got); err != nil || got != tc.n {
+			t.Errorf("Unmarshal(% x) = %d, %v; want %d", b, got, err, tc.n)
+		}
+	}
+
+	var small int8
+	if err := Unmarshal([]byte{0xcc, 0xc8}, &small); err == nil {
+		t.Error("expected an overflow error decoding 200 into int8")
+	}
+}
+
+func TestUnmarshalPrefix(t *testing.T) {
+	b, err := Marshal(inner{Type: "body_chunk", StreamID: "s"})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	b = append(b, "payload"...)
+
+	var env inner
+	rest, err := UnmarshalPrefix(b, &env)
+	if err != nil {
+		t.Fatalf("UnmarshalPrefix: %v", err)
+	}
+	if env.Type != "body_chunk" || string(rest) != "payload" {
+		t.Errorf("got %+v with rest %q", env, rest)
+	}
+	if err := Unmarshal(b, &env); err == nil {
+		t.Error("Unmarshal should reject trailing bytes")
+	}
+}
+
+func TestUnknownFieldsSkipped(t *testing.T) {
+	b, err := Marshal(map[string]any{
+		"type":   "ready",
+		"extra":  map[string]any{"nested": []any{int64(1), "two", nil, true}},
+		"window": int64(7),
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var msg message
+	if err := Unmarshal(b, &msg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if msg.Type != "ready" || msg.Window != 7 {
+		t.Errorf("got %+v", msg)
+	}
+
+	var generic map[string]any
+	if err := Unmarshal(b, &generic); err != nil {
+		t.Fatalf("Unmarshal into map: %v", err)
+	}
+	nested := generic["extra"].(map[string]any)["nested"].([]any)
+	if nested[0] != uint64(1) || nested[1] != "two" || nested[2] != nil || nested[3] != true {
+		t.Errorf("nested = %#v", nested)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	b, err := Marshal(message{inner: inner{Type: "http_request"}, Names: []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	for i := range len(b) {
+		var msg message
+		if err := Unmarshal(b[:i], &msg); !errors.Is(err, ErrTruncated) {
+			t.Fatalf("Unmarshal of %d/%d bytes: err = %v, want ErrTruncated", i, len(b), err)
+		}
+	}
+	// A length far beyond the input must not allocate it.
+	var names []string
+	if err := Unmarshal([]byte{0xdd, 0xff, 0xff, 0xff, 0xff}, &names); !errors.Is(err, ErrTruncated) {
+		t.Errorf("err = %v, want ErrTruncated", err)
+	}
+}
+
+func TestNestingTooDeep(t *testing.T) {
+	// Arrays nested a million deep: a few bytes that would exhaust the stack
+	// of a decoder without a depth limit.
+	deep := bytes.Repeat([]byte{0x91}, 1<<20)
+
+	var v any
+	if err := Unmarshal(deep, &v); !errors.Is(err, ErrTooDeep) {
+		t.Errorf("Unmarshal into any: err = %v, want ErrTooDeep", err)
+	}
+	var nested [][][]int
+	if err := Unmarshal(deep, &nested); err == nil {
+		t.Error("Unmarshal into a slice succeeded")
+	}
+	// Skipped as the value of an unknown field.
+	withUnknown := append([]byte{0x81, 0xa5, 'e', 'x', 't', 'r', 'a'}, deep...)
+	var msg message
+	if err := Unmarshal(withUnknown, &msg); !errors.Is(err, ErrTooDeep) {
+		t.Errorf("Unmarshal skipping a field: err = %v, want ErrTooDeep", err)
+	}
+
+	// Nesting up to the limit is fine.
+	ok := append(bytes.Repeat([]byte{0x91}, MaxDepth-1), 0x90)
+	if err := Unmarshal(ok, &v); err != nil {
+		t.Errorf("Unmarshal of %d nested arrays: %v", MaxDepth, err)
+	}
+}
@@ -0,0 +1,195 @@
+// Package probe checks in the background whether anything is listening on the
+// agent's upstream ports, so the bridge can tell "dev server starting" apart
+// from a request that failed.
+package probe
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/metrics"
+	"docker-bridge-tunnel-agent/internal/upstream"
+)
+
+// DialTimeout bounds a single probe. Loopback dials normally fail at once with
+// "connection refused"; the timeout matters for filtered ports and remote
+// upstreams.
+const DialTimeout = time.Second
+
+// Status is the observed state of a port.
+type Status string
+
+const (
+	// StatusUnknown means the port has not been probed yet.
+	StatusUnknown Status = "unknown"
+	// StatusUp means the last probe connected.
+	StatusUp Status = "up"
+	// StatusDown means the last probe could not connect.
+	StatusDown Status = "down"
+)
+
+// PortState is the state of one port. Since is when the port entered Status;
+// Error is the dial error of the last failed probe.
+type PortState struct {
+	Port   int       `json:"port"`
+	Status Status    `json:"status"`
+	Since  time.Time `json:"since,omitzero"`
+	Error  string    `json:"error,omitempty"`
+}
+
+var portUp = metrics.Default.NewGaugeVec("tunnel_agent_port_up",
+	"Whether the last probe of a port connected (1) or not (0).",
+	"port")
+
+// Prober dials each port on a fixed interval and tracks whether it is up.
+// Subscribers are notified whenever a port changes state. A nil *Prober
+// reports no ports.
+type Prober struct {
+	interval time.Duration
+	dial     func(ctx context.Context, port int) error
+
+	mu     sync.Mutex
+	ports  []int
+	states map[int]PortState
+	subs   map[chan struct{}]struct{}
+}
+
+// NewProber creates a Prober for ports that probes every interval once Run is
+// called, connecting to each port's upstream with dialer.
+func NewProber(ports []int, interval time.Duration, dialer *upstream.Dialer) *Prober {
+	p := &Prober{
+		interval: interval,
+		dial: func(ctx context.Context, port int) error {
+			conn, err := dialer.Dial(ctx, port)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+		ports:  slices.Clone(ports),
+		states: make(map[int]PortState),
+		subs:   make(map[chan struct{}]struct{}),
+	}
+	for _, port := range ports {
+		p.states[port] = PortState{Port: port, Status: StatusUnknown}
+	}
+	return p
+}
+
+// Run probes every port immediately and then on each interval until ctx is
+// cancelled.
+func (p *Prober) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.ProbeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProbeAll probes every port once, concurrently, and records the results.
+func (p *Prober) ProbeAll(ctx context.Context) {
+	p.mu.Lock()
+	ports := slices.Clone(p.ports)
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, port := range ports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.dial(ctx, port)
+			if ctx.Err() != nil {
+				return
+			}
+			p.record(port, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// record stores the result of probing port and notifies subscribers when its
+// status changed.
+func (p *Prober) record(port int, err error) {
+	status, errText := StatusUp, ""
+	if err != nil {
+		status, errText = StatusDown, err.Error()
+	}
+	if status == StatusUp {
+		portUp.WithLabelValues(strconv.Itoa(port)).Set(1)
+	} else {
+		portUp.WithLabelValues(strconv.Itoa(port)).Set(0)
+	}
+
+	p.mu.Lock()
+	prev, ok := p.states[port]
+	if !ok {
+		// The port was removed while it was being probed.
+		p.mu.Unlock()
+		return
+	}
+	changed := prev.Status != status
+	state := PortState{Port: port, Status: status, Since: prev.Since, Error: errText}
+	if changed {
+		state.Since = time.Now()
+	}
+	p.states[port] = state
+	if changed {
+		p.notifyLocked()
+	}
+	p.mu.Unlock()
+
+	if changed {
+		slog.Info("port status changed", "port", port, "status", status, "previous", prev.Status)
+	}
+}
+
+// notifyLocked signals every subscriber without blocking. p.mu must be held.
+func (p *Prober) notifyLocked() {
+	for ch := range p.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// States returns the state of every port, in the order the ports were given.
+func (p *Prober) States() []PortState {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	states := make([]PortState, 0, len(p.ports))
+	for _, port := range p.ports {
+		states = append(states, p.states[port])
+	}
+	return states
+}
+
+// Subscribe returns a channel that receives a signal after one or more ports
+// change state, and a function that ends the subscription. Signals coalesce,
+// so a subscriber reads States after each one.
+func (p *Prober) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	if p == nil {
+		return ch, func() {}
+	}
+	p.mu.Lock()
+	p.subs[ch] = struct{}{}
+	p.mu.Unlock()
+	return ch, func() {
+		p.mu.Lock()
+		delete(p.subs, ch)
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,131 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/upstream"
+)
+
+// fakeDialer lets tests decide which ports are up.
+type fakeDialer struct {
+	mu sync.Mutex
+	up map[int]bool
+}
+
+func (f *fakeDialer) set(port int, up bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.up[port] = up
+}
+
+func (f *fakeDialer) dial(ctx context.Context, port int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.up[port] {
+		return nil
+	}
+	return errors.New("connection refused")
+}
+
+func newFakeProber(ports ...int) (*Prober, *fakeDialer) {
+	f := &fakeDialer{up: make(map[int]bool)}
+	p := NewProber(ports, time.Hour, nil)
+	p.dial = f.dial
+	return p, f
+}
+
+func statusOf(p *Prober, port int) Status {
+	for _, s := range p.States() {
+		if s.Port == port {
+			return s.Status
+		}
+	}
+	return ""
+}
+
+func TestProberTracksStatus(t *testing.T) {
+	p, f := newFakeProber(3000, 5173)
+	if got := statusOf(p, 3000); got != StatusUnknown {
+		t.Errorf("before probing, status = %q, want unknown", got)
+	}
+
+	f.set(3000, true)
+	p.ProbeAll(context.Background())
+	if got := statusOf(p, 3000); got != StatusUp {
+		t.Errorf("port 3000 status = %q, want up", got)
+	}
+	states := p.States()
+	if states[1].Port != 5173 || states[1].Status != StatusDown || states[1].Error == "" {
+		t.Errorf("port 5173 state = %+v, want down with an error", states[1])
+	}
+
+	since := states[0].Since
+	p.ProbeAll(context.Background())
+	if got := p.States()[0].Since; !got.Equal(since) {
+		t.Errorf("Since changed from %v to %v without a status change", since, got)
+	}
+}
+
+func TestProberNotifiesOnChange(t *testing.T) {
+	p, f := newFakeProber(3000)
+	changes, unsubscribe := p.Subscribe()
+	defer unsubscribe()
+
+	p.ProbeAll(context.Background())
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected a signal when the port was first probed")
+	}
+
+	p.ProbeAll(context.Background())
+	select {
+	case <-changes:
+		t.Fatal("unexpected signal without a status change")
+	default:
+	}
+
+	f.set(3000, true)
+	p.ProbeAll(context.Background())
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected a signal when the port came up")
+	}
+}
+
+func TestProberDialsLoopback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	p := NewProber([]int{port}, time.Hour, upstream.NewDialer(&config.Config{}, DialTimeout))
+	p.ProbeAll(context.Background())
+	if got := statusOf(p, port); got != StatusUp {
+		t.Errorf("status = %q, want up", got)
+	}
+
+	ln.Close()
+	p.ProbeAll(context.Background())
+	if got := statusOf(p, port); got != StatusDown {
+		t.Errorf("after close, status = %q, want down", got)
+	}
+}
+
+func TestNilProber(t *testing.T) {
+	var p *Prober
+	if states := p.States(); states != nil {
+		t.Errorf("States() = %v, want nil", states)
+	}
+	_, unsubscribe := p.Subscribe()
+	unsubscribe()
+}
@@ -0,0 +1,8 @@
+// Package pty allocates pseudo-terminals for interactive commands run through
+// the tunnel. Only Linux is supported; elsewhere Open returns ErrUnsupported.
+package pty
+
+import "errors"
+
+// ErrUnsupported is returned by Open on platforms without pseudo-terminals.
+var ErrUnsupported = errors.New("pty: not supported on this platform")
@@ -0,0 +1,49 @@
+package pty
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpenRunsCommandOnTerminal(t *testing.T) {
+	master, tty, err := Open()
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer master.Close()
+	if err := Setsize(master, 100, 40); err != nil {
+		t.Fatalf("Setsize: %v", err)
+	}
+
+	cmd := exec.Command("sh", "-c", "test -t 0 && stty size")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = SysProcAttr()
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	tty.Close()
+
+	_ = master.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var out bytes.Buffer
+	_, err = io.Copy(&out, master)
+	// Reading the master fails with EIO once the command has closed the tty.
+	if err != nil && !errors.Is(err, syscall.EIO) {
+		t.Fatalf("read: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("command failed: %v (output %q)", err, out.String())
+	}
+	if got := strings.TrimSpace(out.String()); got != "40 100" {
+		t.Errorf("stty size = %q, want \"40 100\"", got)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package pty
+
+import (
+	"os"
+	"syscall"
+)
+
+// Open returns ErrUnsupported.
+func Open() (master, tty *os.File, err error) {
+	return nil, nil, ErrUnsupported
+}
+
+// Setsize returns ErrUnsupported.
+func Setsize(f *os.File, cols, rows int) error {
+	return ErrUnsupported
+}
+
+// SysProcAttr returns nil.
+func SysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Frame buffers are pooled in power-of-two size classes from minBufferSize up
+// to MaxFrameSize.
+const (
+	minBufferShift = 9 // 512 B
+	maxBufferShift = 24
+	minBufferSize  = 1 << minBufferShift
+)
+
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// bufferClass returns the index of the smallest size class holding n bytes.
+func bufferClass(n int) int {
+	if n <= minBufferSize {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minBufferShift
+}
+
+// GetBuffer returns a buffer of length n, reusing a pooled one when possible.
+// Buffers larger than MaxFrameSize are not pooled.
+func GetBuffer(n int) []byte {
+	class := bufferClass(n)
+	if class >= len(bufferPools) {
+		return make([]byte, n)
+	}
+	if p, ok := bufferPools[class].Get().(*[]byte); ok {
+		return (*p)[:n]
+	}
+	return make([]byte, n, 1<<(class+minBufferShift))
+}
+
+// PutBuffer returns a buffer obtained from GetBuffer (such as a payload from
+// ReadFrame) to the pool. Buffers whose capacity is not a pool class are
+// dropped, but any other slice is pooled wherever it came from, so callers
+// must only pass memory they own outright: neither b nor any slice sharing
+// its backing array may be used afterwards.
+func PutBuffer(b []byte) {
+	c := cap(b)
+	if c < minBufferSize || c&(c-1) != 0 {
+		return
+	}
+	class := bufferClass(c)
+	if class >= len(bufferPools) {
+		return
+	}
+	b = b[:0]
+	bufferPools[class].Put(&b)
+}
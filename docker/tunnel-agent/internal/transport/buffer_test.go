@@ -0,0 +1,35 @@
+package transport
+
+import "testing"
+
+func TestGetBufferSizeClasses(t *testing.T) {
+	for _, tc := range []struct{ n, wantCap int }{
+		{0, 512},
+		{5, 512},
+		{512, 512},
+		{513, 1024},
+		{32 * 1024, 32 * 1024},
+		{1<<20 + 1, 2 << 20},
+		{int(MaxFrameSize), int(MaxFrameSize)},
+	} {
+		b := GetBuffer(tc.n)
+		if len(b) != tc.n || cap(b) != tc.wantCap {
+			t.Errorf("GetBuffer(%d): len=%d cap=%d, want len=%d cap=%d", tc.n, len(b), cap(b), tc.n, tc.wantCap)
+		}
+		PutBuffer(b)
+	}
+	if b := GetBuffer(int(MaxFrameSize) + 1); len(b) != int(MaxFrameSize)+1 {
+		t.Errorf("oversized GetBuffer: len=%d", len(b))
+	}
+}
+
+func TestPutBufferIgnoresForeignSlices(t *testing.T) {
+	// A slice whose capacity is not a size class must never be handed out.
+	PutBuffer(make([]byte, 700))
+	PutBuffer(make([]byte, 100))
+	for range 10 {
+		if b := GetBuffer(600); cap(b) != 1024 {
+			t.Fatalf("GetBuffer(600) returned cap %d, want 1024", cap(b))
+		}
+	}
+}
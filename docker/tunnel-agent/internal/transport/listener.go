@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// ConnTransport provides the same framing as StdioTransport over a network
+// connection accepted by a Listener.
+type ConnTransport struct {
+	*StdioTransport
+	conn net.Conn
+}
+
+// NewConnTransport creates a ConnTransport that frames messages over conn.
+func NewConnTransport(conn net.Conn) *ConnTransport {
+	return &ConnTransport{
+		StdioTransport: NewStdioTransportFromRW(conn, conn),
+		conn:           conn,
+	}
+}
+
+// RemoteAddr returns the address of the connected bridge.
+func (t *ConnTransport) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+// Close closes the underlying connection, unblocking any pending ReadFrame.
+func (t *ConnTransport) Close() error {
+	return t.conn.Close()
+}
+
+// Listener accepts bridge connections on a Unix domain socket or TCP address.
+type Listener struct {
+	ln net.Listener
+}
+
+// Listen opens a listener for network "unix" or "tcp". For "unix", a stale
+// socket file left at addr by a previous run is removed first; any other kind
+// of file at addr is an error. The socket is made accessible to its owner
+// only. For "tcp", an address without a host, such as ":7000", listens on
+// loopback only; other interfaces must be named explicitly, e.g. "0.0.0.0:7000".
+func Listen(network, addr string) (*Listener, error) {
+	switch network {
+	case "unix":
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	case "tcp":
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		if host == "" {
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported listener network %q", network)
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s %s: %w", network, addr, err)
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0o600); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("restrict socket %s: %w", addr, err)
+		}
+	}
+	return &Listener{ln: ln}, nil
+}
+
+// Accept waits for the next bridge connection.
+func (l *Listener) Accept() (*ConnTransport, error) {
+	conn, err := l.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConnTransport(conn), nil
+}
+
+// Addr returns the listener's address.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Close stops the listener. Unix socket files are removed.
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+// removeStaleSocket deletes a Unix socket file at path, if one exists.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove stale socket %s: %w", path, err)
+	}
+	return nil
+}
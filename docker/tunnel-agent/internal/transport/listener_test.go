@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestListenerUnixRoundTrip verifies frames flow both ways over an accepted
+// Unix socket connection.
+func TestListenerUnixRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan *ConnTransport, 1)
+	go func() {
+		tr, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- tr
+	}()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	client := NewConnTransport(conn)
+	server := <-accepted
+	defer server.Close()
+
+	go func() {
+		_ = client.WriteJSONThenBinary(map[string]string{"type": "ws_data"}, []byte("payload"))
+	}()
+	if ft, data, err := server.ReadFrame(); err != nil || ft != FrameText || string(data) != `{"type":"ws_data"}` {
+		t.Fatalf("text frame = 0x%02x %q, %v", ft, data, err)
+	}
+	if ft, data, err := server.ReadFrame(); err != nil || ft != FrameBinary || string(data) != "payload" {
+		t.Fatalf("binary frame = 0x%02x %q, %v", ft, data, err)
+	}
+
+	go func() {
+		_ = server.WriteBinary([]byte("reply"))
+	}()
+	if ft, data, err := client.ReadFrame(); err != nil || ft != FrameBinary || string(data) != "reply" {
+		t.Fatalf("reply frame = 0x%02x %q, %v", ft, data, err)
+	}
+}
+
+// TestListenUnixRestrictsSocket verifies the socket is accessible to its owner only.
+func TestListenUnixRestrictsSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket permissions = %o, want 600", perm)
+	}
+}
+
+// TestListenTCPDefaultsToLoopback verifies an address without a host listens
+// on loopback only.
+func TestListenTCPDefaultsToLoopback(t *testing.T) {
+	ln, err := Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	if ip := ln.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("listening on %s, want loopback", ip)
+	}
+}
+
+// TestListenUnixRemovesStaleSocket verifies a socket file left behind by a
+// previous run does not prevent listening.
+func TestListenUnixRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("create stale socket: %v", err)
+	}
+	// Leave the socket file in place, as a crashed process would.
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen over stale socket: %v", err)
+	}
+	ln.Close()
+}
+
+// TestListenUnixRefusesRegularFile verifies Listen does not delete a file
+// that is not a socket.
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	if err := os.WriteFile(path, []byte("keep me"), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	if ln, err := Listen("unix", path); err == nil {
+		ln.Close()
+		t.Fatal("expected an error for a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("regular file was removed: %v", err)
+	}
+}
+
+// TestListenRejectsUnknownNetwork verifies only unix and tcp are accepted.
+func TestListenRejectsUnknownNetwork(t *testing.T) {
+	if ln, err := Listen("udp", "127.0.0.1:0"); err == nil {
+		ln.Close()
+		t.Fatal("expected an error for udp")
+	}
+}
@@ -1,12 +1,15 @@
 package transport
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"sync"
+
+	"docker-bridge-tunnel-agent/internal/msgpack"
 )
 
 const (
@@ -14,6 +17,10 @@ const (
 	FrameText byte = 0x01
 	// FrameBinary is the type byte for binary data frames.
 	FrameBinary byte = 0x02
+	// FrameMsgpack is the type byte for compact frames: a MessagePack
+	// envelope, followed in the same frame by the payload of messages that
+	// carry one.
+	FrameMsgpack byte = 0x03
 	// MaxFrameSize is the maximum payload size for a single frame (16 MB).
 	// Prevents OOM from malformed or malicious frame headers.
 	MaxFrameSize uint32 = 16 * 1024 * 1024
@@ -23,8 +30,25 @@ const (
 // Frame format: [type: 1 byte] [length: 4 bytes big-endian] [payload: length bytes]
 type StdioTransport struct {
 	reader io.Reader
-	writer io.Writer
-	mu     sync.Mutex // serialize writes
+	header [5]byte // read loop's frame header buffer
+
+	writer   io.Writer
+	mu       sync.Mutex // serialize writes
+	encoding Encoding
+	buf      bytes.Buffer
+	enc      *json.Encoder // encodes into buf
+}
+
+// JSONAppender is implemented by messages that append their own JSON encoding
+// to dst. Hot message types implement it so that writing them needs neither
+// reflection nor allocation.
+type JSONAppender interface {
+	AppendJSON(dst []byte) []byte
+}
+
+// MsgpackAppender is the EncodingMsgpack counterpart of JSONAppender.
+type MsgpackAppender interface {
+	AppendMsgpack(dst []byte) []byte
 }
 
 // NewStdioTransport creates a StdioTransport using os.Stdin and os.Stdout.
@@ -44,9 +68,11 @@ func NewStdioTransportFromRW(r io.Reader, w io.Writer) *StdioTransport {
 }
 
 // ReadFrame reads a single framed message from the transport.
-// Returns the frame type byte, the payload, and any error.
+// Returns the frame type byte, the payload, and any error. The payload comes
+// from the buffer pool; a caller that is done with it may hand it back with
+// PutBuffer.
 func (t *StdioTransport) ReadFrame() (byte, []byte, error) {
-	header := make([]byte, 5)
+	header := t.header[:]
 	if _, err := io.ReadFull(t.reader, header); err != nil {
 		return 0, nil, fmt.Errorf("read header: %w", err)
 	}
@@ -55,60 +81,113 @@ func (t *StdioTransport) ReadFrame() (byte, []byte, error) {
 	if length > MaxFrameSize {
 		return 0, nil, fmt.Errorf("frame size %d exceeds maximum %d", length, MaxFrameSize)
 	}
-	payload := make([]byte, length)
+	payload := GetBuffer(int(length))
 	if length > 0 {
 		if _, err := io.ReadFull(t.reader, payload); err != nil {
+			PutBuffer(payload)
 			return 0, nil, fmt.Errorf("read payload: %w", err)
 		}
 	}
 	return frameType, payload, nil
 }
 
-// WriteJSON marshals v as JSON and writes it as a TEXT frame.
+// SetEncoding switches the encoding of envelopes written from now on. Every
+// frame's type says how it is encoded, so frames already written, and any
+// being written concurrently, stay readable.
+func (t *StdioTransport) SetEncoding(e Encoding) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.encoding = e
+}
+
+// WriteJSON encodes v and writes it as an envelope frame: a TEXT frame of
+// JSON, or a FrameMsgpack frame once SetEncoding selected EncodingMsgpack.
 func (t *StdioTransport) WriteJSON(v any) error {
-	data, err := json.Marshal(v)
-	if err != nil {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.encodeEnvelope(v, 0); err != nil {
 		return fmt.Errorf("marshal: %w", err)
 	}
-	return t.writeFrame(FrameText, data)
+	return t.flush(nil)
 }
 
 // WriteBinary writes data as a BINARY frame.
 func (t *StdioTransport) WriteBinary(data []byte) error {
-	return t.writeFrame(FrameBinary, data)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf.Reset()
+	t.appendHeader(FrameBinary, len(data))
+	return t.flush(data)
 }
 
 // WriteJSONThenBinary atomically writes a TEXT frame (JSON envelope) followed by
 // a BINARY frame (body data). The mutex is held across both writes to prevent
-// interleaving from other goroutines.
+// interleaving from other goroutines. With EncodingMsgpack the envelope and
+// body travel in a single FrameMsgpack frame instead.
 func (t *StdioTransport) WriteJSONThenBinary(envelope any, body []byte) error {
-	envData, err := json.Marshal(envelope)
-	if err != nil {
-		return fmt.Errorf("marshal envelope: %w", err)
-	}
 	t.mu.Lock()
 	defer t.mu.Unlock()
-
-	if err := t.writeFrameUnlocked(FrameText, envData); err != nil {
-		return err
+	if err := t.encodeEnvelope(envelope, len(body)); err != nil {
+		return fmt.Errorf("marshal envelope: %w", err)
+	}
+	if t.encoding == EncodingJSON {
+		t.appendHeader(FrameBinary, len(body))
 	}
-	return t.writeFrameUnlocked(FrameBinary, body)
+	return t.flush(body)
 }
 
-// writeFrame writes a single framed message (mutex-protected).
-func (t *StdioTransport) writeFrame(frameType byte, payload []byte) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.writeFrameUnlocked(frameType, payload)
+// encodeEnvelope replaces the contents of t.buf with the header and envelope
+// of a frame holding v. With EncodingMsgpack the frame length also covers the
+// payloadLen bytes of payload the caller writes after the envelope. The caller
+// must hold t.mu.
+func (t *StdioTransport) encodeEnvelope(v any, payloadLen int) error {
+	t.buf.Reset()
+	if t.encoding == EncodingMsgpack {
+		t.appendHeader(FrameMsgpack, 0)
+		var b []byte
+		if a, ok := v.(MsgpackAppender); ok {
+			b = a.AppendMsgpack(t.buf.AvailableBuffer())
+		} else {
+			var err error
+			if b, err = msgpack.Append(t.buf.AvailableBuffer(), v); err != nil {
+				t.buf.Reset()
+				return err
+			}
+		}
+		t.buf.Write(b)
+		binary.BigEndian.PutUint32(t.buf.Bytes()[1:5], uint32(t.buf.Len()-5+payloadLen))
+		return nil
+	}
+
+	t.appendHeader(FrameText, 0)
+	if a, ok := v.(JSONAppender); ok {
+		t.buf.Write(a.AppendJSON(t.buf.AvailableBuffer()))
+	} else {
+		if t.enc == nil {
+			t.enc = json.NewEncoder(&t.buf)
+		}
+		if err := t.enc.Encode(v); err != nil {
+			t.buf.Reset()
+			return err
+		}
+		t.buf.Truncate(t.buf.Len() - 1) // Encode appends a newline
+	}
+	binary.BigEndian.PutUint32(t.buf.Bytes()[1:5], uint32(t.buf.Len()-5))
+	return nil
 }
 
-// writeFrameUnlocked writes a single framed message without acquiring the mutex.
-// The caller must hold t.mu.
-func (t *StdioTransport) writeFrameUnlocked(frameType byte, payload []byte) error {
-	header := make([]byte, 5)
+// appendHeader appends a frame header to t.buf. The caller must hold t.mu.
+func (t *StdioTransport) appendHeader(frameType byte, length int) {
+	var header [5]byte
 	header[0] = frameType
-	binary.BigEndian.PutUint32(header[1:5], uint32(len(payload)))
-	if _, err := t.writer.Write(header); err != nil {
+	binary.BigEndian.PutUint32(header[1:5], uint32(length))
+	t.buf.Write(header[:])
+}
+
+// flush writes t.buf followed by payload, which is written on its own to
+// avoid copying large bodies. The caller must hold t.mu.
+func (t *StdioTransport) flush(payload []byte) error {
+	if _, err := t.writer.Write(t.buf.Bytes()); err != nil {
 		return err
 	}
 	if len(payload) > 0 {
@@ -7,6 +7,8 @@ import (
 	"io"
 	"sync"
 	"testing"
+
+	"docker-bridge-tunnel-agent/internal/msgpack"
 )
 
 // TestReadFrameText verifies round-trip for a TEXT frame.
@@ -337,3 +339,97 @@ func (sw *syncWriter) Write(p []byte) (int, error) {
 	defer sw.mu.Unlock()
 	return sw.w.Write(p)
 }
+
+// repeatReader yields the same bytes forever.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+// benchEnvelope stands in for a tunnel protocol message.
+type benchEnvelope struct {
+	Type     string `json:"type"`
+	StreamID string `json:"stream_id,omitempty"`
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	var frames bytes.Buffer
+	w := NewStdioTransportFromRW(nil, &frames)
+	payload := make([]byte, 32*1024)
+	if err := w.WriteJSONThenBinary(benchEnvelope{Type: "body_chunk", StreamID: "stream-1"}, payload); err != nil {
+		b.Fatal(err)
+	}
+	tr := NewStdioTransportFromRW(&repeatReader{data: frames.Bytes()}, nil)
+
+	b.SetBytes(int64(frames.Len()))
+	b.ReportAllocs()
+	for b.Loop() {
+		for range 2 {
+			_, data, err := tr.ReadFrame()
+			if err != nil {
+				b.Fatal(err)
+			}
+			PutBuffer(data)
+		}
+	}
+}
+
+func BenchmarkWriteJSONThenBinary(b *testing.B) {
+	tr := NewStdioTransportFromRW(nil, io.Discard)
+	env := benchEnvelope{Type: "body_chunk", StreamID: "stream-1"}
+	payload := make([]byte, 32*1024)
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := tr.WriteJSONThenBinary(env, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestMsgpackEncoding verifies that with EncodingMsgpack an envelope and its
+// body are written as one compact frame.
+func TestMsgpackEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewStdioTransportFromRW(nil, &buf)
+	w.SetEncoding(EncodingMsgpack)
+	env := benchEnvelope{Type: "body_chunk", StreamID: "s1"}
+	if err := w.WriteJSONThenBinary(env, []byte("payload")); err != nil {
+		t.Fatalf("WriteJSONThenBinary: %v", err)
+	}
+	if err := w.WriteJSON(benchEnvelope{Type: "heartbeat"}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+
+	r := NewStdioTransportFromRW(&buf, nil)
+	ft, data, err := r.ReadFrame()
+	if err != nil || ft != FrameMsgpack {
+		t.Fatalf("first frame = 0x%02x, %v; want a compact frame", ft, err)
+	}
+	var got benchEnvelope
+	rest, err := msgpack.UnmarshalPrefix(data, &got)
+	if err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+	if got != env || string(rest) != "payload" {
+		t.Errorf("got %+v with payload %q", got, rest)
+	}
+
+	ft, data, err = r.ReadFrame()
+	if err != nil || ft != FrameMsgpack {
+		t.Fatalf("second frame = 0x%02x, %v; want a compact frame", ft, err)
+	}
+	if err := msgpack.Unmarshal(data, &got); err != nil || got.Type != "heartbeat" {
+		t.Errorf("second envelope = %+v, %v", got, err)
+	}
+	if _, _, err := r.ReadFrame(); err == nil {
+		t.Error("expected no further frames")
+	}
+}
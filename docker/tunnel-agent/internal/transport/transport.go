@@ -0,0 +1,37 @@
+package transport
+
+// Transport carries framed tunnel messages between the agent and the bridge.
+// Implementations must allow concurrent writers; ReadFrame is only called
+// from the agent's read loop.
+type Transport interface {
+	// ReadFrame reads a single framed message, returning its type and payload.
+	ReadFrame() (byte, []byte, error)
+	// WriteJSON encodes v in the current encoding and writes it as an
+	// envelope frame.
+	WriteJSON(v any) error
+	// WriteBinary writes data as a BINARY frame.
+	WriteBinary(data []byte) error
+	// WriteJSONThenBinary writes an envelope and its payload with no other
+	// frame in between: a TEXT frame followed by a BINARY frame, or a single
+	// FrameMsgpack frame.
+	WriteJSONThenBinary(envelope any, body []byte) error
+	// SetEncoding switches the encoding of envelopes written from now on.
+	SetEncoding(e Encoding)
+}
+
+// Encoding selects how envelopes are written.
+type Encoding int
+
+const (
+	// EncodingJSON writes envelopes as JSON TEXT frames, each payload in a
+	// BINARY frame of its own. It is the default.
+	EncodingJSON Encoding = iota
+	// EncodingMsgpack writes each envelope as MessagePack in a FrameMsgpack
+	// frame, with its payload in the same frame.
+	EncodingMsgpack
+)
+
+var (
+	_ Transport = (*StdioTransport)(nil)
+	_ Transport = (*ConnTransport)(nil)
+)
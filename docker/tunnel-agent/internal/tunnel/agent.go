@@ -1,52 +1,114 @@
 package tunnel
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/discovery"
+	"docker-bridge-tunnel-agent/internal/probe"
 	"docker-bridge-tunnel-agent/internal/transport"
 )
 
-// HeartbeatInterval is the interval between heartbeat messages.
-const HeartbeatInterval = 10 * time.Second
-
 // ShutdownDrainTimeout is the maximum time to wait for in-flight requests on shutdown.
 const ShutdownDrainTimeout = 5 * time.Second
 
-// Agent manages the stdin/stdout tunnel connection to the bridge service.
+// Agent manages one tunnel connection to the bridge service.
 // It multiplexes HTTP requests from the bridge to local dev server ports
-// and sends responses back via the StdioTransport.
+// and sends responses back via the Transport.
 type Agent struct {
 	cfg       *config.Config
-	transport *transport.StdioTransport
+	transport transport.Transport
+	out       *writeScheduler // every outbound message goes through out
 	proxy     *HTTPProxy
 	wsProxy   *WSProxy
+	tcpProxy  *TCPProxy
+	execProxy *ExecProxy
+	files     *FileProxy
 	registry  StreamRegistry
-	wsChanMap sync.Map // stream_id -> chan []byte; carries inbound ws_data frames
+	limiter   *streamLimiter
+	wsChanMap sync.Map // stream_id -> *inboundQueue; carries inbound ws_data frames
+	bodyMap   sync.Map // stream_id -> *requestBody; carries inbound body_chunk frames
+	tcpMap    sync.Map // stream_id -> *inboundQueue; carries inbound tcp_data payloads
+	execMap   sync.Map // stream_id -> *execSession; carries exec stdin and resizes
+	windowMap sync.Map // stream_id -> *sendWindow; send credit on flow-controlled streams
+	live      *liveness
 	startTime time.Time
 	running   atomic.Bool
 	inFlight  sync.WaitGroup
+
+	// features is nil until the bridge's hello selects the enabled features.
+	features atomic.Pointer[featureSet]
+	// negotiated is closed once the hello_ack has been sent, waking the
+	// loops that report to bridges that ask for it.
+	negotiated chan struct{}
+	// prober, when set, supplies the port states reported via port_status.
+	prober *probe.Prober
+	// watcher, when set, supplies the ports announced via port_opened.
+	watcher *discovery.Watcher
+	// authToken, when set, is the secret the bridge's hello must present
+	// before anything else is served; onAuth is called once it has.
+	authToken string
+	onAuth    func()
+	// unread is a frame the read loop must dispatch before reading another.
+	unread *unreadFrame
 }
 
 // NewAgent creates an Agent with the given config and transport.
-func NewAgent(cfg *config.Config, tr *transport.StdioTransport) *Agent {
+func NewAgent(cfg *config.Config, tr transport.Transport) *Agent {
 	return &Agent{
 		cfg:       cfg,
 		transport: tr,
+		out:       newWriteScheduler(tr),
 		proxy:     NewHTTPProxy(cfg),
-		wsProxy:   NewWSProxy(cfg.Ports[0]),
+		wsProxy:   NewWSProxy(cfg),
+		tcpProxy:  NewTCPProxy(cfg),
+		execProxy: NewExecProxy(cfg),
+		files:     NewFileProxy(cfg),
+		limiter:   newStreamLimiter(cfg.MaxStreams, cfg.MaxStreamsPerPort),
+		live:      newLiveness(cfg.HeartbeatInterval),
 		startTime: time.Now(),
+
+		negotiated: make(chan struct{}),
 	}
 }
 
+// WatchPorts makes the agent report the port state changes seen by p to the
+// bridge as port_status messages. It must be called before Run.
+func (a *Agent) WatchPorts(p *probe.Prober) {
+	a.prober = p
+}
+
+// WatchListeners makes the agent announce the ports found by w to the bridge
+// as port_opened and port_closed messages. It must be called before Run.
+func (a *Agent) WatchListeners(w *discovery.Watcher) {
+	a.watcher = w
+}
+
+// RequireAuth makes the agent end the session unless the bridge's first
+// message is a hello presenting token. authenticated, if not nil, is called
+// once the bridge has authenticated. It must be called before Run.
+func (a *Agent) RequireAuth(token string, authenticated func()) {
+	a.authToken = token
+	a.onAuth = authenticated
+}
+
+// authenticated reports whether the bridge may send messages other than hello.
+func (a *Agent) authenticated() bool {
+	return a.authToken == "" || a.features.Load() != nil
+}
+
 // IsRunning returns true if the agent is currently running its read loop.
 func (a *Agent) IsRunning() bool {
 	return a.running.Load()
@@ -63,7 +125,8 @@ func (a *Agent) ActiveStreams() int {
 }
 
 // Run is the main agent loop. It sends a ready message, starts the heartbeat,
-// and reads frames from stdin until EOF or context cancellation.
+// and reads frames from the transport until EOF or context cancellation, or
+// until a bridge that enabled ping stops answering.
 func (a *Agent) Run(ctx context.Context) error {
 	a.running.Store(true)
 	defer func() {
@@ -72,8 +135,16 @@ func (a *Agent) Run(ctx context.Context) error {
 	}()
 
 	// Send ready message immediately.
-	readyMsg := ReadyMsg{Envelope: Envelope{Type: MsgReady}}
-	if err := a.transport.WriteJSON(readyMsg); err != nil {
+	readyMsg := ReadyMsg{
+		Envelope:           Envelope{Type: MsgReady},
+		Window:             a.streamWindow(),
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: MinProtocolVersion,
+		AgentVersion:       AgentVersion,
+		Capabilities:       Capabilities(),
+		HeartbeatInterval:  time.Duration(a.live.interval.Load()).Milliseconds(),
+	}
+	if err := a.out.WriteJSON(readyMsg); err != nil {
 		return err
 	}
 	slog.Info("ready message sent")
@@ -82,13 +153,42 @@ func (a *Agent) Run(ctx context.Context) error {
 	heartbeatCtx, cancelHeartbeat := context.WithCancel(ctx)
 	defer cancelHeartbeat()
 	go a.heartbeatLoop(heartbeatCtx)
+	unresponsive := make(chan error, 1)
+	go func() {
+		if err := a.watchdog(heartbeatCtx); err != nil {
+			unresponsive <- err
+		}
+	}()
+	if a.prober != nil {
+		go a.portStatusLoop(heartbeatCtx)
+	}
+	if a.watcher != nil {
+		go a.discoveryLoop(heartbeatCtx)
+	}
 
-	// Main read loop.
+	// The read loop runs on its own so that an unresponsive bridge ends the
+	// session even while a read is blocked. A transport that cannot be
+	// closed leaves the loop behind; the process is about to exit anyway.
+	done := make(chan error, 1)
+	go func() {
+		done <- a.readLoop(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case err := <-unresponsive:
+		return err
+	}
+}
+
+// readLoop reads frames from the transport and dispatches them until the
+// transport fails or a hello is refused.
+func (a *Agent) readLoop(ctx context.Context) error {
 	for {
-		frameType, data, err := a.transport.ReadFrame()
+		frameType, data, err := a.nextFrame()
 		if err != nil {
 			if errors.Is(err, io.EOF) || isClosedPipeError(err) {
-				slog.Info("stdin closed, initiating shutdown")
+				slog.Info("transport closed, initiating shutdown")
 				return nil
 			}
 			if ctx.Err() != nil {
@@ -96,147 +196,723 @@ func (a *Agent) Run(ctx context.Context) error {
 			}
 			return err
 		}
+		a.live.seen()
 
 		switch frameType {
-		case transport.FrameText:
-			var env Envelope
-			if err := json.Unmarshal(data, &env); err != nil {
-				slog.Warn("failed to parse envelope", "error", err)
+		case transport.FrameText, transport.FrameMsgpack:
+			m, err := decodeInbound(frameType, data)
+			if err == nil && m.Type == MsgHello {
+				err := a.handleHello(m)
+				transport.PutBuffer(data)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if !a.authenticated() {
+				transport.PutBuffer(data)
+				return a.refuseUnauthenticated()
+			}
+			if err != nil {
+				a.protocolFault("", ProtocolErrMalformedEnvelope, err)
 				continue
 			}
-			a.dispatchText(ctx, env, data)
+			a.dispatch(ctx, m)
+			// Messages are decoded into memory of their own, so the frame
+			// buffer can be reused unless a handler kept the payload of a
+			// compact frame.
+			if !m.payloadTaken {
+				transport.PutBuffer(data)
+			}
 
 		case transport.FrameBinary:
-			slog.Warn("unexpected binary frame outside body context")
+			transport.PutBuffer(data)
+			if !a.authenticated() {
+				return a.refuseUnauthenticated()
+			}
+			a.protocolFault("", ProtocolErrUnexpectedBinary, errors.New("binary frame outside a message body"))
+
+		default:
+			transport.PutBuffer(data)
+			if !a.authenticated() {
+				return a.refuseUnauthenticated()
+			}
+			a.protocolFault("", ProtocolErrUnknownFrame, fmt.Errorf("unknown frame type 0x%02x", frameType))
 		}
 	}
 }
 
-// dispatchText routes a text frame to the appropriate handler based on message type.
-func (a *Agent) dispatchText(ctx context.Context, env Envelope, data []byte) {
-	switch env.Type {
+// refuseUnauthenticated ends a session whose bridge sent something other than
+// an authenticating hello.
+func (a *Agent) refuseUnauthenticated() error {
+	slog.Error("refusing bridge: first message is not an authenticating hello")
+	return ErrUnauthenticated
+}
+
+// dispatch routes a message to the appropriate handler based on its type.
+func (a *Agent) dispatch(ctx context.Context, m *inboundMessage) {
+	switch m.Type {
 	case MsgHTTPRequest:
 		var msg HTTPRequestMsg
-		if err := json.Unmarshal(data, &msg); err != nil {
-			slog.Warn("failed to parse http_request", "error", err)
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+		a.features.Load().restrictHTTPRequest(&msg)
+
+		port, release, ok := a.admitStream(msg.Port, protoHTTP)
+		if !ok {
+			// Consume a body sent in one frame so it is not read as the
+			// next message; a streamed body is dropped as it arrives.
+			if msg.BodyFollows && !msg.BodyStream {
+				_, _ = a.readPayload(m)
+			}
+			if err := writeMessages(a.out, buildBusyResponse(msg, port)); err != nil {
+				slog.Warn("failed to write 503 response", "error", err, "stream_id", msg.StreamID)
+			}
 			return
 		}
 
 		// If body follows, read the next frame and verify it's BINARY.
-		var bodyData []byte
-		if msg.BodyFollows {
-			frameType, bodyBytes, err := a.transport.ReadFrame()
+		// A streamed body is registered now so the body_chunk frames that
+		// follow find it, and is filled in by the read loop as they arrive.
+		var body io.Reader
+		var streamed *requestBody
+		switch {
+		case msg.BodyStream:
+			streamed = newRequestBody(a.newInboundQueue(msg.StreamID, msg.Window > 0))
+			a.bodyMap.Store(msg.StreamID, streamed)
+			body = streamed
+		case msg.BodyFollows:
+			bodyBytes, err := a.readPayload(m)
 			if err != nil {
-				slog.Warn("failed to read body frame", "error", err, "stream_id", msg.StreamID)
+				release()
+				a.protocolFault(msg.StreamID, ProtocolErrMissingPayload, err)
 				return
 			}
-			if frameType == transport.FrameBinary {
-				bodyData = bodyBytes
-			} else {
-				slog.Warn("expected binary body frame, got text", "stream_id", msg.StreamID)
+			if len(bodyBytes) > 0 {
+				body = bytes.NewReader(bodyBytes)
 			}
 		}
 
+		window := a.openSendWindow(msg.StreamID, msg.Window)
+
 		a.inFlight.Add(1)
 		go func() {
 			defer a.inFlight.Done()
-			a.handleHTTPRequest(ctx, msg, bodyData)
+			defer release()
+			a.handleHTTPRequest(ctx, msg, body, window)
+			if streamed != nil {
+				a.bodyMap.CompareAndDelete(msg.StreamID, streamed)
+				streamed.queue.abort(errRequestBodyClosed)
+			}
+			if window != nil {
+				a.windowMap.CompareAndDelete(msg.StreamID, window)
+			}
 		}()
 
+	case MsgBodyChunk:
+		// Request body chunks always carry a payload.
+		chunk, err := a.readPayload(m)
+		if err != nil {
+			a.protocolFault(m.StreamID, ProtocolErrMissingPayload, err)
+			return
+		}
+		v, ok := a.bodyMap.Load(m.StreamID)
+		if !ok {
+			slog.Debug("body_chunk for unknown stream", "stream_id", m.StreamID)
+			return
+		}
+		if err := v.(*requestBody).queue.push(inboundFrame{data: chunk}); err != nil {
+			a.handlePushError(m.StreamID, err)
+		}
+
+	case MsgBodyEnd:
+		if v, ok := a.bodyMap.Load(m.StreamID); ok {
+			v.(*requestBody).queue.close()
+		}
+
 	case MsgWSUpgrade:
 		var msg WSUpgradeMsg
-		if err := json.Unmarshal(data, &msg); err != nil {
-			slog.Warn("failed to parse ws_upgrade", "error", err)
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+		a.features.Load().restrictWSUpgrade(&msg)
+
+		_, release, ok := a.admitStream(msg.Port, protoWS)
+		if !ok {
+			writeWSUpgradeFailure(a.out, msg.StreamID, errTooManyStreams, "too_many_streams")
 			return
 		}
 
-		// Create inbound channel for this WebSocket stream.
-		inbound := make(chan []byte, 32)
+		// Create inbound queue for this WebSocket stream.
+		inbound := a.newInboundQueue(msg.StreamID, msg.Window > 0)
 		a.wsChanMap.Store(msg.StreamID, inbound)
+		window := a.openSendWindow(msg.StreamID, msg.Window)
 
 		a.inFlight.Add(1)
 		go func() {
 			defer a.inFlight.Done()
-			a.wsProxy.Handle(ctx, msg, inbound, a.transport, &a.registry)
-			// Only close channel if stream_close handler hasn't already.
-			if _, loaded := a.wsChanMap.LoadAndDelete(msg.StreamID); loaded {
-				close(inbound)
+			defer release()
+			a.wsProxy.Handle(ctx, msg, inbound, a.compressPayloads(a.streamWriter(ctx, window)), &a.registry)
+			a.wsChanMap.CompareAndDelete(msg.StreamID, inbound)
+			inbound.abort(errInboundClosed)
+			if window != nil {
+				a.windowMap.CompareAndDelete(msg.StreamID, window)
 			}
 		}()
 
 	case MsgWSData:
 		var msg WSDataMsg
-		if err := json.Unmarshal(data, &msg); err != nil {
-			slog.Warn("failed to parse ws_data", "error", err)
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
 			return
 		}
+		a.features.Load().restrictWSData(&msg)
 
 		if msg.BodyFollows {
-			frameType, bodyBytes, err := a.transport.ReadFrame()
+			frameData, err := a.readPayload(m)
 			if err != nil {
-				slog.Warn("failed to read ws_data body frame", "error", err, "stream_id", msg.StreamID)
+				a.protocolFault(msg.StreamID, ProtocolErrMissingPayload, err)
 				return
 			}
-			var frameData []byte
-			if frameType == transport.FrameBinary {
-				frameData = bodyBytes
-			} else {
-				slog.Warn("expected binary ws_data frame, got text", "stream_id", msg.StreamID)
-			}
 			// Deliver to the WSProxy goroutine for this stream.
-			if ch, ok := a.wsChanMap.Load(msg.StreamID); ok {
-				select {
-				case ch.(chan []byte) <- frameData:
-				default:
-					slog.Warn("ws inbound channel full, dropping frame", "stream_id", msg.StreamID)
+			v, ok := a.wsChanMap.Load(msg.StreamID)
+			if !ok {
+				wsDroppedFrames.WithLabelValues("unknown_stream").Inc()
+				return
+			}
+			frame := inboundFrame{data: frameData, opcode: msg.Opcode}
+			if err := v.(*inboundQueue).push(frame); err != nil {
+				wsDroppedFrames.WithLabelValues(dropReason(err)).Inc()
+				a.handlePushError(msg.StreamID, err)
+			}
+		}
+
+	case MsgTCPConnect:
+		var msg TCPConnectMsg
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+		if !a.features.Load().has(CapTCPStreams) {
+			writeTCPConnectFailure(a.out, msg.StreamID,
+				errors.New("tcp_streams capability not enabled"), "feature_not_enabled")
+			return
+		}
+		a.features.Load().restrictTCPConnect(&msg)
+
+		_, release, ok := a.admitStream(msg.Port, protoTCP)
+		if !ok {
+			writeTCPConnectFailure(a.out, msg.StreamID, errTooManyStreams, "too_many_streams")
+			return
+		}
+
+		inbound := a.newInboundQueue(msg.StreamID, msg.Window > 0)
+		a.tcpMap.Store(msg.StreamID, inbound)
+		window := a.openSendWindow(msg.StreamID, msg.Window)
+
+		a.inFlight.Add(1)
+		go func() {
+			defer a.inFlight.Done()
+			defer release()
+			a.tcpProxy.Handle(ctx, msg, inbound, a.streamWriter(ctx, window), &a.registry)
+			a.tcpMap.CompareAndDelete(msg.StreamID, inbound)
+			inbound.abort(errInboundClosed)
+			if window != nil {
+				a.windowMap.CompareAndDelete(msg.StreamID, window)
+			}
+		}()
+
+	case MsgTCPData:
+		var msg TCPDataMsg
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+
+		if msg.BodyFollows {
+			frameData, err := a.readPayload(m)
+			if err != nil {
+				a.protocolFault(msg.StreamID, ProtocolErrMissingPayload, err)
+				return
+			}
+			if v, ok := a.tcpMap.Load(msg.StreamID); ok {
+				if err := v.(*inboundQueue).push(inboundFrame{data: frameData}); err != nil {
+					a.handlePushError(msg.StreamID, err)
+				}
+			}
+		}
+
+	case MsgExecStart:
+		var msg ExecStartMsg
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+		if !a.features.Load().has(CapExec) {
+			writeExecFailure(a.out, msg.StreamID,
+				errors.New("exec capability not enabled"), "feature_not_enabled")
+			return
+		}
+		a.features.Load().restrictExecStart(&msg)
+
+		release, ok := a.reserveStream(execStreamKey, protoExec)
+		if !ok {
+			writeExecFailure(a.out, msg.StreamID, errTooManyStreams, "too_many_streams")
+			return
+		}
+
+		session := newExecSession(a.newInboundQueue(msg.StreamID, msg.Window > 0), msg.Cols, msg.Rows)
+		a.execMap.Store(msg.StreamID, session)
+		window := a.openSendWindow(msg.StreamID, msg.Window)
+
+		a.inFlight.Add(1)
+		go func() {
+			defer a.inFlight.Done()
+			defer release()
+			a.execProxy.Handle(ctx, msg, session, a.streamWriter(ctx, window), &a.registry)
+			a.execMap.CompareAndDelete(msg.StreamID, session)
+			session.stdin.abort(errInboundClosed)
+			if window != nil {
+				a.windowMap.CompareAndDelete(msg.StreamID, window)
+			}
+		}()
+
+	case MsgExecData:
+		var msg ExecDataMsg
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+
+		if msg.BodyFollows {
+			frameData, err := a.readPayload(m)
+			if err != nil {
+				a.protocolFault(msg.StreamID, ProtocolErrMissingPayload, err)
+				return
+			}
+			if v, ok := a.execMap.Load(msg.StreamID); ok {
+				if err := v.(*execSession).stdin.push(inboundFrame{data: frameData}); err != nil {
+					a.handlePushError(msg.StreamID, err)
 				}
 			}
 		}
 
+	case MsgExecResize:
+		var msg ExecResizeMsg
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+		if v, ok := a.execMap.Load(msg.StreamID); ok {
+			if err := v.(*execSession).resize(msg.Cols, msg.Rows); err != nil {
+				slog.Debug("failed to resize terminal", "error", err, "stream_id", msg.StreamID)
+			}
+		}
+
+	case MsgFileRead, MsgFileWrite, MsgFileList:
+		var msg FileRequestMsg
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+		if !a.features.Load().has(CapFiles) {
+			writeFileFailure(a.out, msg.StreamID,
+				errors.New("files capability not enabled"), "feature_not_enabled")
+			return
+		}
+		a.features.Load().restrictFileRequest(&msg)
+
+		release, ok := a.reserveStream(fileStreamKey, protoFile)
+		if !ok {
+			writeFileFailure(a.out, msg.StreamID, errTooManyStreams, "too_many_streams")
+			return
+		}
+
+		// The content of a file_write follows as body_chunk frames, like a
+		// streamed request body.
+		var body *requestBody
+		if msg.Type == MsgFileWrite {
+			body = newRequestBody(a.newInboundQueue(msg.StreamID, msg.Window > 0))
+			a.bodyMap.Store(msg.StreamID, body)
+		}
+		window := a.openSendWindow(msg.StreamID, msg.Window)
+
+		a.inFlight.Add(1)
+		go func() {
+			defer a.inFlight.Done()
+			defer release()
+			a.handleFileRequest(ctx, msg, body, window)
+			if body != nil {
+				a.bodyMap.CompareAndDelete(msg.StreamID, body)
+				body.queue.abort(errRequestBodyClosed)
+			}
+			if window != nil {
+				a.windowMap.CompareAndDelete(msg.StreamID, window)
+			}
+		}()
+
+	case MsgWindowUpdate:
+		var msg WindowUpdateMsg
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+		if v, ok := a.windowMap.Load(msg.StreamID); ok {
+			if err := v.(*sendWindow).update(msg.Increment); err != nil {
+				a.failStream(msg.StreamID, "flow_control_error")
+			}
+		}
+
 	case MsgStreamClose:
-		// Close WebSocket inbound channel if this is a WS stream.
-		if ch, ok := a.wsChanMap.LoadAndDelete(env.StreamID); ok {
-			close(ch.(chan []byte))
+		var msg StreamCloseMsg
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+		a.features.Load().restrictStreamClose(&msg)
+		// For a WS stream, end its input and let the WS proxy finish the close
+		// handshake with the local server using the bridge's close status. The
+		// proxy ends the stream once the queued frames have been delivered.
+		if v, ok := a.wsChanMap.LoadAndDelete(m.StreamID); ok {
+			inbound := v.(*inboundQueue)
+			if msg.CloseCode != 0 {
+				closeFrame := inboundFrame{closeCode: msg.CloseCode, closeReason: msg.CloseReason}
+				if err := inbound.push(closeFrame); err != nil {
+					a.handlePushError(m.StreamID, err)
+				}
+			}
+			inbound.close()
+			return
 		}
-		// Cancel any stream (HTTP or WS) in the registry.
-		if s, ok := a.registry.Get(env.StreamID); ok {
-			s.Cancel()
-			a.registry.Remove(env.StreamID)
+		// A half-closed TCP stream keeps running until the local side finishes;
+		// a full close tears it down.
+		if v, ok := a.tcpMap.LoadAndDelete(m.StreamID); ok {
+			if msg.HalfClose {
+				v.(*inboundQueue).close()
+				return
+			}
+			v.(*inboundQueue).abort(errInboundClosed)
 		}
+		// Likewise a half-close ends an exec stream's input, and a full close
+		// hangs up the command.
+		if v, ok := a.execMap.LoadAndDelete(m.StreamID); ok {
+			if msg.HalfClose {
+				v.(*execSession).stdin.close()
+				return
+			}
+			v.(*execSession).stdin.abort(errInboundClosed)
+		}
+		// Fail a streamed request body that is still being uploaded.
+		if v, ok := a.bodyMap.LoadAndDelete(m.StreamID); ok {
+			v.(*requestBody).queue.abort(errRequestBodyClosed)
+		}
+		a.cancelStream(m.StreamID)
+
+	case MsgPing:
+		var msg PingMsg
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+		if err := a.out.WriteJSON(PongMsg{Envelope: Envelope{Type: MsgPong}, Seq: msg.Seq}); err != nil {
+			slog.Debug("pong write failed", "error", err)
+		}
+
+	case MsgPong:
+		var msg PongMsg
+		if err := m.decode(&msg); err != nil {
+			a.malformed(m, err)
+			return
+		}
+		a.live.pong(msg.Seq)
 
 	default:
-		slog.Debug("unknown message type", "type", env.Type)
+		// A bridge that has not opted into protocol errors may be newer than
+		// the agent; its extension messages are skipped, not held against
+		// their stream.
+		if !a.features.Load().requested(CapProtocolErrors) {
+			slog.Debug("unknown message type", "type", m.Type)
+			return
+		}
+		a.protocolFault(m.StreamID, ProtocolErrUnknownType, fmt.Errorf("unknown message type %q", m.Type))
+	}
+}
+
+// handleHello authenticates the bridge when required, negotiates the protocol
+// version and features with it and answers with a hello_ack. It returns
+// ErrUnauthenticated for a missing or wrong auth token, or an error wrapping
+// ErrIncompatiblePeer when the bridge speaks no version the agent does;
+// either ends the session.
+func (a *Agent) handleHello(m *inboundMessage) error {
+	var msg HelloMsg
+	if err := m.decode(&msg); err != nil {
+		if !a.authenticated() {
+			return a.refuseUnauthenticated()
+		}
+		a.malformed(m, err)
+		return nil
 	}
+	if a.features.Load() != nil {
+		slog.Warn("ignoring repeated hello")
+		return nil
+	}
+
+	ack := HelloAckMsg{Envelope: Envelope{Type: MsgHelloAck}}
+	if a.authToken != "" && subtle.ConstantTimeCompare([]byte(msg.AuthToken), []byte(a.authToken)) != 1 {
+		ack.Error = ErrUnauthenticated.Error()
+		_ = a.out.WriteJSON(ack)
+		slog.Error("refusing bridge: wrong auth token", "bridge_version", msg.BridgeVersion)
+		return ErrUnauthenticated
+	}
+	version, features, err := negotiate(msg)
+	if err != nil {
+		ack.Error = err.Error()
+		_ = a.out.WriteJSON(ack)
+		slog.Error("refusing bridge", "bridge_version", msg.BridgeVersion, "error", err)
+		return err
+	}
+	a.features.Store(features)
+	interval := time.Duration(a.live.interval.Load())
+	if msg.HeartbeatInterval > 0 {
+		interval = a.live.setInterval(time.Duration(msg.HeartbeatInterval) * time.Millisecond)
+	}
+
+	ack.Success = true
+	ack.ProtocolVersion = version
+	ack.Capabilities = features.list()
+	ack.HeartbeatInterval = interval.Milliseconds()
+	slog.Info("protocol negotiated",
+		"protocol_version", version,
+		"bridge_version", msg.BridgeVersion,
+		"capabilities", ack.Capabilities,
+		"heartbeat_interval", interval,
+	)
+	if a.onAuth != nil {
+		a.onAuth()
+	}
+	if err := a.out.WriteJSON(ack); err != nil {
+		return err
+	}
+	close(a.negotiated)
+	// The hello_ack itself goes out as JSON, so the bridge learns that msgpack
+	// is enabled before the first compact frame arrives.
+	if features.has(CapMsgpack) {
+		a.transport.SetEncoding(transport.EncodingMsgpack)
+	}
+	return nil
+}
+
+// cancelStream cancels any stream (HTTP or WS) registered under id.
+func (a *Agent) cancelStream(id string) {
+	if s, ok := a.registry.Get(id); ok {
+		s.Cancel()
+		a.registry.Remove(id)
+	}
+}
+
+// failStream reports a stream-level fault to the bridge with a stream_close
+// carrying reason, then tears down the stream's inputs and handler.
+func (a *Agent) failStream(id string, reason string) {
+	slog.Warn("failing stream", "stream_id", id, "reason", reason)
+	closeMsg := StreamCloseMsg{
+		Envelope: Envelope{Type: MsgStreamClose, StreamID: id},
+		Reason:   reason,
+	}
+	_ = a.out.WriteJSON(closeMsg)
+
+	if v, ok := a.wsChanMap.LoadAndDelete(id); ok {
+		v.(*inboundQueue).abort(errFlowControl)
+	}
+	if v, ok := a.bodyMap.LoadAndDelete(id); ok {
+		v.(*requestBody).queue.abort(errFlowControl)
+	}
+	if v, ok := a.tcpMap.LoadAndDelete(id); ok {
+		v.(*inboundQueue).abort(errFlowControl)
+	}
+	if v, ok := a.execMap.LoadAndDelete(id); ok {
+		v.(*execSession).stdin.abort(errFlowControl)
+	}
+	a.cancelStream(id)
+}
+
+// protocolFault reports a frame or message from the bridge that the agent
+// cannot process. The bridge learns of it from a protocol_error, and the
+// stream it belongs to, if any, is failed so that neither side waits on it.
+// Only a bridge that requested protocol_errors is sent a protocol_error.
+func (a *Agent) protocolFault(streamID string, code ProtocolErrorCode, err error) {
+	slog.Warn("protocol error", "stream_id", streamID, "code", code, "error", err)
+	if a.features.Load().requested(CapProtocolErrors) {
+		msg := ProtocolErrorMsg{
+			Envelope:    Envelope{Type: MsgProtocolError, StreamID: streamID},
+			Code:        code,
+			Description: err.Error(),
+		}
+		if err := a.out.WriteJSON(msg); err != nil {
+			slog.Debug("failed to write protocol_error", "error", err)
+		}
+	}
+	if streamID != "" {
+		a.failStream(streamID, "protocol_error")
+	}
+}
+
+// malformed reports a message whose fields could not be decoded.
+func (a *Agent) malformed(m *inboundMessage, err error) {
+	a.protocolFault(m.StreamID, ProtocolErrMalformedMessage, fmt.Errorf("parse %s: %w", m.Type, err))
+}
+
+// handlePushError reacts to a failed delivery of inbound stream data.
+func (a *Agent) handlePushError(id string, err error) {
+	switch {
+	case errors.Is(err, errFlowControl):
+		a.failStream(id, "flow_control_error")
+	case errors.Is(err, errInboundStalled):
+		slog.Warn("stream consumer fell behind, closing stream", "stream_id", id)
+		a.cancelStream(id)
+	default:
+		slog.Debug("dropping data for closed stream", "stream_id", id, "error", err)
+	}
+}
+
+// admitStream reserves one of the concurrent streams allowed to the requested
+// port and returns the resolved port with the func that frees the slot. It
+// reports false when a limit is reached. A port that is not allowed is
+// admitted without a slot, for the stream's handler to refuse.
+func (a *Agent) admitStream(requested int, proto string) (int, func(), bool) {
+	port, err := a.cfg.ResolvePort(requested)
+	if err != nil {
+		return requested, func() {}, true
+	}
+	release, ok := a.reserveStream(port, proto)
+	return port, release, ok
+}
+
+// reserveStream reserves one of the concurrent streams allowed under key, a
+// port or one of the exec and file stream keys, and returns the func that
+// frees it. It reports false when a limit is reached.
+func (a *Agent) reserveStream(key int, proto string) (func(), bool) {
+	if !a.limiter.acquire(key) {
+		slog.Warn("refusing stream over the concurrency limit", "key", key, "protocol", proto)
+		streamsRejected.WithLabelValues(proto).Inc()
+		return nil, false
+	}
+	return func() { a.limiter.release(key) }, true
+}
+
+// streamWindow returns the per-stream receive window advertised to the bridge.
+func (a *Agent) streamWindow() int64 {
+	if a.cfg.StreamWindow > 0 {
+		return a.cfg.StreamWindow
+	}
+	return DefaultStreamWindow
+}
+
+// newInboundQueue creates the inbound queue for a stream. Flow-controlled
+// queues return consumed credit to the bridge as window_update messages.
+func (a *Agent) newInboundQueue(streamID string, flow bool) *inboundQueue {
+	var onConsume func(int64)
+	if flow {
+		onConsume = func(increment int64) {
+			update := WindowUpdateMsg{
+				Envelope:  Envelope{Type: MsgWindowUpdate, StreamID: streamID},
+				Increment: increment,
+			}
+			if err := a.out.WriteJSON(update); err != nil {
+				slog.Debug("failed to write window_update", "error", err, "stream_id", streamID)
+			}
+		}
+	}
+	return newInboundQueue(a.streamWindow(), flow, onConsume)
+}
+
+// openSendWindow registers the send window for a stream whose bridge granted
+// initial credit. It returns nil for streams without flow control.
+func (a *Agent) openSendWindow(streamID string, initial int64) *sendWindow {
+	if initial <= 0 {
+		return nil
+	}
+	window := newSendWindow(min(initial, MaxWindowSize))
+	a.windowMap.Store(streamID, window)
+	return window
+}
+
+// streamWriter returns the writer for a stream's outbound messages, charging
+// BINARY payloads against window when the stream is flow-controlled.
+func (a *Agent) streamWriter(ctx context.Context, window *sendWindow) ResponseWriter {
+	if window == nil {
+		return a.out
+	}
+	return &flowControlledWriter{ResponseWriter: a.out, ctx: ctx, window: window}
+}
+
+// handleFileRequest serves a file request as a cancellable stream. It runs
+// in its own goroutine.
+func (a *Agent) handleFileRequest(ctx context.Context, msg FileRequestMsg, body *requestBody, window *sendWindow) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	a.registry.Register(msg.StreamID, NewStream(msg.StreamID, cancel))
+	activeStreams.WithLabelValues(protoFile).Inc()
+	defer func() {
+		cancel()
+		a.registry.Remove(msg.StreamID)
+		activeStreams.WithLabelValues(protoFile).Dec()
+	}()
+
+	a.files.Handle(streamCtx, msg, body, a.compressPayloads(a.streamWriter(streamCtx, window)))
 }
 
 // handleHTTPRequest proxies an HTTP request to the local service and sends
 // the response back to the bridge. It runs in its own goroutine.
-func (a *Agent) handleHTTPRequest(ctx context.Context, msg HTTPRequestMsg, bodyData []byte) {
+func (a *Agent) handleHTTPRequest(ctx context.Context, msg HTTPRequestMsg, body io.Reader, window *sendWindow) {
 	start := time.Now()
 
 	// Register stream for cancellation support.
 	streamCtx, cancel := context.WithCancel(ctx)
 	stream := NewStream(msg.StreamID, cancel)
 	a.registry.Register(msg.StreamID, stream)
+	activeStreams.WithLabelValues(protoHTTP).Inc()
 	defer func() {
 		cancel()
 		a.registry.Remove(msg.StreamID)
+		activeStreams.WithLabelValues(protoHTTP).Dec()
 	}()
 
-	// Use streaming execution — handles both regular and SSE/chunked responses.
-	// For streaming responses (text/event-stream, chunked), body chunks are
-	// forwarded incrementally. For normal responses, the body is buffered.
-	_, err := a.proxy.ExecuteStreaming(streamCtx, msg, bodyData, a.transport)
+	// Bodies moving in either direction keep the stream alive; waiting for
+	// the response headers is bounded by the proxy timeout instead.
+	idle := newIdleTimer(a.cfg.StreamIdleTimeout, cancel)
+	defer idle.pause()
+	writer := a.compressPayloads(a.streamWriter(streamCtx, window))
+	if idle != nil {
+		writer = &idleWriter{ResponseWriter: writer, idle: idle}
+		if body != nil {
+			body = &idleReader{r: body, idle: idle}
+		}
+	}
+
+	// Every response body is streamed in bounded chunks as it is read; SSE and
+	// chunked responses forward each read as soon as it arrives.
+	_, err := a.proxy.ExecuteStreaming(streamCtx, msg, body, writer)
 	if err != nil {
 		slog.Warn("proxy execution failed",
 			"stream_id", msg.StreamID,
+			"port", msg.Port,
 			"error", err,
 		)
+		reason := "proxy_error"
+		switch {
+		case errors.Is(err, config.ErrPortNotAllowed):
+			reason = "port_not_allowed"
+		case idle.expired():
+			reason = "idle_timeout"
+			idleTimeouts.WithLabelValues(protoHTTP).Inc()
+		}
 		closeMsg := StreamCloseMsg{
 			Envelope: Envelope{Type: MsgStreamClose, StreamID: msg.StreamID},
-			Reason:   "proxy_error",
+			Reason:   reason,
 		}
-		_ = a.transport.WriteJSON(closeMsg)
+		_ = a.out.WriteJSON(closeMsg)
 		return
 	}
 
@@ -245,49 +921,97 @@ func (a *Agent) handleHTTPRequest(ctx context.Context, msg HTTPRequestMsg, bodyD
 		"stream_id", msg.StreamID,
 		"method", msg.Method,
 		"path", msg.Path,
-		"port", a.cfg.Ports[0],
+		"port", msg.Port,
 		"duration_ms", elapsed,
 	)
 }
 
-// writeResponses writes a sequence of protocol response messages via the transport.
-func (a *Agent) writeResponses(ctx context.Context, streamID string, responses []any) {
-	for _, r := range responses {
-		switch v := r.(type) {
-		case HTTPResponseMsg:
-			if err := a.transport.WriteJSON(v); err != nil {
-				slog.Warn("failed to write http_response", "error", err, "stream_id", streamID)
-				return
-			}
-		case BodyChunkMsg:
-			if err := a.transport.WriteJSONThenBinary(v, v.Data); err != nil {
-				slog.Warn("failed to write body_chunk", "error", err, "stream_id", streamID)
-				return
-			}
-		case BodyEndMsg:
-			if err := a.transport.WriteJSON(v); err != nil {
-				slog.Warn("failed to write body_end", "error", err, "stream_id", streamID)
-				return
+// portStatusLoop sends a port_status message for every probed port, then one
+// for each port that changes state, until ctx is cancelled. Nothing is sent
+// unless the bridge's hello asked for port_status.
+func (a *Agent) portStatusLoop(ctx context.Context) {
+	changes, unsubscribe := a.prober.Subscribe()
+	defer unsubscribe()
+
+	negotiated := a.negotiated
+	reported := make(map[int]probe.Status)
+	for {
+		if a.features.Load().requested(CapPortStatus) {
+			for _, state := range a.prober.States() {
+				if state.Status == probe.StatusUnknown || reported[state.Port] == state.Status {
+					continue
+				}
+				msg := PortStatusMsg{
+					Envelope: Envelope{Type: MsgPortStatus},
+					Port:     state.Port,
+					Status:   state.Status,
+					Error:    state.Error,
+				}
+				if err := a.out.WriteJSON(msg); err != nil {
+					slog.Debug("port_status write failed", "error", err)
+					return
+				}
+				reported[state.Port] = state.Status
 			}
 		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+		case <-negotiated:
+			negotiated = nil
+		}
 	}
 }
 
-// heartbeatLoop sends heartbeat messages at regular intervals until ctx is cancelled.
-func (a *Agent) heartbeatLoop(ctx context.Context) {
-	ticker := time.NewTicker(HeartbeatInterval)
-	defer ticker.Stop()
+// discoveryLoop announces every discovered port, then each port that opens or
+// closes, until ctx is cancelled. Nothing is sent unless the bridge's hello
+// asked for port_discovery.
+func (a *Agent) discoveryLoop(ctx context.Context) {
+	changes, unsubscribe := a.watcher.Subscribe()
+	defer unsubscribe()
 
+	negotiated := a.negotiated
+	announced := make(map[int]bool)
 	for {
+		if a.features.Load().requested(CapPortDiscovery) {
+			open := make(map[int]bool)
+			for _, port := range a.watcher.Ports() {
+				open[port] = true
+				if announced[port] {
+					continue
+				}
+				msg := PortOpenedMsg{
+					Envelope: Envelope{Type: MsgPortOpened},
+					Port:     port,
+					Routable: a.cfg.AllowsPort(port),
+				}
+				if err := a.out.WriteJSON(msg); err != nil {
+					slog.Debug("port_opened write failed", "error", err)
+					return
+				}
+				announced[port] = true
+			}
+			for port := range announced {
+				if open[port] {
+					continue
+				}
+				msg := PortClosedMsg{Envelope: Envelope{Type: MsgPortClosed}, Port: port}
+				if err := a.out.WriteJSON(msg); err != nil {
+					slog.Debug("port_closed write failed", "error", err)
+					return
+				}
+				delete(announced, port)
+			}
+		}
+
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			hb := HeartbeatMsg{Envelope: Envelope{Type: MsgHeartbeat}}
-			if err := a.transport.WriteJSON(hb); err != nil {
-				slog.Warn("heartbeat write failed", "error", err)
-				return
-			}
+		case <-changes:
+		case <-negotiated:
+			negotiated = nil
 		}
 	}
 }
@@ -313,12 +1037,15 @@ func (a *Agent) gracefulShutdown() {
 	}
 }
 
-// isClosedPipeError checks if an error is due to a closed pipe/reader.
+// isClosedPipeError checks if an error is due to a closed pipe/reader or a
+// closed or reset connection.
 func isClosedPipeError(err error) bool {
 	if err == nil {
 		return false
 	}
 	return errors.Is(err, io.ErrClosedPipe) ||
 		errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
 		errors.Is(err, io.ErrUnexpectedEOF)
 }
@@ -3,15 +3,24 @@ package tunnel
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/discovery"
+	"docker-bridge-tunnel-agent/internal/probe"
 	"docker-bridge-tunnel-agent/internal/transport"
+	"docker-bridge-tunnel-agent/internal/upstream"
 )
 
 func newTestAgentConfig(ports []int) *config.Config {
@@ -72,13 +81,12 @@ func TestAgentReadyMessageOnStartup(t *testing.T) {
 }
 
 // TestAgentHeartbeat verifies that heartbeat messages are sent periodically.
-// Uses a short wait since the default interval is 10s — we just check that at least
-// one heartbeat arrives within a reasonable time.
 func TestAgentHeartbeat(t *testing.T) {
 	cfg := newTestAgentConfig([]int{3000})
+	cfg.HeartbeatInterval = 100 * time.Millisecond
 	agent, _, bridgeRead := newAgentTestPair(cfg)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	go func() {
@@ -91,7 +99,6 @@ func TestAgentHeartbeat(t *testing.T) {
 		t.Fatalf("read ready: %v", err)
 	}
 
-	// Wait for heartbeat (10s interval + some slack).
 	heartbeatCh := make(chan Envelope, 1)
 	go func() {
 		for {
@@ -114,7 +121,7 @@ func TestAgentHeartbeat(t *testing.T) {
 		if hb.Type != MsgHeartbeat {
 			t.Errorf("expected heartbeat, got %q", hb.Type)
 		}
-	case <-time.After(12 * time.Second):
+	case <-time.After(2 * time.Second):
 		t.Fatal("timed out waiting for heartbeat")
 	}
 
@@ -257,3 +264,1303 @@ func TestAgentMethods(t *testing.T) {
 		t.Error("Expected 0 active streams before Run()")
 	}
 }
+
+// TestAgentHTTPRequestPortNotAllowed verifies a request for a port outside the
+// allow-list is answered with stream_close reason=port_not_allowed.
+func TestAgentHTTPRequestPortNotAllowed(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+
+	// Skip ready message.
+	if _, _, err := bridgeRead.ReadFrame(); err != nil {
+		t.Fatalf("read ready: %v", err)
+	}
+
+	reqMsg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "denied-stream"},
+		Port:     4000,
+		Method:   "GET",
+		Path:     "/",
+		Headers:  map[string]string{"host": "localhost"},
+	}
+	if err := bridgeWrite.WriteJSON(reqMsg); err != nil {
+		t.Fatalf("write http_request: %v", err)
+	}
+
+	for {
+		_, data, err := bridgeRead.ReadFrame()
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		var closeMsg StreamCloseMsg
+		if json.Unmarshal(data, &closeMsg) != nil || closeMsg.Type != MsgStreamClose {
+			continue
+		}
+		if closeMsg.StreamID != "denied-stream" {
+			t.Errorf("expected stream_id=denied-stream, got %q", closeMsg.StreamID)
+		}
+		if closeMsg.Reason != "port_not_allowed" {
+			t.Errorf("expected reason=port_not_allowed, got %q", closeMsg.Reason)
+		}
+		break
+	}
+
+	cancel()
+}
+
+// TestAgentStreamedRequestBody verifies a body sent as body_chunk/body_end frames
+// is piped to the upstream request as it arrives.
+func TestAgentStreamedRequestBody(t *testing.T) {
+	received := make(chan string, 1)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		received <- string(data)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer localServer.Close()
+	localPort := localServer.Listener.Addr().(*net.TCPAddr).Port
+
+	cfg := newTestAgentConfig([]int{localPort})
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+
+	// Skip ready message.
+	if _, _, err := bridgeRead.ReadFrame(); err != nil {
+		t.Fatalf("read ready: %v", err)
+	}
+
+	reqMsg := HTTPRequestMsg{
+		Envelope:   Envelope{Type: MsgHTTPRequest, StreamID: "upload-1"},
+		Method:     "POST",
+		Path:       "/upload",
+		Headers:    map[string]string{"host": "localhost"},
+		BodyStream: true,
+	}
+	if err := bridgeWrite.WriteJSON(reqMsg); err != nil {
+		t.Fatalf("write http_request: %v", err)
+	}
+	for _, part := range []string{"first,", "second,", "third"} {
+		chunk := BodyChunkMsg{Envelope: Envelope{Type: MsgBodyChunk, StreamID: "upload-1"}}
+		if err := bridgeWrite.WriteJSONThenBinary(chunk, []byte(part)); err != nil {
+			t.Fatalf("write body_chunk: %v", err)
+		}
+	}
+	if err := bridgeWrite.WriteJSON(BodyEndMsg{Envelope: Envelope{Type: MsgBodyEnd, StreamID: "upload-1"}}); err != nil {
+		t.Fatalf("write body_end: %v", err)
+	}
+
+	select {
+	case got := <-received:
+		if got != "first,second,third" {
+			t.Errorf("upstream body = %q, want %q", got, "first,second,third")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("upstream did not receive the streamed body")
+	}
+
+	for {
+		_, data, err := bridgeRead.ReadFrame()
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		var resp HTTPResponseMsg
+		if json.Unmarshal(data, &resp) == nil && resp.Type == MsgHTTPResponse {
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("expected status 201, got %d", resp.StatusCode)
+			}
+			break
+		}
+	}
+
+	cancel()
+}
+
+// readMessage reads frames from the agent until a TEXT frame of type want
+// arrives, skipping heartbeats and other message types. It returns the raw JSON.
+func readMessage(t *testing.T, bridgeRead transport.Transport, want MessageType) []byte {
+	t.Helper()
+	for {
+		ft, data, err := bridgeRead.ReadFrame()
+		if err != nil {
+			t.Fatalf("read %s: %v", want, err)
+		}
+		if ft != transport.FrameText {
+			continue
+		}
+		var env Envelope
+		if json.Unmarshal(data, &env) == nil && env.Type == want {
+			return data
+		}
+	}
+}
+
+// expectNoneBefore reads messages from the agent until one of type until
+// arrives, failing if one of type unwanted comes first.
+func expectNoneBefore(t *testing.T, bridgeRead transport.Transport, unwanted, until MessageType) {
+	t.Helper()
+	for {
+		_, data, err := bridgeRead.ReadFrame()
+		if err != nil {
+			t.Fatalf("read %s: %v", until, err)
+		}
+		var env Envelope
+		if json.Unmarshal(data, &env) != nil {
+			continue
+		}
+		switch env.Type {
+		case unwanted:
+			t.Fatalf("%s sent before %s", unwanted, until)
+		case until:
+			return
+		}
+	}
+}
+
+// TestAgentReadyAdvertisesWindow verifies the ready message carries the
+// agent's per-stream receive window.
+func TestAgentReadyAdvertisesWindow(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	cfg.StreamWindow = 65536
+	agent, _, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+
+	var ready ReadyMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgReady), &ready); err != nil {
+		t.Fatalf("unmarshal ready: %v", err)
+	}
+	if ready.Window != 65536 {
+		t.Errorf("expected window=65536, got %d", ready.Window)
+	}
+
+	cancel()
+}
+
+// TestAgentResponseFlowControl verifies response body chunks stop once the
+// bridge's window is spent and resume after a window_update.
+func TestAgentResponseFlowControl(t *testing.T) {
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("aaaabbbb"))
+	}))
+	defer localServer.Close()
+	localPort := localServer.Listener.Addr().(*net.TCPAddr).Port
+
+	cfg := newTestAgentConfig([]int{localPort})
+	cfg.MaxBodyChunkSize = 4
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	reqMsg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "fc-1"},
+		Method:   "GET",
+		Path:     "/",
+		Headers:  map[string]string{"host": "localhost"},
+		Window:   4,
+	}
+	if err := bridgeWrite.WriteJSON(reqMsg); err != nil {
+		t.Fatalf("write http_request: %v", err)
+	}
+
+	readMessage(t, bridgeRead, MsgHTTPResponse)
+	readMessage(t, bridgeRead, MsgBodyChunk)
+
+	// The window is spent: the second chunk must wait for credit.
+	next := make(chan MessageType, 1)
+	go func() {
+		for {
+			ft, data, err := bridgeRead.ReadFrame()
+			if err != nil {
+				return
+			}
+			var env Envelope
+			if ft == transport.FrameText && json.Unmarshal(data, &env) == nil && env.Type != MsgHeartbeat {
+				next <- env.Type
+				return
+			}
+		}
+	}()
+	select {
+	case typ := <-next:
+		t.Fatalf("expected agent to wait for window_update, got %q", typ)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	update := WindowUpdateMsg{Envelope: Envelope{Type: MsgWindowUpdate, StreamID: "fc-1"}, Increment: 4}
+	if err := bridgeWrite.WriteJSON(update); err != nil {
+		t.Fatalf("write window_update: %v", err)
+	}
+	select {
+	case typ := <-next:
+		if typ != MsgBodyChunk {
+			t.Errorf("expected body_chunk after window_update, got %q", typ)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent did not resume after window_update")
+	}
+
+	cancel()
+}
+
+// TestAgentInboundWindowExceeded verifies ws_data beyond the advertised window
+// fails the stream with stream_close reason=flow_control_error.
+func TestAgentInboundWindowExceeded(t *testing.T) {
+	wsURL, _, _, cleanup := echoWSServer(t)
+	defer cleanup()
+	port, path := parseWSTestURL(t, wsURL)
+
+	cfg := newTestAgentConfig([]int{port})
+	cfg.StreamWindow = 8
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	upgrade := WSUpgradeMsg{
+		Envelope: Envelope{Type: MsgWSUpgrade, StreamID: "fc-ws"},
+		Path:     path,
+		Headers:  map[string]string{},
+		Window:   1024,
+	}
+	if err := bridgeWrite.WriteJSON(upgrade); err != nil {
+		t.Fatalf("write ws_upgrade: %v", err)
+	}
+	readMessage(t, bridgeRead, MsgWSUpgradeAck)
+
+	dataMsg := WSDataMsg{Envelope: Envelope{Type: MsgWSData, StreamID: "fc-ws"}, BodyFollows: true}
+	if err := bridgeWrite.WriteJSONThenBinary(dataMsg, []byte("more than eight bytes")); err != nil {
+		t.Fatalf("write ws_data: %v", err)
+	}
+
+	var closeMsg StreamCloseMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgStreamClose), &closeMsg); err != nil {
+		t.Fatalf("unmarshal stream_close: %v", err)
+	}
+	if closeMsg.Reason != "flow_control_error" {
+		t.Errorf("expected reason=flow_control_error, got %q", closeMsg.Reason)
+	}
+
+	cancel()
+}
+
+// TestAgentReadyAdvertisesCapabilities verifies the ready message carries the
+// protocol version range, agent version and capability list.
+func TestAgentReadyAdvertisesCapabilities(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	agent, _, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+
+	var ready ReadyMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgReady), &ready); err != nil {
+		t.Fatalf("unmarshal ready: %v", err)
+	}
+	if ready.ProtocolVersion != ProtocolVersion || ready.MinProtocolVersion != MinProtocolVersion {
+		t.Errorf("versions = %d-%d, want %d-%d",
+			ready.MinProtocolVersion, ready.ProtocolVersion, MinProtocolVersion, ProtocolVersion)
+	}
+	if ready.AgentVersion != AgentVersion {
+		t.Errorf("agent_version = %q, want %q", ready.AgentVersion, AgentVersion)
+	}
+	if !slices.Contains(ready.Capabilities, CapFlowControl) {
+		t.Errorf("capabilities %v missing %q", ready.Capabilities, CapFlowControl)
+	}
+
+	cancel()
+}
+
+// TestAgentHelloEnablesFeatures verifies a hello is answered with the
+// negotiated version and the capabilities both sides support.
+func TestAgentHelloEnablesFeatures(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	hello := HelloMsg{
+		Envelope:        Envelope{Type: MsgHello},
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    []Capability{CapMultiHeaders, "future_feature"},
+	}
+	if err := bridgeWrite.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+
+	var ack HelloAckMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgHelloAck), &ack); err != nil {
+		t.Fatalf("unmarshal hello_ack: %v", err)
+	}
+	if !ack.Success {
+		t.Fatalf("expected success, got error %q", ack.Error)
+	}
+	if ack.ProtocolVersion != ProtocolVersion {
+		t.Errorf("protocol_version = %d, want %d", ack.ProtocolVersion, ProtocolVersion)
+	}
+	if !slices.Equal(ack.Capabilities, []Capability{CapMultiHeaders}) {
+		t.Errorf("capabilities = %v, want [%s]", ack.Capabilities, CapMultiHeaders)
+	}
+	if agent.features.Load().has(CapFlowControl) {
+		t.Error("flow_control should be disabled when the hello does not request it")
+	}
+
+	cancel()
+}
+
+// TestAgentHelloRejectsIncompatibleBridge verifies the agent answers an
+// incompatible hello with a failed hello_ack and stops.
+func TestAgentHelloRejectsIncompatibleBridge(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	hello := HelloMsg{
+		Envelope:           Envelope{Type: MsgHello},
+		ProtocolVersion:    ProtocolVersion + 2,
+		MinProtocolVersion: ProtocolVersion + 1,
+	}
+	if err := bridgeWrite.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+
+	var ack HelloAckMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgHelloAck), &ack); err != nil {
+		t.Fatalf("unmarshal hello_ack: %v", err)
+	}
+	if ack.Success || ack.Error == "" {
+		t.Errorf("expected a failed hello_ack with an error, got %+v", ack)
+	}
+
+	select {
+	case err := <-runErr:
+		if !errors.Is(err, ErrIncompatiblePeer) {
+			t.Errorf("Run() error = %v, want ErrIncompatiblePeer", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run() did not exit after an incompatible hello")
+	}
+}
+
+// TestAgentHelloHeartbeatInterval verifies the ready message advertises the
+// configured heartbeat interval and a hello may change it within bounds.
+func TestAgentHelloHeartbeatInterval(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	cfg.HeartbeatInterval = 3 * time.Second
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+
+	var ready ReadyMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgReady), &ready); err != nil {
+		t.Fatalf("unmarshal ready: %v", err)
+	}
+	if ready.HeartbeatInterval != 3000 {
+		t.Errorf("ready heartbeat_interval_ms = %d, want 3000", ready.HeartbeatInterval)
+	}
+
+	hello := HelloMsg{
+		Envelope:          Envelope{Type: MsgHello},
+		ProtocolVersion:   ProtocolVersion,
+		HeartbeatInterval: 10,
+	}
+	if err := bridgeWrite.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+
+	var ack HelloAckMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgHelloAck), &ack); err != nil {
+		t.Fatalf("unmarshal hello_ack: %v", err)
+	}
+	if want := MinHeartbeatInterval.Milliseconds(); ack.HeartbeatInterval != want {
+		t.Errorf("hello_ack heartbeat_interval_ms = %d, want %d", ack.HeartbeatInterval, want)
+	}
+
+	cancel()
+}
+
+// TestAgentPingPong verifies that once the bridge enables ping the agent
+// measures the round trip of its pings, and that it answers the bridge's.
+func TestAgentPingPong(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	cfg.HeartbeatInterval = 50 * time.Millisecond
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	hello := HelloMsg{
+		Envelope:        Envelope{Type: MsgHello},
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    []Capability{CapPing},
+	}
+	if err := bridgeWrite.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+	readMessage(t, bridgeRead, MsgHelloAck)
+
+	// A pong only counts for the latest ping, which a slow test may miss, so
+	// answer pings until one is measured. The bridge's own ping is read after
+	// its pong, so the agent's pong shows the round trip has been recorded.
+	for seq := uint64(1); ; seq++ {
+		var ping PingMsg
+		if err := json.Unmarshal(readMessage(t, bridgeRead, MsgPing), &ping); err != nil {
+			t.Fatalf("unmarshal ping: %v", err)
+		}
+		if err := bridgeWrite.WriteJSON(PongMsg{Envelope: Envelope{Type: MsgPong}, Seq: ping.Seq}); err != nil {
+			t.Fatalf("write pong: %v", err)
+		}
+		if err := bridgeWrite.WriteJSON(PingMsg{Envelope: Envelope{Type: MsgPing}, Seq: seq}); err != nil {
+			t.Fatalf("write ping: %v", err)
+		}
+
+		var pong PongMsg
+		if err := json.Unmarshal(readMessage(t, bridgeRead, MsgPong), &pong); err != nil {
+			t.Fatalf("unmarshal pong: %v", err)
+		}
+		if pong.Seq != seq {
+			t.Fatalf("pong seq = %d, want %d", pong.Seq, seq)
+		}
+		if rtt, at := agent.BridgeLatency(); !at.IsZero() {
+			if rtt <= 0 {
+				t.Errorf("BridgeLatency() rtt = %v, want a positive round trip", rtt)
+			}
+			break
+		}
+	}
+
+	cancel()
+}
+
+// TestAgentUnresponsiveBridge verifies the agent closes its streams and exits
+// when a bridge that enabled ping stops sending anything.
+func TestAgentUnresponsiveBridge(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	cfg.HeartbeatInterval = 50 * time.Millisecond
+	cfg.HeartbeatTimeout = 200 * time.Millisecond
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	hello := HelloMsg{
+		Envelope:        Envelope{Type: MsgHello},
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    []Capability{CapPing},
+	}
+	if err := bridgeWrite.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+	readMessage(t, bridgeRead, MsgHelloAck)
+
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	defer cancelStream()
+	agent.registry.Register("stream-1", NewStream("stream-1", cancelStream))
+
+	// Stop reading, as a wedged bridge would: the agent's pings then block
+	// on the pipe, which must not keep it from giving up.
+	select {
+	case err := <-runErr:
+		if !errors.Is(err, ErrBridgeUnresponsive) {
+			t.Errorf("Run() error = %v, want ErrBridgeUnresponsive", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run() did not exit for an unresponsive bridge")
+	}
+	if streamCtx.Err() == nil {
+		t.Error("expected the active stream to be cancelled")
+	}
+}
+
+// TestAgentTCPStream verifies tcp_connect, tcp_data and a half-closing
+// stream_close from the bridge are routed to the TCP proxy.
+func TestAgentTCPStream(t *testing.T) {
+	port := tcpTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		_, _ = conn.Write(request)
+	})
+
+	cfg := newTestAgentConfig([]int{port})
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	connect := TCPConnectMsg{Envelope: Envelope{Type: MsgTCPConnect, StreamID: "tcp-1"}}
+	if err := bridgeWrite.WriteJSON(connect); err != nil {
+		t.Fatalf("write tcp_connect: %v", err)
+	}
+	var ack TCPConnectAckMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgTCPConnectAck), &ack); err != nil {
+		t.Fatalf("unmarshal ack: %v", err)
+	}
+	if !ack.Success {
+		t.Fatalf("expected Success=true, got error=%q", ack.Error)
+	}
+
+	dataMsg := TCPDataMsg{Envelope: Envelope{Type: MsgTCPData, StreamID: "tcp-1"}, BodyFollows: true}
+	if err := bridgeWrite.WriteJSONThenBinary(dataMsg, []byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		t.Fatalf("write tcp_data: %v", err)
+	}
+	halfClose := StreamCloseMsg{Envelope: Envelope{Type: MsgStreamClose, StreamID: "tcp-1"}, HalfClose: true}
+	if err := bridgeWrite.WriteJSON(halfClose); err != nil {
+		t.Fatalf("write stream_close: %v", err)
+	}
+
+	readMessage(t, bridgeRead, MsgTCPData)
+	_, echoed, err := bridgeRead.ReadFrame()
+	if err != nil {
+		t.Fatalf("read tcp_data body: %v", err)
+	}
+	if string(echoed) != "*1\r\n$4\r\nPING\r\n" {
+		t.Errorf("echoed %q", echoed)
+	}
+
+	var closeMsg StreamCloseMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgStreamClose), &closeMsg); err != nil {
+		t.Fatalf("unmarshal stream_close: %v", err)
+	}
+	if !closeMsg.HalfClose {
+		t.Errorf("expected the local EOF to arrive as a half-close, got %+v", closeMsg)
+	}
+
+	cancel()
+}
+
+// TestAgentPortStatus verifies the agent reports each probed port once the
+// bridge's hello enables port_status, and again whenever a port changes state.
+func TestAgentPortStatus(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	cfg := newTestAgentConfig([]int{port})
+	prober := probe.NewProber([]int{port}, time.Hour, upstream.NewDialer(cfg, probe.DialTimeout))
+	prober.ProbeAll(context.Background())
+
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+	agent.WatchPorts(prober)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+	// Give the agent time to report anything it would report unasked.
+	time.Sleep(100 * time.Millisecond)
+
+	hello := HelloMsg{
+		Envelope:        Envelope{Type: MsgHello},
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    []Capability{CapPortStatus},
+	}
+	if err := bridgeWrite.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+	expectNoneBefore(t, bridgeRead, MsgPortStatus, MsgHelloAck)
+
+	var status PortStatusMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgPortStatus), &status); err != nil {
+		t.Fatalf("unmarshal port_status: %v", err)
+	}
+	if status.Port != port || status.Status != probe.StatusUp {
+		t.Errorf("initial port_status = %+v, want port %d up", status, port)
+	}
+
+	ln.Close()
+	prober.ProbeAll(context.Background())
+
+	status = PortStatusMsg{}
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgPortStatus), &status); err != nil {
+		t.Fatalf("unmarshal port_status: %v", err)
+	}
+	if status.Port != port || status.Status != probe.StatusDown || status.Error == "" {
+		t.Errorf("port_status after close = %+v, want port %d down with an error", status, port)
+	}
+
+	cancel()
+}
+
+// TestAgentAnnouncesDiscoveredPorts verifies discovered ports are announced
+// with port_opened and port_closed once the bridge's hello enables
+// port_discovery.
+func TestAgentAnnouncesDiscoveredPorts(t *testing.T) {
+	table := filepath.Join(t.TempDir(), "tcp")
+	writeTable := func(entries string) {
+		header := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+		if err := os.WriteFile(table, []byte(header+entries), 0o644); err != nil {
+			t.Fatalf("write table: %v", err)
+		}
+	}
+	// 0.0.0.0:5173 listening.
+	writeTable("   0: 00000000:1435 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1 1 0 100 0 0 10 0\n")
+
+	saved := discovery.ProcNetTCP
+	discovery.ProcNetTCP = []string{table}
+	t.Cleanup(func() { discovery.ProcNetTCP = saved })
+
+	cfg := newTestAgentConfig([]int{3000})
+	cfg.DiscoverInclude = []config.PortRange{{First: 1024, Last: 65535}}
+	cfg.DiscoverRoute = true
+	watcher := discovery.NewWatcher(cfg)
+	if err := watcher.Scan(); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+	agent.WatchListeners(watcher)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+	// Give the agent time to announce anything it would announce unasked.
+	time.Sleep(100 * time.Millisecond)
+
+	hello := HelloMsg{
+		Envelope:        Envelope{Type: MsgHello},
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    []Capability{CapPortDiscovery},
+	}
+	if err := bridgeWrite.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+	expectNoneBefore(t, bridgeRead, MsgPortOpened, MsgHelloAck)
+
+	var opened PortOpenedMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgPortOpened), &opened); err != nil {
+		t.Fatalf("unmarshal port_opened: %v", err)
+	}
+	if opened.Port != 5173 || !opened.Routable {
+		t.Errorf("port_opened = %+v, want routable port 5173", opened)
+	}
+
+	writeTable("")
+	if err := watcher.Scan(); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	var closed PortClosedMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgPortClosed), &closed); err != nil {
+		t.Fatalf("unmarshal port_closed: %v", err)
+	}
+	if closed.Port != 5173 {
+		t.Errorf("port_closed port = %d, want 5173", closed.Port)
+	}
+
+	cancel()
+}
+
+// TestAgentMsgpackEnvelopes verifies that once msgpack is negotiated both
+// sides exchange compact frames, each payload travelling with its envelope.
+func TestAgentMsgpackEnvelopes(t *testing.T) {
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte("echo:"), body...))
+	}))
+	defer localServer.Close()
+	localPort := localServer.Listener.Addr().(*net.TCPAddr).Port
+
+	cfg := newTestAgentConfig([]int{localPort})
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	hello := HelloMsg{
+		Envelope:        Envelope{Type: MsgHello},
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    []Capability{CapMsgpack},
+	}
+	if err := bridgeWrite.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+	// The hello_ack is still JSON.
+	readMessage(t, bridgeRead, MsgHelloAck)
+
+	bridgeWrite.SetEncoding(transport.EncodingMsgpack)
+	reqMsg := HTTPRequestMsg{
+		Envelope:    Envelope{Type: MsgHTTPRequest, StreamID: "compact-1"},
+		Method:      "POST",
+		Path:        "/",
+		Headers:     map[string]string{"host": "localhost"},
+		BodyFollows: true,
+	}
+	if err := bridgeWrite.WriteJSONThenBinary(reqMsg, []byte("hi")); err != nil {
+		t.Fatalf("write http_request: %v", err)
+	}
+
+	var types []MessageType
+	var body []byte
+	for {
+		ft, data, err := bridgeRead.ReadFrame()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if ft != transport.FrameMsgpack {
+			t.Fatalf("frame type 0x%02x, want compact frames only", ft)
+		}
+		m, err := decodeInbound(ft, data)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if m.Type == MsgHeartbeat {
+			continue
+		}
+		types = append(types, m.Type)
+		if m.Type == MsgBodyChunk {
+			body = append(body, m.payload...)
+		}
+		if m.Type == MsgBodyEnd {
+			break
+		}
+	}
+	if !slices.Equal(types, []MessageType{MsgHTTPResponse, MsgBodyChunk, MsgBodyEnd}) {
+		t.Errorf("messages = %v", types)
+	}
+	if string(body) != "echo:hi" {
+		t.Errorf("body = %q, want echo:hi", body)
+	}
+}
+
+// TestAgentCompressesResponseBodies verifies that a bridge asking for
+// compress_gzip receives gzipped body chunks it can inflate, and that
+// compression stays off without a hello.
+func TestAgentCompressesResponseBodies(t *testing.T) {
+	page := strings.Repeat("<p>hello from the dev server</p>\n", 256)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = io.WriteString(w, page)
+	}))
+	defer localServer.Close()
+	localPort := localServer.Listener.Addr().(*net.TCPAddr).Port
+
+	for _, negotiated := range []bool{true, false} {
+		cfg := newTestAgentConfig([]int{localPort})
+		cfg.CompressThreshold = 1024
+		agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		go func() {
+			_ = agent.Run(ctx)
+		}()
+		readMessage(t, bridgeRead, MsgReady)
+
+		if negotiated {
+			hello := HelloMsg{
+				Envelope:        Envelope{Type: MsgHello},
+				ProtocolVersion: ProtocolVersion,
+				Capabilities:    []Capability{CapCompressGzip},
+			}
+			if err := bridgeWrite.WriteJSON(hello); err != nil {
+				t.Fatalf("write hello: %v", err)
+			}
+			readMessage(t, bridgeRead, MsgHelloAck)
+		}
+
+		reqMsg := HTTPRequestMsg{
+			Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "gz-1"},
+			Method:   "GET",
+			Path:     "/",
+			Headers:  map[string]string{"host": "localhost"},
+		}
+		if err := bridgeWrite.WriteJSON(reqMsg); err != nil {
+			t.Fatalf("write http_request: %v", err)
+		}
+
+		var chunk BodyChunkMsg
+		if err := json.Unmarshal(readMessage(t, bridgeRead, MsgBodyChunk), &chunk); err != nil {
+			t.Fatalf("unmarshal body_chunk: %v", err)
+		}
+		_, data, err := bridgeRead.ReadFrame()
+		if err != nil {
+			t.Fatalf("read body frame: %v", err)
+		}
+		cancel()
+
+		if !negotiated {
+			if chunk.Compression != "" || string(data) != page {
+				t.Errorf("without a hello: compression %q, %d body bytes", chunk.Compression, len(data))
+			}
+			continue
+		}
+		if chunk.Compression != CompressionGzip {
+			t.Fatalf("compression = %q, want gzip", chunk.Compression)
+		}
+		if got := gunzip(t, data); string(got) != page {
+			t.Errorf("inflated body is %d bytes, want the %d byte page", len(got), len(page))
+		}
+	}
+}
+
+// TestAgentFileTransfer verifies a file written through the tunnel with
+// body_chunk frames can be read back.
+func TestAgentFileTransfer(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestAgentConfig([]int{3000})
+	cfg.FileRoots = []string{root}
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	path := filepath.Join(root, "notes.txt")
+	write := FileRequestMsg{Envelope: Envelope{Type: MsgFileWrite, StreamID: "w-1"}, Path: path}
+	if err := bridgeWrite.WriteJSON(write); err != nil {
+		t.Fatalf("write file_write: %v", err)
+	}
+	chunk := BodyChunkMsg{Envelope: Envelope{Type: MsgBodyChunk, StreamID: "w-1"}}
+	for _, part := range []string{"hello ", "tunnel"} {
+		if err := bridgeWrite.WriteJSONThenBinary(chunk, []byte(part)); err != nil {
+			t.Fatalf("write body_chunk: %v", err)
+		}
+	}
+	if err := bridgeWrite.WriteJSON(BodyEndMsg{Envelope: Envelope{Type: MsgBodyEnd, StreamID: "w-1"}}); err != nil {
+		t.Fatalf("write body_end: %v", err)
+	}
+
+	var result FileResultMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgFileResult), &result); err != nil {
+		t.Fatalf("unmarshal file_result: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("file_write failed: %s", result.Error)
+	}
+
+	read := FileRequestMsg{Envelope: Envelope{Type: MsgFileRead, StreamID: "r-1"}, Path: path}
+	if err := bridgeWrite.WriteJSON(read); err != nil {
+		t.Fatalf("write file_read: %v", err)
+	}
+	readMessage(t, bridgeRead, MsgFileResult)
+	readMessage(t, bridgeRead, MsgBodyChunk)
+	_, data, err := bridgeRead.ReadFrame()
+	if err != nil {
+		t.Fatalf("read body frame: %v", err)
+	}
+	if string(data) != "hello tunnel" {
+		t.Errorf("read back %q, want %q", data, "hello tunnel")
+	}
+}
+
+// TestAgentStreamLimits verifies that streams over the per-port limit get a
+// 503 or a failed ack at once, and that a finished stream frees its slot.
+func TestAgentStreamLimits(t *testing.T) {
+	release := make(chan struct{})
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer localServer.Close()
+	localPort := localServer.Listener.Addr().(*net.TCPAddr).Port
+
+	cfg := newTestAgentConfig([]int{localPort})
+	cfg.MaxStreamsPerPort = 1
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	request := func(id, path string) {
+		t.Helper()
+		req := HTTPRequestMsg{
+			Envelope: Envelope{Type: MsgHTTPRequest, StreamID: id},
+			Method:   "GET",
+			Path:     path,
+			Headers:  map[string]string{},
+		}
+		if err := bridgeWrite.WriteJSON(req); err != nil {
+			t.Fatalf("write http_request: %v", err)
+		}
+	}
+	request("slow", "/slow")
+	deadline := time.Now().Add(2 * time.Second)
+	for agent.ActiveStreams() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first request never started")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	request("busy", "/")
+	var resp HTTPResponseMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgHTTPResponse), &resp); err != nil {
+		t.Fatalf("unmarshal http_response: %v", err)
+	}
+	if resp.StreamID != "busy" || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d on %q, want 503 on the second request", resp.StatusCode, resp.StreamID)
+	}
+	readMessage(t, bridgeRead, MsgBodyEnd)
+
+	upgrade := WSUpgradeMsg{Envelope: Envelope{Type: MsgWSUpgrade, StreamID: "ws"}, Path: "/"}
+	if err := bridgeWrite.WriteJSON(upgrade); err != nil {
+		t.Fatalf("write ws_upgrade: %v", err)
+	}
+	var ack WSUpgradeAckMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgWSUpgradeAck), &ack); err != nil {
+		t.Fatalf("unmarshal ws_upgrade_ack: %v", err)
+	}
+	if ack.Success {
+		t.Error("ws_upgrade over the limit succeeded")
+	}
+	var closeMsg StreamCloseMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgStreamClose), &closeMsg); err != nil {
+		t.Fatalf("unmarshal stream_close: %v", err)
+	}
+	if closeMsg.Reason != "too_many_streams" {
+		t.Errorf("stream_close reason = %q, want too_many_streams", closeMsg.Reason)
+	}
+
+	close(release)
+	readMessage(t, bridgeRead, MsgBodyEnd)
+	deadline = time.Now().Add(2 * time.Second)
+	for agent.ActiveStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first request never finished")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	request("after", "/")
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgHTTPResponse), &resp); err != nil {
+		t.Fatalf("unmarshal http_response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status after the first request finished = %d, want 200", resp.StatusCode)
+	}
+
+	cancel()
+}
+
+// TestAgentExecStreamLimits verifies exec streams count against
+// MaxStreams: one over the limit gets a failed ack and a too_many_streams
+// stream_close, and the slot is freed when the running command ends.
+func TestAgentExecStreamLimits(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	cfg.ExecAllow = []string{"sleep"}
+	cfg.MaxStreams = 1
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	start := func(id string) ExecStartAckMsg {
+		t.Helper()
+		msg := ExecStartMsg{
+			Envelope: Envelope{Type: MsgExecStart, StreamID: id},
+			Command:  []string{"sleep", "30"},
+		}
+		if err := bridgeWrite.WriteJSON(msg); err != nil {
+			t.Fatalf("write exec_start: %v", err)
+		}
+		var ack ExecStartAckMsg
+		if err := json.Unmarshal(readMessage(t, bridgeRead, MsgExecStartAck), &ack); err != nil {
+			t.Fatalf("unmarshal exec_start_ack: %v", err)
+		}
+		if ack.StreamID != id {
+			t.Fatalf("exec_start_ack for %q, want %q", ack.StreamID, id)
+		}
+		return ack
+	}
+
+	if ack := start("first"); !ack.Success {
+		t.Fatalf("first exec refused: %+v", ack)
+	}
+	if ack := start("busy"); ack.Success {
+		t.Error("exec_start over the limit succeeded")
+	}
+	var closeMsg StreamCloseMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgStreamClose), &closeMsg); err != nil {
+		t.Fatalf("unmarshal stream_close: %v", err)
+	}
+	if closeMsg.StreamID != "busy" || closeMsg.Reason != "too_many_streams" {
+		t.Errorf("stream_close = %+v, want too_many_streams on busy", closeMsg)
+	}
+
+	// Ending the first command frees its slot.
+	stop := StreamCloseMsg{Envelope: Envelope{Type: MsgStreamClose, StreamID: "first"}}
+	if err := bridgeWrite.WriteJSON(stop); err != nil {
+		t.Fatalf("write stream_close: %v", err)
+	}
+	readMessage(t, bridgeRead, MsgStreamClose)
+	deadline := time.Now().Add(2 * time.Second)
+	for i := 0; !start(fmt.Sprintf("after-%d", i)).Success; i++ {
+		// A refused exec is followed by its stream_close.
+		readMessage(t, bridgeRead, MsgStreamClose)
+		if time.Now().After(deadline) {
+			t.Fatal("exec still refused after the first command ended")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+}
+
+// TestAgentHTTPIdleTimeout verifies a response body that stops flowing is
+// closed with reason idle_timeout.
+func TestAgentHTTPIdleTimeout(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: hello\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-stop:
+		case <-r.Context().Done():
+		}
+	}))
+	defer localServer.Close()
+	localPort := localServer.Listener.Addr().(*net.TCPAddr).Port
+
+	cfg := newTestAgentConfig([]int{localPort})
+	cfg.StreamIdleTimeout = 200 * time.Millisecond
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	req := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "sse"},
+		Method:   "GET",
+		Path:     "/events",
+		Headers:  map[string]string{},
+	}
+	if err := bridgeWrite.WriteJSON(req); err != nil {
+		t.Fatalf("write http_request: %v", err)
+	}
+	readMessage(t, bridgeRead, MsgBodyChunk)
+
+	var closeMsg StreamCloseMsg
+	if err := json.Unmarshal(readMessage(t, bridgeRead, MsgStreamClose), &closeMsg); err != nil {
+		t.Fatalf("unmarshal stream_close: %v", err)
+	}
+	if closeMsg.Reason != "idle_timeout" {
+		t.Errorf("stream_close reason = %q, want idle_timeout", closeMsg.Reason)
+	}
+
+	cancel()
+}
+
+// TestAgentProtocolErrors verifies that frames and messages the agent cannot
+// process are reported with protocol_error, failing the stream they name.
+func TestAgentProtocolErrors(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	hello := HelloMsg{
+		Envelope:        Envelope{Type: MsgHello},
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    []Capability{CapProtocolErrors},
+	}
+	if err := bridgeWrite.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+	readMessage(t, bridgeRead, MsgHelloAck)
+
+	expect := func(streamID string, code ProtocolErrorCode) {
+		t.Helper()
+		var msg ProtocolErrorMsg
+		if err := json.Unmarshal(readMessage(t, bridgeRead, MsgProtocolError), &msg); err != nil {
+			t.Fatalf("unmarshal protocol_error: %v", err)
+		}
+		if msg.StreamID != streamID || msg.Code != code || msg.Description == "" {
+			t.Errorf("protocol_error = %+v, want code %s on stream %q", msg, code, streamID)
+		}
+		if streamID == "" {
+			return
+		}
+		var closeMsg StreamCloseMsg
+		if err := json.Unmarshal(readMessage(t, bridgeRead, MsgStreamClose), &closeMsg); err != nil {
+			t.Fatalf("unmarshal stream_close: %v", err)
+		}
+		if closeMsg.StreamID != streamID || closeMsg.Reason != "protocol_error" {
+			t.Errorf("stream_close = %+v, want reason protocol_error on stream %q", closeMsg, streamID)
+		}
+	}
+	write := func(v any) {
+		t.Helper()
+		if err := bridgeWrite.WriteJSON(v); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	write(map[string]any{"type": 5})
+	expect("", ProtocolErrMalformedEnvelope)
+
+	if err := bridgeWrite.WriteBinary([]byte("stray")); err != nil {
+		t.Fatalf("write binary: %v", err)
+	}
+	expect("", ProtocolErrUnexpectedBinary)
+
+	write(map[string]any{"type": MsgHTTPRequest, "stream_id": "bad-port", "port": "http"})
+	expect("bad-port", ProtocolErrMalformedMessage)
+
+	write(map[string]any{"type": "teleport", "stream_id": "unknown"})
+	expect("unknown", ProtocolErrUnknownType)
+
+	// A body announced but followed by another message instead, which is
+	// still dispatched.
+	write(HTTPRequestMsg{
+		Envelope:    Envelope{Type: MsgHTTPRequest, StreamID: "no-body"},
+		Method:      "POST",
+		Path:        "/",
+		BodyFollows: true,
+	})
+	write(map[string]any{"type": "teleport", "stream_id": "next"})
+	expect("no-body", ProtocolErrMissingPayload)
+	expect("next", ProtocolErrUnknownType)
+
+	if n := agent.ActiveStreams(); n != 0 {
+		t.Errorf("ActiveStreams() = %d after protocol errors, want 0", n)
+	}
+
+	cancel()
+}
+
+// TestAgentSkipsUnknownTypesWithoutProtocolErrors verifies a bridge that did
+// not enable protocol_errors is sent no protocol_error, and an unknown message
+// type does not close its stream.
+func TestAgentSkipsUnknownTypesWithoutProtocolErrors(t *testing.T) {
+	cfg := newTestAgentConfig([]int{3000})
+	agent, bridgeWrite, bridgeRead := newAgentTestPair(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = agent.Run(ctx)
+	}()
+	readMessage(t, bridgeRead, MsgReady)
+
+	for _, unwanted := range []MessageType{MsgProtocolError, MsgStreamClose} {
+		if err := bridgeWrite.WriteJSON(map[string]any{"type": "teleport", "stream_id": "s1"}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := bridgeWrite.WriteJSON(PingMsg{Envelope: Envelope{Type: MsgPing}, Seq: 1}); err != nil {
+			t.Fatalf("write ping: %v", err)
+		}
+		expectNoneBefore(t, bridgeRead, unwanted, MsgPong)
+	}
+
+	// A malformed message is still logged, but not reported.
+	if err := bridgeWrite.WriteJSON(map[string]any{"type": 5}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := bridgeWrite.WriteJSON(PingMsg{Envelope: Envelope{Type: MsgPing}, Seq: 2}); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	expectNoneBefore(t, bridgeRead, MsgProtocolError, MsgPong)
+
+	cancel()
+}
@@ -0,0 +1,166 @@
+package tunnel
+
+import (
+	"compress/gzip"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+// CompressionGzip marks a payload compressed as a gzip stream.
+const CompressionGzip = "gzip"
+
+// compressingWriter gzips the body_chunk and ws_data payloads of one stream
+// that are at least minSize bytes long. A chunk is sent as is when gzip does
+// not make it smaller, and a response body that is already compressed is
+// not touched at all.
+//
+// It wraps the stream's flow-controlled writer, so windows are charged the
+// compressed size.
+type compressingWriter struct {
+	ResponseWriter
+	minSize int
+	skip    bool // the response body is already compressed
+}
+
+// compressPayloads wraps w to compress the payloads it carries when the
+// bridge asked for compression.
+func (a *Agent) compressPayloads(w ResponseWriter) ResponseWriter {
+	if a.cfg.CompressThreshold < 0 || !a.features.Load().requested(CapCompressGzip) {
+		return w
+	}
+	return &compressingWriter{ResponseWriter: w, minSize: a.cfg.CompressThreshold}
+}
+
+// WriteJSON notes from an http_response whether the body that follows is
+// worth compressing.
+func (w *compressingWriter) WriteJSON(v any) error {
+	if resp, ok := v.(HTTPResponseMsg); ok {
+		w.skip = alreadyCompressed(headersFromMsg(resp.Headers, resp.MultiHeaders))
+	}
+	return w.ResponseWriter.WriteJSON(v)
+}
+
+// WriteJSONThenBinary writes the envelope and body, compressing the body
+// when that pays off.
+func (w *compressingWriter) WriteJSONThenBinary(envelope any, body []byte) error {
+	if w.skip || len(body) == 0 || len(body) < w.minSize {
+		return w.ResponseWriter.WriteJSONThenBinary(envelope, body)
+	}
+	switch msg := envelope.(type) {
+	case BodyChunkMsg:
+		compressed, ok := gzipPayload(body)
+		if !ok {
+			break
+		}
+		defer transport.PutBuffer(compressed)
+		msg.Data, msg.Compression = compressed, CompressionGzip
+		return w.ResponseWriter.WriteJSONThenBinary(msg, compressed)
+	case WSDataMsg:
+		compressed, ok := gzipPayload(body)
+		if !ok {
+			break
+		}
+		defer transport.PutBuffer(compressed)
+		msg.Compression = CompressionGzip
+		return w.ResponseWriter.WriteJSONThenBinary(msg, compressed)
+	}
+	return w.ResponseWriter.WriteJSONThenBinary(envelope, body)
+}
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		zw, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return zw
+	},
+}
+
+// errNotSmaller stops compression once the output is as long as the input.
+var errNotSmaller = errors.New("compressed payload is not smaller")
+
+// boundedBuffer collects output up to its capacity and fails beyond it.
+type boundedBuffer struct {
+	b []byte
+}
+
+func (w *boundedBuffer) Write(p []byte) (int, error) {
+	if len(w.b)+len(p) >= cap(w.b) {
+		return 0, errNotSmaller
+	}
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+// gzipPayload compresses body into a buffer from the transport pool, which
+// the caller returns with transport.PutBuffer. It reports false, having
+// given up early, when the result would not be smaller than body.
+func gzipPayload(body []byte) ([]byte, bool) {
+	out := &boundedBuffer{b: transport.GetBuffer(len(body))[:0]}
+	zw := gzipWriters.Get().(*gzip.Writer)
+	zw.Reset(out)
+	_, err := zw.Write(body)
+	if err == nil {
+		err = zw.Close()
+	}
+	zw.Reset(nil)
+	gzipWriters.Put(zw)
+	if err != nil {
+		transport.PutBuffer(out.b)
+		return nil, false
+	}
+	return out.b, true
+}
+
+// compressedTypes are media types whose content is already compressed.
+// Other image, audio and video types count as compressed as well, apart from
+// uncompressedImages.
+var compressedTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/vnd.rar":          true,
+	"application/x-rar-compressed": true,
+	"application/pdf":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// uncompressedImages are the image types that compress well.
+var uncompressedImages = map[string]bool{
+	"svg+xml":            true,
+	"bmp":                true,
+	"x-icon":             true,
+	"vnd.microsoft.icon": true,
+}
+
+// alreadyCompressed reports whether a response body described by h is
+// compressed already, by a content coding or by the nature of its media
+// type, so that gzipping it again would only cost time.
+func alreadyCompressed(h http.Header) bool {
+	if ce := strings.TrimSpace(h.Get("Content-Encoding")); ce != "" && !strings.EqualFold(ce, "identity") {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if compressedTypes[mediaType] {
+		return true
+	}
+	major, minor, _ := strings.Cut(mediaType, "/")
+	switch major {
+	case "image":
+		return !uncompressedImages[minor]
+	case "audio", "video":
+		return true
+	}
+	return false
+}
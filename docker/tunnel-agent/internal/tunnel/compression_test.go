@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAlreadyCompressed(t *testing.T) {
+	tests := []struct {
+		encoding, contentType string
+		want                  bool
+	}{
+		{"", "application/javascript; charset=utf-8", false},
+		{"", "text/html", false},
+		{"identity", "application/json", false},
+		{"gzip", "application/javascript", true},
+		{"br", "text/css", true},
+		{"", "image/png", true},
+		{"", "image/svg+xml", false},
+		{"", "video/mp4", true},
+		{"", "font/woff2", true},
+		{"", "application/zip", true},
+		{"", "Application/GZIP", true},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.encoding != "" {
+			h.Set("Content-Encoding", tt.encoding)
+		}
+		if tt.contentType != "" {
+			h.Set("Content-Type", tt.contentType)
+		}
+		if got := alreadyCompressed(h); got != tt.want {
+			t.Errorf("alreadyCompressed(%q, %q) = %v, want %v", tt.encoding, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+// capturingWriter records the envelopes and copies of the payloads written to it.
+type capturingWriter struct {
+	envelopes []any
+	bodies    [][]byte
+}
+
+func (c *capturingWriter) WriteJSON(v any) error {
+	c.envelopes = append(c.envelopes, v)
+	return nil
+}
+
+func (c *capturingWriter) WriteJSONThenBinary(envelope any, body []byte) error {
+	c.envelopes = append(c.envelopes, envelope)
+	c.bodies = append(c.bodies, bytes.Clone(body))
+	return nil
+}
+
+func gunzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("inflate: %v", err)
+	}
+	return out
+}
+
+func TestCompressingWriter(t *testing.T) {
+	script := []byte(strings.Repeat("console.log('hello, tunnel');\n", 200))
+	chunk := BodyChunkMsg{Envelope: Envelope{Type: MsgBodyChunk, StreamID: "s"}, Data: script}
+	response := func(contentType string) HTTPResponseMsg {
+		return HTTPResponseMsg{
+			Envelope: Envelope{Type: MsgHTTPResponse, StreamID: "s"},
+			Headers:  map[string]string{"Content-Type": contentType},
+		}
+	}
+
+	t.Run("compresses text", func(t *testing.T) {
+		inner := &capturingWriter{}
+		w := &compressingWriter{ResponseWriter: inner, minSize: 1024}
+		_ = w.WriteJSON(response("application/javascript"))
+		if err := w.WriteJSONThenBinary(chunk, script); err != nil {
+			t.Fatalf("WriteJSONThenBinary: %v", err)
+		}
+		got := inner.envelopes[1].(BodyChunkMsg)
+		if got.Compression != CompressionGzip {
+			t.Fatalf("compression = %q, want gzip", got.Compression)
+		}
+		if len(inner.bodies[0]) >= len(script) {
+			t.Errorf("compressed to %d bytes from %d", len(inner.bodies[0]), len(script))
+		}
+		if !bytes.Equal(gunzip(t, inner.bodies[0]), script) {
+			t.Error("inflated chunk differs from the original")
+		}
+	})
+
+	t.Run("skips compressed content", func(t *testing.T) {
+		inner := &capturingWriter{}
+		w := &compressingWriter{ResponseWriter: inner, minSize: 1024}
+		_ = w.WriteJSON(response("image/png"))
+		_ = w.WriteJSONThenBinary(chunk, script)
+		if got := inner.envelopes[1].(BodyChunkMsg); got.Compression != "" || !bytes.Equal(inner.bodies[0], script) {
+			t.Errorf("image chunk was compressed: %+v", got)
+		}
+	})
+
+	t.Run("skips small and incompressible payloads", func(t *testing.T) {
+		inner := &capturingWriter{}
+		w := &compressingWriter{ResponseWriter: inner, minSize: 1024}
+		ws := WSDataMsg{Envelope: Envelope{Type: MsgWSData, StreamID: "ws"}, BodyFollows: true}
+		_ = w.WriteJSONThenBinary(ws, []byte("short"))
+		noise := make([]byte, 4096)
+		rng := rand.New(rand.NewPCG(1, 2))
+		for i := range noise {
+			noise[i] = byte(rng.Uint32())
+		}
+		_ = w.WriteJSONThenBinary(ws, noise)
+		for i, env := range inner.envelopes {
+			if got := env.(WSDataMsg); got.Compression != "" {
+				t.Errorf("message %d was compressed", i)
+			}
+		}
+		if !bytes.Equal(inner.bodies[1], noise) {
+			t.Error("incompressible payload was altered")
+		}
+	})
+}
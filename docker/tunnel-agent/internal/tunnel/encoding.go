@@ -0,0 +1,240 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"docker-bridge-tunnel-agent/internal/msgpack"
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+// inboundMessage is a message read from the bridge. Its envelope is decoded
+// up front; the handler for its type decodes the rest with decode.
+type inboundMessage struct {
+	Envelope
+	frameType byte
+	raw       []byte // the encoded message
+	payload   []byte // FrameMsgpack only: the bytes after the envelope
+	// payloadTaken is set once a handler keeps payload, which shares the
+	// frame's buffer.
+	payloadTaken bool
+}
+
+// decodeInbound decodes the envelope of a TEXT or FrameMsgpack frame.
+func decodeInbound(frameType byte, data []byte) (*inboundMessage, error) {
+	m := &inboundMessage{frameType: frameType, raw: data}
+	if frameType == transport.FrameMsgpack {
+		rest, err := msgpack.UnmarshalPrefix(data, &m.Envelope)
+		if err != nil {
+			return nil, err
+		}
+		m.raw, m.payload = data[:len(data)-len(rest)], rest
+		return m, nil
+	}
+	if err := json.Unmarshal(data, &m.Envelope); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// decode decodes the whole message into v.
+func (m *inboundMessage) decode(v any) error {
+	if m.frameType == transport.FrameMsgpack {
+		return msgpack.Unmarshal(m.raw, v)
+	}
+	return json.Unmarshal(m.raw, v)
+}
+
+// readPayload returns the payload of a message that carries one: the rest of
+// a compact frame, or the BINARY frame that follows a JSON envelope. Any other
+// frame is the bridge's next message, so it is handed back to the read loop
+// for dispatch rather than dropped.
+func (a *Agent) readPayload(m *inboundMessage) ([]byte, error) {
+	if m.frameType == transport.FrameMsgpack {
+		m.payloadTaken = true
+		return m.payload, nil
+	}
+	frameType, data, err := a.transport.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if frameType != transport.FrameBinary {
+		a.unread = &unreadFrame{frameType: frameType, data: data}
+		return nil, fmt.Errorf("expected a binary frame, got type 0x%02x", frameType)
+	}
+	return data, nil
+}
+
+// unreadFrame is a frame read by readPayload that was not a payload.
+type unreadFrame struct {
+	frameType byte
+	data      []byte
+}
+
+// nextFrame returns the frame handed back by readPayload, if any, or else
+// reads one from the transport. Only the read loop calls it.
+func (a *Agent) nextFrame() (byte, []byte, error) {
+	if f := a.unread; f != nil {
+		a.unread = nil
+		return f.frameType, f.data, nil
+	}
+	return a.transport.ReadFrame()
+}
+
+// The messages sent for every chunk of stream data encode themselves, so the
+// transport frames them without reflection. The output is byte for byte what
+// json.Marshal or msgpack.Marshal produces.
+var (
+	_ transport.JSONAppender    = BodyChunkMsg{}
+	_ transport.JSONAppender    = WSDataMsg{}
+	_ transport.JSONAppender    = TCPDataMsg{}
+	_ transport.JSONAppender    = ExecDataMsg{}
+	_ transport.MsgpackAppender = BodyChunkMsg{}
+	_ transport.MsgpackAppender = WSDataMsg{}
+	_ transport.MsgpackAppender = TCPDataMsg{}
+	_ transport.MsgpackAppender = ExecDataMsg{}
+)
+
+// AppendJSON implements transport.JSONAppender.
+func (m BodyChunkMsg) AppendJSON(dst []byte) []byte {
+	dst = m.Envelope.appendJSONFields(append(dst, '{'))
+	if m.Compression != "" {
+		dst = append(dst, `,"compression":`...)
+		dst = appendJSONString(dst, m.Compression)
+	}
+	return append(dst, '}')
+}
+
+// AppendJSON implements transport.JSONAppender.
+func (m WSDataMsg) AppendJSON(dst []byte) []byte {
+	dst = m.Envelope.appendJSONFields(append(dst, '{'))
+	dst = append(dst, `,"body_follows":`...)
+	dst = strconv.AppendBool(dst, m.BodyFollows)
+	if m.Opcode != "" {
+		dst = append(dst, `,"opcode":`...)
+		dst = appendJSONString(dst, string(m.Opcode))
+	}
+	if m.Compression != "" {
+		dst = append(dst, `,"compression":`...)
+		dst = appendJSONString(dst, m.Compression)
+	}
+	return append(dst, '}')
+}
+
+// AppendJSON implements transport.JSONAppender.
+func (m TCPDataMsg) AppendJSON(dst []byte) []byte {
+	dst = m.Envelope.appendJSONFields(append(dst, '{'))
+	dst = append(dst, `,"body_follows":`...)
+	dst = strconv.AppendBool(dst, m.BodyFollows)
+	return append(dst, '}')
+}
+
+// AppendJSON implements transport.JSONAppender.
+func (m ExecDataMsg) AppendJSON(dst []byte) []byte {
+	dst = m.Envelope.appendJSONFields(append(dst, '{'))
+	dst = append(dst, `,"body_follows":`...)
+	dst = strconv.AppendBool(dst, m.BodyFollows)
+	if m.FD != 0 {
+		dst = append(dst, `,"fd":`...)
+		dst = strconv.AppendInt(dst, int64(m.FD), 10)
+	}
+	return append(dst, '}')
+}
+
+// appendJSONFields appends the envelope's fields without surrounding braces.
+func (e Envelope) appendJSONFields(dst []byte) []byte {
+	dst = append(dst, `"type":`...)
+	dst = appendJSONString(dst, string(e.Type))
+	if e.StreamID != "" {
+		dst = append(dst, `,"stream_id":`...)
+		dst = appendJSONString(dst, e.StreamID)
+	}
+	return dst
+}
+
+// appendJSONString appends s as a JSON string. Stream IDs and message types
+// are plain ASCII; anything json.Marshal would escape takes the slow path.
+func appendJSONString(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= 0x80 || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			b, _ := json.Marshal(s)
+			return append(dst, b...)
+		}
+	}
+	dst = append(dst, '"')
+	dst = append(dst, s...)
+	return append(dst, '"')
+}
+
+// AppendMsgpack implements transport.MsgpackAppender.
+func (m BodyChunkMsg) AppendMsgpack(dst []byte) []byte {
+	n := m.Envelope.msgpackFieldCount()
+	if m.Compression != "" {
+		n++
+	}
+	dst = m.Envelope.appendMsgpackFields(msgpack.AppendMapHeader(dst, n))
+	if m.Compression != "" {
+		dst = msgpack.AppendString(msgpack.AppendString(dst, "compression"), m.Compression)
+	}
+	return dst
+}
+
+// AppendMsgpack implements transport.MsgpackAppender.
+func (m WSDataMsg) AppendMsgpack(dst []byte) []byte {
+	n := m.Envelope.msgpackFieldCount() + 1
+	if m.Opcode != "" {
+		n++
+	}
+	if m.Compression != "" {
+		n++
+	}
+	dst = m.Envelope.appendMsgpackFields(msgpack.AppendMapHeader(dst, n))
+	dst = msgpack.AppendBool(msgpack.AppendString(dst, "body_follows"), m.BodyFollows)
+	if m.Opcode != "" {
+		dst = msgpack.AppendString(msgpack.AppendString(dst, "opcode"), string(m.Opcode))
+	}
+	if m.Compression != "" {
+		dst = msgpack.AppendString(msgpack.AppendString(dst, "compression"), m.Compression)
+	}
+	return dst
+}
+
+// AppendMsgpack implements transport.MsgpackAppender.
+func (m TCPDataMsg) AppendMsgpack(dst []byte) []byte {
+	dst = msgpack.AppendMapHeader(dst, m.Envelope.msgpackFieldCount()+1)
+	dst = m.Envelope.appendMsgpackFields(dst)
+	return msgpack.AppendBool(msgpack.AppendString(dst, "body_follows"), m.BodyFollows)
+}
+
+// AppendMsgpack implements transport.MsgpackAppender.
+func (m ExecDataMsg) AppendMsgpack(dst []byte) []byte {
+	n := m.Envelope.msgpackFieldCount() + 1
+	if m.FD != 0 {
+		n++
+	}
+	dst = m.Envelope.appendMsgpackFields(msgpack.AppendMapHeader(dst, n))
+	dst = msgpack.AppendBool(msgpack.AppendString(dst, "body_follows"), m.BodyFollows)
+	if m.FD != 0 {
+		dst = msgpack.AppendInt(msgpack.AppendString(dst, "fd"), int64(m.FD))
+	}
+	return dst
+}
+
+// msgpackFieldCount returns how many map entries appendMsgpackFields writes.
+func (e Envelope) msgpackFieldCount() int {
+	if e.StreamID != "" {
+		return 2
+	}
+	return 1
+}
+
+// appendMsgpackFields appends the envelope's fields as map entries.
+func (e Envelope) appendMsgpackFields(dst []byte) []byte {
+	dst = msgpack.AppendString(msgpack.AppendString(dst, "type"), string(e.Type))
+	if e.StreamID != "" {
+		dst = msgpack.AppendString(msgpack.AppendString(dst, "stream_id"), e.StreamID)
+	}
+	return dst
+}
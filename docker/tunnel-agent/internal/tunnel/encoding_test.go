@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"docker-bridge-tunnel-agent/internal/msgpack"
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+// TestAppendMatchesMarshal verifies the hand-written encoders produce exactly
+// what encoding/json and msgpack.Marshal do.
+func TestAppendMatchesMarshal(t *testing.T) {
+	ids := []string{"", "stream-1", `quote"back\slash`, "<html>&", "ctl\x01\n", "ünïcode", "bad\xffutf8"}
+	for _, id := range ids {
+		env := func(typ MessageType) Envelope { return Envelope{Type: typ, StreamID: id} }
+		for _, msg := range []interface {
+			transport.JSONAppender
+			transport.MsgpackAppender
+		}{
+			BodyChunkMsg{Envelope: env(MsgBodyChunk), Data: []byte("ignored")},
+			BodyChunkMsg{Envelope: env(MsgBodyChunk), Compression: CompressionGzip},
+			WSDataMsg{Envelope: env(MsgWSData), BodyFollows: true, Opcode: WSOpcodeText},
+			WSDataMsg{Envelope: env(MsgWSData), BodyFollows: true, Compression: CompressionGzip},
+			WSDataMsg{Envelope: env(MsgWSData)},
+			TCPDataMsg{Envelope: env(MsgTCPData), BodyFollows: true},
+			ExecDataMsg{Envelope: env(MsgExecData), BodyFollows: true, FD: 2},
+			ExecDataMsg{Envelope: env(MsgExecData), BodyFollows: true},
+		} {
+			want, err := json.Marshal(msg)
+			if err != nil {
+				t.Fatalf("Marshal(%#v): %v", msg, err)
+			}
+			if got := msg.AppendJSON(nil); string(got) != string(want) {
+				t.Errorf("AppendJSON(%#v) = %s, want %s", msg, got, want)
+			}
+			if want, err = msgpack.Marshal(msg); err != nil {
+				t.Fatalf("msgpack.Marshal(%#v): %v", msg, err)
+			}
+			if got := msg.AppendMsgpack(nil); !bytes.Equal(got, want) {
+				t.Errorf("AppendMsgpack(%#v) = % x, want % x", msg, got, want)
+			}
+		}
+	}
+}
+
+func TestDecodeInboundMsgpack(t *testing.T) {
+	msg := WSDataMsg{Envelope: Envelope{Type: MsgWSData, StreamID: "ws-1"}, BodyFollows: true, Opcode: WSOpcodeText}
+	data := append(msg.AppendMsgpack(nil), "hello"...)
+
+	m, err := decodeInbound(transport.FrameMsgpack, data)
+	if err != nil {
+		t.Fatalf("decodeInbound: %v", err)
+	}
+	if m.Type != MsgWSData || m.StreamID != "ws-1" || string(m.payload) != "hello" {
+		t.Errorf("decoded %+v with payload %q", m.Envelope, m.payload)
+	}
+	var got WSDataMsg
+	if err := m.decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got != msg {
+		t.Errorf("decode = %+v, want %+v", got, msg)
+	}
+}
@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errorPageRefreshSeconds is how often the unreachable-port page reloads.
+const errorPageRefreshSeconds = 2
+
+//go:embed templates/port_unreachable.html
+var defaultErrorPageSource string
+
+var defaultErrorPage = template.Must(template.New("port_unreachable").Parse(defaultErrorPageSource))
+
+// errorPageData is the data an error page template is executed with.
+type errorPageData struct {
+	Port           int
+	Method         string
+	Path           string
+	RefreshSeconds int
+}
+
+// LoadErrorPage parses the HTML template served to browsers when a port is
+// unreachable. An empty path selects the built-in page. The template is
+// executed with .Port, .Method, .Path and .RefreshSeconds.
+func LoadErrorPage(path string) (*template.Template, error) {
+	if path == "" {
+		return defaultErrorPage, nil
+	}
+	page, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("error page template: %w", err)
+	}
+	// Execute once so mistakes such as unknown fields fail at startup
+	// instead of on the first unreachable request.
+	if err := page.Execute(new(bytes.Buffer), errorPageData{Port: 3000, Path: "/"}); err != nil {
+		return nil, fmt.Errorf("error page template: %w", err)
+	}
+	return page, nil
+}
+
+// acceptsHTML reports whether the Accept header asks for an HTML document, as
+// browsers navigating to a page do. API clients sending "*/*" or no Accept
+// header do not match.
+func acceptsHTML(h http.Header) bool {
+	for _, value := range h.Values("Accept") {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
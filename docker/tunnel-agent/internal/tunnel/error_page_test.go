@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsHTML(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", true},
+		{"application/xhtml+xml", true},
+		{"TEXT/HTML", true},
+		{"*/*", false},
+		{"application/json", false},
+		{"", false},
+		{"text/html;q=0, application/json", false},
+	}
+	for _, tc := range tests {
+		h := http.Header{}
+		if tc.accept != "" {
+			h.Set("Accept", tc.accept)
+		}
+		if got := acceptsHTML(h); got != tc.want {
+			t.Errorf("acceptsHTML(%q) = %v, want %v", tc.accept, got, tc.want)
+		}
+	}
+}
+
+// TestHTTPProxy502HTMLForBrowsers verifies a browser navigation gets an HTML
+// page naming the port that reloads itself, while API clients keep the JSON.
+func TestHTTPProxy502HTMLForBrowsers(t *testing.T) {
+	proxy := NewHTTPProxy(newTestProxyConfig(3000, 1048576))
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		bodyHas     []string
+	}{
+		{
+			name:        "browser",
+			accept:      "text/html,application/xhtml+xml,*/*;q=0.8",
+			contentType: "text/html; charset=utf-8",
+			bodyHas:     []string{"port 3000", `<meta http-equiv="refresh" content="2">`, "/dashboard?tab=1"},
+		},
+		{
+			name:        "api client",
+			accept:      "*/*",
+			contentType: "application/json",
+			bodyHas:     []string{`"error":"port_unreachable"`, `"port":3000`},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := HTTPRequestMsg{
+				Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "err-page"},
+				Method:   "GET",
+				Path:     "/dashboard?tab=1",
+				Headers:  map[string]string{"accept": tc.accept},
+			}
+			responses := proxy.build502Response(msg, 3000)
+			resp := responses[0].(HTTPResponseMsg)
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d, want 502", resp.StatusCode)
+			}
+			if got := resp.Headers["content-type"]; got != tc.contentType {
+				t.Errorf("content-type = %q, want %q", got, tc.contentType)
+			}
+			body := string(responses[1].(BodyChunkMsg).Data)
+			if resp.BodyLen != int64(len(body)) {
+				t.Errorf("BodyLen = %d, body is %d bytes", resp.BodyLen, len(body))
+			}
+			for _, want := range tc.bodyHas {
+				if !strings.Contains(body, want) {
+					t.Errorf("body missing %q:\n%s", want, body)
+				}
+			}
+		})
+	}
+}
+
+// TestHTTPProxy502CustomErrorPage verifies a configured template replaces the
+// built-in page.
+func TestHTTPProxy502CustomErrorPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "down.html")
+	if err := os.WriteFile(path, []byte(`<p>{{.Method}} {{.Path}}: port {{.Port}} is down</p>`), 0o644); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	page, err := LoadErrorPage(path)
+	if err != nil {
+		t.Fatalf("LoadErrorPage: %v", err)
+	}
+	cfg := newTestProxyConfig(3000, 1048576)
+	cfg.ErrorPage = page
+	proxy := NewHTTPProxy(cfg)
+
+	msg := HTTPRequestMsg{
+		Envelope:     Envelope{Type: MsgHTTPRequest, StreamID: "err-custom"},
+		Method:       "GET",
+		Path:         "/<script>",
+		Headers:      map[string]string{},
+		MultiHeaders: map[string][]string{"accept": {"text/html"}},
+	}
+	responses := proxy.build502Response(msg, 3000)
+	body := string(responses[1].(BodyChunkMsg).Data)
+	if want := "<p>GET /&lt;script&gt;: port 3000 is down</p>"; body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+	resp := responses[0].(HTTPResponseMsg)
+	if got := resp.MultiHeaders["content-type"]; len(got) != 1 || got[0] != "text/html; charset=utf-8" {
+		t.Errorf("multi_headers content-type = %v", got)
+	}
+}
+
+func TestLoadErrorPage(t *testing.T) {
+	if page, err := LoadErrorPage(""); err != nil || page != defaultErrorPage {
+		t.Errorf("LoadErrorPage(\"\") = %v, %v; want the built-in page", page, err)
+	}
+	if _, err := LoadErrorPage(filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Error("expected an error for a missing template")
+	}
+	bad := filepath.Join(t.TempDir(), "bad.html")
+	if err := os.WriteFile(bad, []byte(`{{.Hostname}}`), 0o644); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	if _, err := LoadErrorPage(bad); err == nil {
+		t.Error("expected an error for a template using an unknown field")
+	}
+}
@@ -0,0 +1,363 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/pty"
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+const (
+	// execReadBufferSize is the largest exec_data payload read from a terminal at once.
+	execReadBufferSize = 32 * 1024
+	// execKillDelay is how long a hung-up command has to exit before it is
+	// killed, and how long its output may stay open after it exits.
+	execKillDelay = 2 * time.Second
+	// execDrainTimeout bounds reading a terminal after its command exits, in
+	// case a background process keeps the terminal open.
+	execDrainTimeout = time.Second
+)
+
+// ExecProxy runs the commands the bridge starts with exec_start.
+type ExecProxy struct {
+	cfg *config.Config
+}
+
+// NewExecProxy creates an ExecProxy that runs the commands allowed by cfg.
+func NewExecProxy(cfg *config.Config) *ExecProxy {
+	return &ExecProxy{cfg: cfg}
+}
+
+// execSession is the agent's handle on a running exec stream: the queue
+// carrying its stdin and, for a TTY, the terminal resized by exec_resize.
+type execSession struct {
+	stdin *inboundQueue
+
+	mu         sync.Mutex
+	tty        *os.File // the pty master while the command runs
+	cols, rows int
+}
+
+func newExecSession(stdin *inboundQueue, cols, rows int) *execSession {
+	return &execSession{stdin: stdin, cols: cols, rows: rows}
+}
+
+// resize sets the terminal size, at once or when the terminal is attached.
+func (s *execSession) resize(cols, rows int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cols, s.rows = cols, rows
+	if s.tty == nil {
+		return nil
+	}
+	return pty.Setsize(s.tty, cols, rows)
+}
+
+// attach makes tty the terminal that resize acts on, applying the size
+// requested so far. A nil tty detaches it.
+func (s *execSession) attach(tty *os.File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tty = tty
+	if tty == nil || s.cols <= 0 || s.rows <= 0 {
+		return nil
+	}
+	return pty.Setsize(tty, s.cols, s.rows)
+}
+
+// Handle runs the command described by msg.
+//
+// It checks the program against the exec allow-list, starts the command on a
+// pseudo-terminal when msg.TTY is set and on pipes otherwise, and sends an
+// ExecStartAckMsg. Then:
+//
+//   - bridge->command: stdin payloads arrive via the session's queue; when the
+//     bridge half-closes, the command's stdin is closed (on a TTY, an
+//     end-of-file character is typed instead)
+//   - command->bridge: output is sent as ExecDataMsg + binary body, on fd 1
+//     and 2, or only fd 1 for a TTY
+//
+// When the command exits and its output is drained, a StreamCloseMsg
+// reports the exit status. Cancelling the stream hangs the command up with
+// SIGHUP and kills it if it is still running execKillDelay later.
+func (p *ExecProxy) Handle(
+	ctx context.Context,
+	msg ExecStartMsg,
+	session *execSession,
+	tr ResponseWriter,
+	registry *StreamRegistry,
+) {
+	if len(msg.Command) == 0 || !p.cfg.AllowsCommand(msg.Command[0]) {
+		err := config.ErrCommandNotAllowed
+		if len(msg.Command) > 0 {
+			err = fmt.Errorf("%w: %s", err, msg.Command[0])
+		}
+		slog.Warn("exec: rejected command", "stream_id", msg.StreamID, "error", err)
+		writeExecFailure(tr, msg.StreamID, err, "command_not_allowed")
+		return
+	}
+
+	for _, entry := range msg.Env {
+		if !config.AllowsExecEnv(entry) {
+			name, _, _ := strings.Cut(entry, "=")
+			err := fmt.Errorf("%w: %q", config.ErrEnvNotAllowed, name)
+			slog.Warn("exec: rejected environment", "stream_id", msg.StreamID, "error", err)
+			writeExecFailure(tr, msg.StreamID, err, "env_not_allowed")
+			return
+		}
+	}
+	dir, err := p.workDir(msg.Dir)
+	if err != nil {
+		reason := "exec_failed"
+		if errors.Is(err, config.ErrPathNotAllowed) {
+			reason = "path_not_allowed"
+		}
+		slog.Warn("exec: rejected working directory", "stream_id", msg.StreamID, "error", err)
+		writeExecFailure(tr, msg.StreamID, err, reason)
+		return
+	}
+
+	// Register stream for cancellation support before the command starts,
+	// so that a bridge closing the stream meanwhile also ends the command.
+	proxyCtx, cancel := context.WithCancel(ctx)
+	stream := NewStream(msg.StreamID, cancel)
+	registry.Register(msg.StreamID, stream)
+	defer func() {
+		cancel()
+		registry.Remove(msg.StreamID)
+	}()
+	tr = bindWriter(tr, proxyCtx)
+
+	cmd := exec.CommandContext(proxyCtx, msg.Command[0], msg.Command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	if msg.TTY {
+		// The bridge's env may name another terminal type.
+		cmd.Env = append(cmd.Env, "TERM=xterm-256color")
+	}
+	cmd.Env = append(cmd.Env, msg.Env...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGHUP) }
+	cmd.WaitDelay = execKillDelay
+
+	// Output written by the command before the ack is sent waits for it.
+	acked := make(chan struct{})
+	var stdin io.WriteCloser
+	var master *os.File
+	if msg.TTY {
+		var tty *os.File
+		var err error
+		master, tty, err = pty.Open()
+		if err != nil {
+			slog.Warn("exec: failed to open pty", "stream_id", msg.StreamID, "error", err)
+			writeExecFailure(tr, msg.StreamID, err, "exec_failed")
+			return
+		}
+		defer master.Close()
+		defer session.attach(nil)
+		if err := session.attach(master); err != nil {
+			slog.Debug("exec: failed to size pty", "stream_id", msg.StreamID, "error", err)
+		}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+		cmd.SysProcAttr = pty.SysProcAttr()
+		stdin = ttyInput{master}
+		err = cmd.Start()
+		tty.Close()
+		if err != nil {
+			slog.Warn("exec: failed to start command", "stream_id", msg.StreamID, "error", err)
+			writeExecFailure(tr, msg.StreamID, err, "exec_failed")
+			return
+		}
+	} else {
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			writeExecFailure(tr, msg.StreamID, err, "exec_failed")
+			return
+		}
+		cmd.Stdout = &execOutput{tr: tr, streamID: msg.StreamID, fd: 1, acked: acked}
+		cmd.Stderr = &execOutput{tr: tr, streamID: msg.StreamID, fd: 2, acked: acked}
+		if err := cmd.Start(); err != nil {
+			slog.Warn("exec: failed to start command", "stream_id", msg.StreamID, "error", err)
+			writeExecFailure(tr, msg.StreamID, err, "exec_failed")
+			return
+		}
+	}
+
+	activeStreams.WithLabelValues(protoExec).Inc()
+	defer activeStreams.WithLabelValues(protoExec).Dec()
+
+	slog.Debug("exec: command started",
+		"stream_id", msg.StreamID,
+		"command", msg.Command[0],
+		"pid", cmd.Process.Pid,
+		"tty", msg.TTY,
+	)
+	ack := ExecStartAckMsg{
+		Envelope: Envelope{Type: MsgExecStartAck, StreamID: msg.StreamID},
+		Success:  true,
+	}
+	if err := tr.WriteJSON(ack); err != nil {
+		slog.Warn("exec: failed to send ack", "stream_id", msg.StreamID, "error", err)
+		cancel()
+	}
+	close(acked)
+
+	// bridge -> command. The goroutine ends with the stream's context or
+	// input, and however it ends the command sees end of input.
+	go func() {
+		defer stdin.Close()
+		for {
+			frame, err := session.stdin.pop(proxyCtx)
+			if err != nil {
+				return
+			}
+			if _, err := stdin.Write(frame.data); err != nil {
+				return
+			}
+			transport.PutBuffer(frame.data)
+		}
+	}()
+
+	// command -> bridge, for a TTY. Pipes are copied by cmd itself.
+	outputDone := make(chan struct{})
+	if master != nil {
+		go func() {
+			defer close(outputDone)
+			out := &execOutput{tr: tr, streamID: msg.StreamID, fd: 1, acked: acked}
+			buf := transport.GetBuffer(execReadBufferSize)
+			defer transport.PutBuffer(buf)
+			for {
+				// Reads fail with EIO once no process has the terminal open.
+				n, err := master.Read(buf)
+				if n > 0 {
+					if _, werr := out.Write(buf[:n]); werr != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	} else {
+		close(outputDone)
+	}
+
+	waitErr := cmd.Wait()
+	if master != nil {
+		_ = master.SetReadDeadline(time.Now().Add(execDrainTimeout))
+	}
+	<-outputDone
+
+	closeMsg := StreamCloseMsg{
+		Envelope: Envelope{Type: MsgStreamClose, StreamID: msg.StreamID},
+		Reason:   "exited",
+	}
+	if proxyCtx.Err() != nil {
+		closeMsg.Reason = "stream_ended"
+	}
+	setExitStatus(&closeMsg, cmd.ProcessState)
+	slog.Debug("exec: command ended",
+		"stream_id", msg.StreamID,
+		"reason", closeMsg.Reason,
+		"error", waitErr,
+	)
+	_ = tr.WriteJSON(closeMsg)
+}
+
+// execOutput sends what a command writes to one of its output streams as
+// exec_data messages, once the exec_start_ack has gone out.
+type execOutput struct {
+	tr       ResponseWriter
+	streamID string
+	fd       int
+	acked    <-chan struct{}
+}
+
+func (o *execOutput) Write(p []byte) (int, error) {
+	<-o.acked
+	dataMsg := ExecDataMsg{
+		Envelope:    Envelope{Type: MsgExecData, StreamID: o.streamID},
+		BodyFollows: true,
+		FD:          o.fd,
+	}
+	if err := o.tr.WriteJSONThenBinary(dataMsg, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ttyInput is the input side of a pseudo-terminal. Closing it types an
+// end-of-file character (Ctrl-D) rather than closing the terminal, which
+// would hang up the command.
+type ttyInput struct {
+	master *os.File
+}
+
+func (t ttyInput) Write(p []byte) (int, error) {
+	return t.master.Write(p)
+}
+
+func (t ttyInput) Close() error {
+	_, err := t.master.Write([]byte{0x04})
+	return err
+}
+
+// setExitStatus records in msg how the command that left state ended.
+func setExitStatus(msg *StreamCloseMsg, state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		msg.ExitSignal = int(ws.Signal())
+		return
+	}
+	code := state.ExitCode()
+	msg.ExitCode = &code
+}
+
+// workDir resolves dir, the working directory asked for by the bridge, which
+// must lie within the file roots. An empty dir keeps the agent's own.
+func (p *ExecProxy) workDir(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("%w: %q is not absolute", config.ErrPathNotAllowed, dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	if !p.cfg.AllowsFilePath(resolved) {
+		return "", fmt.Errorf("%w: %s", config.ErrPathNotAllowed, dir)
+	}
+	return resolved, nil
+}
+
+// writeExecFailure sends a failed ExecStartAckMsg followed by a
+// StreamCloseMsg carrying reason.
+func writeExecFailure(tr ResponseWriter, streamID string, cause error, reason string) {
+	ack := ExecStartAckMsg{
+		Envelope: Envelope{Type: MsgExecStartAck, StreamID: streamID},
+		Success:  false,
+		Error:    cause.Error(),
+	}
+	_ = tr.WriteJSON(ack)
+	closeMsg := StreamCloseMsg{
+		Envelope: Envelope{Type: MsgStreamClose, StreamID: streamID},
+		Reason:   reason,
+	}
+	_ = tr.WriteJSON(closeMsg)
+}
@@ -0,0 +1,285 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+// execTestResult collects what an exec stream sent to the bridge.
+type execTestResult struct {
+	ack    ExecStartAckMsg
+	output map[int]string
+	close  StreamCloseMsg
+}
+
+// readExecStream reads messages from the agent until the final stream_close.
+func readExecStream(t *testing.T, bridgeR *transport.StdioTransport) execTestResult {
+	t.Helper()
+	res := execTestResult{output: make(map[int]string)}
+	for {
+		_, raw, err := bridgeR.ReadFrame()
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		var env Envelope
+		if err := json.Unmarshal(raw, &env); err != nil {
+			t.Fatalf("unmarshal envelope: %v", err)
+		}
+		switch env.Type {
+		case MsgExecStartAck:
+			if err := json.Unmarshal(raw, &res.ack); err != nil {
+				t.Fatalf("unmarshal ack: %v", err)
+			}
+		case MsgExecData:
+			var msg ExecDataMsg
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				t.Fatalf("unmarshal exec_data: %v", err)
+			}
+			_, body, err := bridgeR.ReadFrame()
+			if err != nil {
+				t.Fatalf("read exec_data body: %v", err)
+			}
+			res.output[msg.FD] += string(body)
+		case MsgStreamClose:
+			if err := json.Unmarshal(raw, &res.close); err != nil {
+				t.Fatalf("unmarshal stream_close: %v", err)
+			}
+			if !res.close.HalfClose {
+				return res
+			}
+		default:
+			t.Fatalf("unexpected message %q", env.Type)
+		}
+	}
+}
+
+func newTestExecProxy(allow ...string) *ExecProxy {
+	return NewExecProxy(&config.Config{ExecAllow: allow})
+}
+
+// TestExecProxyPipes verifies stdin reaches the command, stdout and stderr
+// come back apart, and the exit code is reported.
+func TestExecProxyPipes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := ExecStartMsg{
+		Envelope: Envelope{Type: MsgExecStart, StreamID: "s-exec"},
+		Command:  []string{"sh", "-c", `read line; echo "out:$line:$GREETING"; echo err >&2; exit 3`},
+		Env:      []string{"GREETING=hello"},
+	}
+	session := newExecSession(newInboundQueue(1048576, false, nil), 0, 0)
+	_ = session.stdin.push(inboundFrame{data: []byte("hi\n")})
+	session.stdin.close()
+	registry := &StreamRegistry{}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestExecProxy("sh").Handle(ctx, msg, session, tp.agentTr, registry)
+	}()
+
+	res := readExecStream(t, tp.bridgeR)
+	if !res.ack.Success {
+		t.Fatalf("expected Success=true, got error=%q", res.ack.Error)
+	}
+	if res.output[1] != "out:hi:hello\n" || res.output[2] != "err\n" {
+		t.Errorf("stdout %q, stderr %q", res.output[1], res.output[2])
+	}
+	if res.close.Reason != "exited" || res.close.ExitCode == nil || *res.close.ExitCode != 3 {
+		t.Errorf("stream_close = %+v, want reason exited with exit code 3", res.close)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() did not exit after the command ended")
+	}
+	if registry.Count() != 0 {
+		t.Errorf("expected registry to be empty, got %d streams", registry.Count())
+	}
+}
+
+// TestExecProxyTTY verifies a TTY command runs on a terminal of the
+// requested size.
+func TestExecProxyTTY(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := ExecStartMsg{
+		Envelope: Envelope{Type: MsgExecStart, StreamID: "s-tty"},
+		Command:  []string{"sh", "-c", "test -t 1 && stty size && echo $TERM"},
+		TTY:      true,
+		Cols:     120,
+		Rows:     30,
+	}
+	session := newExecSession(newInboundQueue(1048576, false, nil), msg.Cols, msg.Rows)
+	go newTestExecProxy("sh").Handle(ctx, msg, session, tp.agentTr, &StreamRegistry{})
+
+	res := readExecStream(t, tp.bridgeR)
+	if !res.ack.Success {
+		t.Fatalf("expected Success=true, got error=%q", res.ack.Error)
+	}
+	// The terminal translates newlines to CRLF.
+	if got := strings.ReplaceAll(res.output[1], "\r\n", "\n"); got != "30 120\nxterm-256color\n" {
+		t.Errorf("output = %q", res.output[1])
+	}
+	if len(res.output) != 1 {
+		t.Errorf("a TTY command sent output on fds %v, want only 1", res.output)
+	}
+	if res.close.ExitCode == nil || *res.close.ExitCode != 0 {
+		t.Errorf("stream_close = %+v, want exit code 0", res.close)
+	}
+}
+
+// TestExecProxyCancel verifies cancelling the stream hangs up the command
+// and reports the signal that ended it.
+func TestExecProxyCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := ExecStartMsg{
+		Envelope: Envelope{Type: MsgExecStart, StreamID: "s-exec-cancel"},
+		Command:  []string{"sleep", "30"},
+	}
+	registry := &StreamRegistry{}
+	session := newExecSession(newInboundQueue(1048576, false, nil), 0, 0)
+	go newTestExecProxy("sleep").Handle(ctx, msg, session, tp.agentTr, registry)
+
+	var ack ExecStartAckMsg
+	_, raw, err := tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+	if err := json.Unmarshal(raw, &ack); err != nil || !ack.Success {
+		t.Fatalf("ack = %+v, %v", ack, err)
+	}
+	stream, ok := registry.Get("s-exec-cancel")
+	if !ok {
+		t.Fatal("stream was not registered")
+	}
+	stream.Cancel()
+
+	res := readExecStream(t, tp.bridgeR)
+	if res.close.Reason != "stream_ended" || res.close.ExitSignal != int(syscall.SIGHUP) {
+		t.Errorf("stream_close = %+v, want stream_ended by SIGHUP", res.close)
+	}
+}
+
+// TestExecProxyAbortedInputEndsStdin verifies the command sees end of input
+// when its stream input is aborted, as a stream_close from the bridge does,
+// and not only when the bridge half-closes it.
+func TestExecProxyAbortedInputEndsStdin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := ExecStartMsg{
+		Envelope: Envelope{Type: MsgExecStart, StreamID: "s-exec-abort"},
+		Command:  []string{"cat"},
+	}
+	session := newExecSession(newInboundQueue(1048576, false, nil), 0, 0)
+	session.stdin.abort(errInboundClosed)
+	go newTestExecProxy("cat").Handle(ctx, msg, session, tp.agentTr, &StreamRegistry{})
+
+	res := readExecStream(t, tp.bridgeR)
+	if res.close.Reason != "exited" || res.close.ExitCode == nil || *res.close.ExitCode != 0 {
+		t.Errorf("stream_close = %+v, want cat to exit at end of input", res.close)
+	}
+}
+
+// TestExecProxyRejectsCommand verifies Handle() refuses a program outside
+// the allow-list with a failed ack and a command_not_allowed stream_close.
+func TestExecProxyRejectsCommand(t *testing.T) {
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := ExecStartMsg{
+		Envelope: Envelope{Type: MsgExecStart, StreamID: "s-exec-denied"},
+		Command:  []string{"rm", "-rf", "/"},
+	}
+	session := newExecSession(newInboundQueue(1048576, false, nil), 0, 0)
+	go newTestExecProxy("sh").Handle(context.Background(), msg, session, tp.agentTr, &StreamRegistry{})
+
+	res := readExecStream(t, tp.bridgeR)
+	if res.ack.Success || !strings.Contains(res.ack.Error, "command not allowed") {
+		t.Errorf("ack = %+v, want a command not allowed failure", res.ack)
+	}
+	if res.close.Reason != "command_not_allowed" {
+		t.Errorf("stream_close reason = %q, want command_not_allowed", res.close.Reason)
+	}
+}
+
+// TestExecProxyRejectsEnvAndDir verifies Handle() refuses loader and shell
+// startup variables and a working directory outside the file roots.
+func TestExecProxyRejectsEnvAndDir(t *testing.T) {
+	root := t.TempDir()
+	proxy := NewExecProxy(&config.Config{ExecAllow: []string{"sh"}, FileRoots: []string{root}})
+	tests := []struct {
+		name   string
+		env    []string
+		dir    string
+		reason string
+	}{
+		{name: "preload", env: []string{"LD_PRELOAD=/tmp/evil.so"}, reason: "env_not_allowed"},
+		{name: "bash startup", env: []string{"BASH_ENV=/tmp/evil.sh"}, reason: "env_not_allowed"},
+		{name: "path", env: []string{"PATH=/tmp"}, reason: "env_not_allowed"},
+		{name: "dir outside roots", dir: os.TempDir(), reason: "path_not_allowed"},
+		{name: "relative dir", dir: "tmp", reason: "path_not_allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestTransportPair()
+			defer tp.close()
+			msg := ExecStartMsg{
+				Envelope: Envelope{Type: MsgExecStart, StreamID: "s-exec-env"},
+				Command:  []string{"sh", "-c", "true"},
+				Env:      tt.env,
+				Dir:      tt.dir,
+			}
+			session := newExecSession(newInboundQueue(1048576, false, nil), 0, 0)
+			go proxy.Handle(context.Background(), msg, session, tp.agentTr, &StreamRegistry{})
+
+			res := readExecStream(t, tp.bridgeR)
+			if res.ack.Success {
+				t.Errorf("ack = %+v, want a failure", res.ack)
+			}
+			if res.close.Reason != tt.reason {
+				t.Errorf("stream_close reason = %q, want %s", res.close.Reason, tt.reason)
+			}
+		})
+	}
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := ExecStartMsg{
+		Envelope: Envelope{Type: MsgExecStart, StreamID: "s-exec-dir"},
+		Command:  []string{"sh", "-c", "pwd"},
+		Dir:      root,
+	}
+	session := newExecSession(newInboundQueue(1048576, false, nil), 0, 0)
+	go proxy.Handle(context.Background(), msg, session, tp.agentTr, &StreamRegistry{})
+	res := readExecStream(t, tp.bridgeR)
+	want, _ := filepath.EvalSymlinks(root)
+	if got := strings.TrimSpace(res.output[1]); got != want {
+		t.Errorf("pwd = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,348 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+const (
+	// defaultFileMode is the permissions of a written file when the bridge
+	// sets none.
+	defaultFileMode = 0o644
+	// maxFileListEntries bounds a file_list result, which travels in a
+	// single frame.
+	maxFileListEntries = 10000
+)
+
+// FileProxy serves the bridge's file_read, file_write and file_list requests
+// inside the configured file roots.
+type FileProxy struct {
+	cfg          *config.Config
+	maxChunkSize int64
+}
+
+// NewFileProxy creates a FileProxy for the file roots in cfg.
+func NewFileProxy(cfg *config.Config) *FileProxy {
+	maxChunkSize := cfg.MaxBodyChunkSize
+	if maxChunkSize <= 0 {
+		maxChunkSize = defaultMaxChunkSize
+	}
+	return &FileProxy{cfg: cfg, maxChunkSize: maxChunkSize}
+}
+
+// Handle serves msg and writes its FileResultMsg, and for a file_read the
+// file's content, to tr. body carries the content of a file_write and is nil
+// for other requests. A request that fails is answered with a failed result,
+// or with just a stream_close when the result has already been sent.
+func (p *FileProxy) Handle(ctx context.Context, msg FileRequestMsg, body *requestBody, tr ResponseWriter) {
+	var sent bool
+	var err error
+	switch msg.Type {
+	case MsgFileRead:
+		sent, err = p.read(ctx, msg, tr)
+	case MsgFileWrite:
+		sent, err = p.write(ctx, msg, body, tr)
+	case MsgFileList:
+		sent, err = p.list(msg, tr)
+	default:
+		err = fmt.Errorf("unknown file request %q", msg.Type)
+	}
+	if err == nil {
+		return
+	}
+
+	slog.Warn("file request failed",
+		"stream_id", msg.StreamID,
+		"type", msg.Type,
+		"path", msg.Path,
+		"error", err,
+	)
+	reason := "file_error"
+	if errors.Is(err, config.ErrPathNotAllowed) {
+		reason = "path_not_allowed"
+	}
+	if sent {
+		closeMsg := StreamCloseMsg{
+			Envelope: Envelope{Type: MsgStreamClose, StreamID: msg.StreamID},
+			Reason:   reason,
+		}
+		_ = tr.WriteJSON(closeMsg)
+		return
+	}
+	writeFileFailure(tr, msg.StreamID, err, reason)
+}
+
+// resolve maps path, an absolute path from the bridge, to the file it names,
+// which must lie inside a file root. Symlinks are resolved before the check,
+// so neither ".." nor a link can lead out of a root. With create the file
+// itself need not exist, only its directory.
+func (p *FileProxy) resolve(path string, create bool) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%w: %q is not absolute", config.ErrPathNotAllowed, path)
+	}
+	path = filepath.Clean(path)
+	var resolved string
+	if create {
+		dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			return "", err
+		}
+		resolved = filepath.Join(dir, filepath.Base(path))
+	} else {
+		var err error
+		if resolved, err = filepath.EvalSymlinks(path); err != nil {
+			return "", err
+		}
+	}
+	if !p.cfg.AllowsFilePath(resolved) {
+		return "", fmt.Errorf("%w: %s", config.ErrPathNotAllowed, path)
+	}
+	return resolved, nil
+}
+
+// within opens the file root holding resolved, a path returned by resolve,
+// and returns it with the path relative to it. Files opened through the root
+// cannot leave it, even if a directory on the way is replaced by a symlink
+// after resolve checked the path.
+func (p *FileProxy) within(resolved string) (*os.Root, string, error) {
+	for _, dir := range p.cfg.FileRoots {
+		rel, err := filepath.Rel(dir, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			return nil, "", err
+		}
+		return root, rel, nil
+	}
+	return nil, "", fmt.Errorf("%w: %s", config.ErrPathNotAllowed, resolved)
+}
+
+// read sends the file named by msg as body_chunk frames after its result.
+func (p *FileProxy) read(ctx context.Context, msg FileRequestMsg, tr ResponseWriter) (bool, error) {
+	path, err := p.resolve(msg.Path, false)
+	if err != nil {
+		return false, err
+	}
+	root, rel, err := p.within(path)
+	if err != nil {
+		return false, err
+	}
+	defer root.Close()
+	// Opening a FIFO or device could block, and so could reading it; neither
+	// gets past the check below. Regular files ignore O_NONBLOCK.
+	f, err := root.OpenFile(rel, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, fmt.Errorf("%s is not a regular file", msg.Path)
+	}
+
+	result := FileResultMsg{
+		Envelope: Envelope{Type: MsgFileResult, StreamID: msg.StreamID},
+		Success:  true,
+		Info:     newFileInfo(info),
+	}
+	if err := tr.WriteJSON(result); err != nil {
+		return true, err
+	}
+
+	buf := transport.GetBuffer(int(p.maxChunkSize))
+	defer transport.PutBuffer(buf)
+	for {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			chunkMsg := BodyChunkMsg{
+				Envelope: Envelope{Type: MsgBodyChunk, StreamID: msg.StreamID},
+				Data:     buf[:n],
+			}
+			if werr := tr.WriteJSONThenBinary(chunkMsg, chunkMsg.Data); werr != nil {
+				return true, fmt.Errorf("failed to write body chunk: %w", werr)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+
+	endMsg := BodyEndMsg{Envelope: Envelope{Type: MsgBodyEnd, StreamID: msg.StreamID}}
+	return true, tr.WriteJSON(endMsg)
+}
+
+// write stores body in the file named by msg. The content goes to a
+// temporary file in the same directory, which replaces the file by a rename
+// once it is complete and synced.
+func (p *FileProxy) write(ctx context.Context, msg FileRequestMsg, body *requestBody, tr ResponseWriter) (bool, error) {
+	// Closing the body refuses further chunks and unblocks a pending read.
+	defer body.Close()
+	stop := context.AfterFunc(ctx, func() { _ = body.Close() })
+	defer stop()
+
+	path, err := p.resolve(msg.Path, true)
+	if err != nil {
+		return false, err
+	}
+	root, rel, err := p.within(path)
+	if err != nil {
+		return false, err
+	}
+	defer root.Close()
+	if info, err := root.Lstat(rel); err == nil && info.IsDir() {
+		return false, fmt.Errorf("%s is a directory", msg.Path)
+	}
+	mode := fs.FileMode(msg.Mode).Perm()
+	if msg.Mode == 0 {
+		mode = defaultFileMode
+	}
+
+	// os.Root cannot rename before Go 1.25, so the temporary file and the
+	// rename still go by path.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := io.Copy(tmp, body); err != nil {
+		return false, fmt.Errorf("failed to receive file: %w", err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, err
+	}
+	committed = true
+
+	result := FileResultMsg{
+		Envelope: Envelope{Type: MsgFileResult, StreamID: msg.StreamID},
+		Success:  true,
+	}
+	if info, err := os.Stat(path); err == nil {
+		result.Info = newFileInfo(info)
+	}
+	return true, tr.WriteJSON(result)
+}
+
+// list sends the entries of the directory named by msg. Symlinks in the
+// directory are reported as such, not followed.
+func (p *FileProxy) list(msg FileRequestMsg, tr ResponseWriter) (bool, error) {
+	path, err := p.resolve(msg.Path, false)
+	if err != nil {
+		return false, err
+	}
+	root, rel, err := p.within(path)
+	if err != nil {
+		return false, err
+	}
+	defer root.Close()
+	dir, err := root.Open(rel)
+	if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+	info, err := dir.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return false, fmt.Errorf("%s is not a directory", msg.Path)
+	}
+	entries, err := dir.ReadDir(maxFileListEntries)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	truncated := false
+	if len(entries) == maxFileListEntries {
+		more, _ := dir.ReadDir(1)
+		truncated = len(more) > 0
+	}
+
+	result := FileResultMsg{
+		Envelope:  Envelope{Type: MsgFileResult, StreamID: msg.StreamID},
+		Success:   true,
+		Info:      newFileInfo(info),
+		Entries:   make([]FileInfo, 0, len(entries)),
+		Truncated: truncated,
+	}
+	for _, e := range entries {
+		entryInfo, err := e.Info()
+		if err != nil {
+			// Removed since the directory was read.
+			continue
+		}
+		result.Entries = append(result.Entries, *newFileInfo(entryInfo))
+	}
+	return true, tr.WriteJSON(result)
+}
+
+// newFileInfo describes info for a FileResultMsg.
+func newFileInfo(info fs.FileInfo) *FileInfo {
+	fileType := "other"
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		fileType = "file"
+	case mode.IsDir():
+		fileType = "dir"
+	case mode&fs.ModeSymlink != 0:
+		fileType = "symlink"
+	}
+	return &FileInfo{
+		Name:    info.Name(),
+		Type:    fileType,
+		Size:    info.Size(),
+		Mode:    uint32(info.Mode().Perm()),
+		ModTime: info.ModTime().UnixMilli(),
+	}
+}
+
+// writeFileFailure sends a failed FileResultMsg followed by a StreamCloseMsg
+// carrying reason.
+func writeFileFailure(tr ResponseWriter, streamID string, cause error, reason string) {
+	result := FileResultMsg{
+		Envelope: Envelope{Type: MsgFileResult, StreamID: streamID},
+		Success:  false,
+		Error:    cause.Error(),
+	}
+	_ = tr.WriteJSON(result)
+	closeMsg := StreamCloseMsg{
+		Envelope: Envelope{Type: MsgStreamClose, StreamID: streamID},
+		Reason:   reason,
+	}
+	_ = tr.WriteJSON(closeMsg)
+}
@@ -0,0 +1,242 @@
+package tunnel
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/config"
+)
+
+// newTestFileProxy returns a FileProxy confined to a new temporary root,
+// which it returns with symlinks resolved, sending chunks of up to maxChunk bytes.
+func newTestFileProxy(t *testing.T, maxChunk int64) (*FileProxy, string) {
+	t.Helper()
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFileProxy(&config.Config{FileRoots: []string{root}, MaxBodyChunkSize: maxChunk}), root
+}
+
+func fileRequest(typ MessageType, path string) FileRequestMsg {
+	return FileRequestMsg{Envelope: Envelope{Type: typ, StreamID: "s-file"}, Path: path}
+}
+
+func TestFileProxyRead(t *testing.T) {
+	proxy, root := newTestFileProxy(t, 4)
+	path := filepath.Join(root, "build.log")
+	if err := os.WriteFile(path, []byte("line one\nline two\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &capturingWriter{}
+	proxy.Handle(context.Background(), fileRequest(MsgFileRead, path), nil, w)
+
+	result, ok := w.envelopes[0].(FileResultMsg)
+	if !ok || !result.Success {
+		t.Fatalf("first message = %+v, want a successful file_result", w.envelopes[0])
+	}
+	if result.Info.Name != "build.log" || result.Info.Type != "file" || result.Info.Size != 18 || result.Info.Mode != 0o600 {
+		t.Errorf("info = %+v", result.Info)
+	}
+	if got := strings.Join(stringsOf(w.bodies), ""); got != "line one\nline two\n" {
+		t.Errorf("content = %q", got)
+	}
+	if len(w.bodies) != 5 {
+		t.Errorf("sent %d chunks, want 5 of up to 4 bytes", len(w.bodies))
+	}
+	if _, ok := w.envelopes[len(w.envelopes)-1].(BodyEndMsg); !ok {
+		t.Errorf("last message = %T, want BodyEndMsg", w.envelopes[len(w.envelopes)-1])
+	}
+}
+
+func stringsOf(bodies [][]byte) []string {
+	s := make([]string, len(bodies))
+	for i, b := range bodies {
+		s[i] = string(b)
+	}
+	return s
+}
+
+func TestFileProxyWrite(t *testing.T) {
+	proxy, root := newTestFileProxy(t, 1024)
+	path := filepath.Join(root, "upload.txt")
+	if err := os.WriteFile(path, []byte("old content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	body := newRequestBody(newInboundQueue(1048576, false, nil))
+	_ = body.queue.push(inboundFrame{data: []byte("new ")})
+	_ = body.queue.push(inboundFrame{data: []byte("content")})
+	body.queue.close()
+
+	msg := fileRequest(MsgFileWrite, path)
+	msg.Mode = 0o640
+	w := &capturingWriter{}
+	proxy.Handle(context.Background(), msg, body, w)
+
+	if len(w.envelopes) != 1 {
+		t.Fatalf("sent %d messages, want one file_result", len(w.envelopes))
+	}
+	if result := w.envelopes[0].(FileResultMsg); !result.Success || result.Info.Size != 11 {
+		t.Errorf("result = %+v", result)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != "new content" {
+		t.Errorf("file holds %q, %v", got, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("file mode = %v, %v; want 0640", info.Mode(), err)
+	}
+	assertNoTempFiles(t, root)
+}
+
+// TestFileProxyWriteAborted verifies a write cut short by the bridge leaves
+// the existing file untouched and no temporary file behind.
+func TestFileProxyWriteAborted(t *testing.T) {
+	proxy, root := newTestFileProxy(t, 1024)
+	path := filepath.Join(root, "config.json")
+	if err := os.WriteFile(path, []byte(`{"ok":true}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	body := newRequestBody(newInboundQueue(1048576, false, nil))
+	_ = body.queue.push(inboundFrame{data: []byte(`{"partial`)})
+	body.queue.abort(errInboundClosed)
+
+	w := &capturingWriter{}
+	proxy.Handle(context.Background(), fileRequest(MsgFileWrite, path), body, w)
+
+	if result := w.envelopes[0].(FileResultMsg); result.Success {
+		t.Error("aborted write reported success")
+	}
+	if closeMsg := w.envelopes[1].(StreamCloseMsg); closeMsg.Reason != "file_error" {
+		t.Errorf("stream_close reason = %q, want file_error", closeMsg.Reason)
+	}
+	if got, _ := os.ReadFile(path); string(got) != `{"ok":true}` {
+		t.Errorf("file holds %q after an aborted write", got)
+	}
+	assertNoTempFiles(t, root)
+}
+
+func assertNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp-") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+func TestFileProxyList(t *testing.T) {
+	proxy, root := newTestFileProxy(t, 1024)
+	if err := os.Mkdir(filepath.Join(root, "dist"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("<html>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("index.html", filepath.Join(root, "latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &capturingWriter{}
+	proxy.Handle(context.Background(), fileRequest(MsgFileList, root), nil, w)
+
+	result := w.envelopes[0].(FileResultMsg)
+	if !result.Success || result.Info.Type != "dir" || result.Truncated {
+		t.Fatalf("result = %+v", result)
+	}
+	got := make(map[string]string)
+	for _, e := range result.Entries {
+		got[e.Name] = e.Type
+	}
+	want := map[string]string{"dist": "dir", "index.html": "file", "latest": "symlink"}
+	if len(got) != len(want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+	for name, typ := range want {
+		if got[name] != typ {
+			t.Errorf("entry %s has type %q, want %q", name, got[name], typ)
+		}
+	}
+}
+
+// TestFileProxyConfinement verifies requests outside the root are refused,
+// whether they get there by "..", by a symlink or by a relative path.
+// TestFileProxyReadRefusesFIFO verifies reading a FIFO inside a root fails
+// at once instead of blocking until a writer opens it.
+func TestFileProxyReadRefusesFIFO(t *testing.T) {
+	proxy, root := newTestFileProxy(t, 1024)
+	path := filepath.Join(root, "pipe")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+
+	done := make(chan *capturingWriter, 1)
+	go func() {
+		w := &capturingWriter{}
+		proxy.Handle(context.Background(), fileRequest(MsgFileRead, path), nil, w)
+		done <- w
+	}()
+	select {
+	case w := <-done:
+		result, ok := w.envelopes[0].(FileResultMsg)
+		if !ok || result.Success || !strings.Contains(result.Error, "not a regular file") {
+			t.Errorf("first message = %+v, want a not a regular file failure", w.envelopes[0])
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("reading a FIFO blocked")
+	}
+}
+
+func TestFileProxyConfinement(t *testing.T) {
+	proxy, root := newTestFileProxy(t, 1024)
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(outside, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []FileRequestMsg{
+		fileRequest(MsgFileRead, filepath.Join(root, "..", filepath.Base(outside), "secret")),
+		fileRequest(MsgFileRead, filepath.Join(root, "escape", "secret")),
+		fileRequest(MsgFileRead, "secret"),
+		fileRequest(MsgFileList, filepath.Join(root, "escape")),
+		fileRequest(MsgFileWrite, filepath.Join(root, "escape", "planted")),
+	} {
+		var body *requestBody
+		if msg.Type == MsgFileWrite {
+			body = newRequestBody(newInboundQueue(1048576, false, nil))
+			body.queue.close()
+		}
+		w := &capturingWriter{}
+		proxy.Handle(context.Background(), msg, body, w)
+
+		if result := w.envelopes[0].(FileResultMsg); result.Success {
+			t.Errorf("%s %s succeeded", msg.Type, msg.Path)
+			continue
+		}
+		if closeMsg := w.envelopes[1].(StreamCloseMsg); closeMsg.Reason != "path_not_allowed" {
+			t.Errorf("%s %s: stream_close reason = %q, want path_not_allowed", msg.Type, msg.Path, closeMsg.Reason)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "planted")); err == nil {
+		t.Error("a write escaped the root through a symlink")
+	}
+}
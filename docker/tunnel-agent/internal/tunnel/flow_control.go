@@ -0,0 +1,261 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultStreamWindow is the per-stream receive window used when the config
+// does not set one.
+const DefaultStreamWindow int64 = 4 * 1024 * 1024
+
+// MaxWindowSize is the largest send window a peer may grant, matching the
+// HTTP/2 limit. A window_update that would exceed it is a flow control error.
+const MaxWindowSize int64 = 1<<31 - 1
+
+var (
+	// errFlowControl is returned when a peer sends more stream data than its
+	// window allows, or grows a window beyond MaxWindowSize.
+	errFlowControl = errors.New("flow control window exceeded")
+	// errInboundStalled is returned by inboundQueue.push when the stream's
+	// consumer falls a full queue behind.
+	errInboundStalled = errors.New("stream consumer fell behind")
+	// errInboundClosed is returned by inboundQueue.push once no more frames
+	// are accepted for the stream.
+	errInboundClosed = errors.New("stream input closed")
+)
+
+// sendWindow tracks the credit the bridge has granted for agent-to-bridge data
+// on one stream, in the style of HTTP/2 WINDOW_UPDATE.
+//
+// A sender may write whenever the window is positive; the frame's full size is
+// then charged, so the window can go negative by at most one frame. This keeps
+// body chunks and WebSocket messages whole instead of splitting them to fit.
+type sendWindow struct {
+	mu     sync.Mutex
+	avail  int64
+	notify chan struct{}
+}
+
+// newSendWindow creates a send window with the given initial credit.
+func newSendWindow(initial int64) *sendWindow {
+	return &sendWindow{avail: initial, notify: make(chan struct{}, 1)}
+}
+
+// acquire blocks until the window is positive (or ctx is done), then charges n bytes.
+func (w *sendWindow) acquire(ctx context.Context, n int) error {
+	for {
+		w.mu.Lock()
+		if w.avail > 0 {
+			w.avail -= int64(n)
+			w.mu.Unlock()
+			return nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.notify:
+		}
+	}
+}
+
+// update adds increment bytes of credit. It returns errFlowControl if the
+// window would exceed MaxWindowSize.
+func (w *sendWindow) update(increment int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if increment <= 0 || w.avail+increment > MaxWindowSize {
+		return errFlowControl
+	}
+	w.avail += increment
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// flowControlledWriter charges every BINARY payload against a stream's send
+// window before handing it to the underlying writer.
+type flowControlledWriter struct {
+	ResponseWriter
+	ctx    context.Context
+	window *sendWindow
+}
+
+// WriteJSONThenBinary waits for send credit, then writes the envelope and body.
+func (w *flowControlledWriter) WriteJSONThenBinary(envelope any, body []byte) error {
+	if err := w.window.acquire(w.ctx, len(body)); err != nil {
+		return err
+	}
+	return w.ResponseWriter.WriteJSONThenBinary(envelope, body)
+}
+
+// withContext returns a copy of w whose waits for credit end when ctx is done.
+func (w *flowControlledWriter) withContext(ctx context.Context) ResponseWriter {
+	return &flowControlledWriter{ResponseWriter: w.ResponseWriter, ctx: ctx, window: w.window}
+}
+
+// bindWriter ties a writer's blocking waits to ctx when the writer supports it,
+// so a handler that stops a stream also releases writers waiting for credit.
+func bindWriter(w ResponseWriter, ctx context.Context) ResponseWriter {
+	if fw, ok := w.(*flowControlledWriter); ok {
+		return fw.withContext(ctx)
+	}
+	return w
+}
+
+// inboundFrame is one unit of data received from the bridge for a stream.
+// WebSocket streams also use it to carry the message type and, for the final
+// frame, the close status the bridge asked for.
+type inboundFrame struct {
+	data        []byte
+	opcode      WSOpcode
+	closeCode   int
+	closeReason string
+}
+
+// inboundQueue buffers frames received from the bridge for one stream until
+// the stream's handler consumes them.
+//
+// For flow-controlled streams limit is the receive window the agent advertised:
+// push never blocks, a payload that would overrun the window fails with
+// errFlowControl, and consumed bytes are returned to the bridge through
+// onConsume. Legacy streams have no way to slow the bridge down, so limit
+// bounds what they may buffer: a payload that would overrun it fails the stream
+// with errInboundStalled, except that an empty queue takes any one payload.
+//
+// push and close must only be called from the agent's read loop.
+type inboundQueue struct {
+	limit     int64
+	flow      bool
+	onConsume func(increment int64)
+
+	mu       sync.Mutex
+	frames   []inboundFrame
+	buffered int64
+	consumed int64
+	closed   bool
+	err      error
+
+	readable  chan struct{}
+	done      chan struct{}
+	abortOnce sync.Once
+}
+
+// newInboundQueue creates a queue holding up to limit bytes. onConsume is
+// called with window increments when flow is true; it may be nil otherwise.
+func newInboundQueue(limit int64, flow bool, onConsume func(increment int64)) *inboundQueue {
+	return &inboundQueue{
+		limit:     limit,
+		flow:      flow,
+		onConsume: onConsume,
+		readable:  make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// push queues a frame for the consumer without blocking, so one slow stream
+// never holds up the read loop. A legacy stream whose consumer has fallen a
+// full queue behind is aborted with errInboundStalled.
+func (q *inboundQueue) push(frame inboundFrame) error {
+	q.mu.Lock()
+	if q.err != nil {
+		err := q.err
+		q.mu.Unlock()
+		return err
+	}
+	if q.closed {
+		q.mu.Unlock()
+		return errInboundClosed
+	}
+	if q.buffered+int64(len(frame.data)) > q.limit && (q.flow || q.buffered > 0) {
+		q.mu.Unlock()
+		if q.flow {
+			return errFlowControl
+		}
+		q.abort(errInboundStalled)
+		return errInboundStalled
+	}
+	q.frames = append(q.frames, frame)
+	q.buffered += int64(len(frame.data))
+	q.mu.Unlock()
+	signal(q.readable)
+	return nil
+}
+
+// pop returns the next frame, blocking until one arrives. It returns io.EOF
+// after close once the queue is drained, or the abort error.
+func (q *inboundQueue) pop(ctx context.Context) (inboundFrame, error) {
+	q.mu.Lock()
+	for len(q.frames) == 0 {
+		if q.err != nil {
+			err := q.err
+			q.mu.Unlock()
+			return inboundFrame{}, err
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return inboundFrame{}, io.EOF
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return inboundFrame{}, ctx.Err()
+		case <-q.done:
+		case <-q.readable:
+		}
+		q.mu.Lock()
+	}
+	frame := q.frames[0]
+	q.frames[0] = inboundFrame{}
+	q.frames = q.frames[1:]
+	q.buffered -= int64(len(frame.data))
+
+	// Return credit in batches of half a window rather than per frame.
+	var increment int64
+	if q.flow {
+		q.consumed += int64(len(frame.data))
+		if q.consumed >= q.limit/2 {
+			increment = q.consumed
+			q.consumed = 0
+		}
+	}
+	q.mu.Unlock()
+
+	if increment > 0 && q.onConsume != nil {
+		q.onConsume(increment)
+	}
+	return frame, nil
+}
+
+// close marks the end of input. pop returns io.EOF once queued frames are drained.
+func (q *inboundQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	signal(q.readable)
+}
+
+// abort fails pending and future pushes and pops with err.
+func (q *inboundQueue) abort(err error) {
+	q.abortOnce.Do(func() {
+		q.mu.Lock()
+		q.err = err
+		q.mu.Unlock()
+		close(q.done)
+	})
+}
+
+// signal performs a non-blocking send on a capacity-1 notification channel.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSendWindowBlocksUntilUpdate verifies acquire waits for credit once the
+// window is exhausted and resumes after a window update.
+func TestSendWindowBlocksUntilUpdate(t *testing.T) {
+	w := newSendWindow(10)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := w.acquire(ctx, 10); err != nil {
+		t.Fatalf("acquire within window: %v", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- w.acquire(ctx, 5) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquire should block on an exhausted window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := w.update(5); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("acquire after update: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not resume after update")
+	}
+}
+
+// TestSendWindowRejectsOverflow verifies a window update past MaxWindowSize is a flow control error.
+func TestSendWindowRejectsOverflow(t *testing.T) {
+	w := newSendWindow(MaxWindowSize)
+	if err := w.update(1); !errors.Is(err, errFlowControl) {
+		t.Errorf("update past MaxWindowSize = %v, want errFlowControl", err)
+	}
+}
+
+// TestInboundQueueFlowControlViolation verifies a flow-controlled queue refuses
+// payloads beyond its window instead of blocking or dropping them.
+func TestInboundQueueFlowControlViolation(t *testing.T) {
+	q := newInboundQueue(8, true, nil)
+	if err := q.push(inboundFrame{data: []byte("12345678")}); err != nil {
+		t.Fatalf("push within window: %v", err)
+	}
+	if err := q.push(inboundFrame{data: []byte("9")}); !errors.Is(err, errFlowControl) {
+		t.Errorf("push past window = %v, want errFlowControl", err)
+	}
+}
+
+// TestInboundQueueReturnsCredit verifies consumed bytes are reported back in
+// batches of at least half a window.
+func TestInboundQueueReturnsCredit(t *testing.T) {
+	var credited atomic.Int64
+	q := newInboundQueue(8, true, func(increment int64) { credited.Add(increment) })
+
+	for _, part := range []string{"ab", "cd", "ef"} {
+		if err := q.push(inboundFrame{data: []byte(part)}); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	if _, err := q.pop(ctx); err != nil {
+		t.Fatalf("pop: %v", err)
+	}
+	if got := credited.Load(); got != 0 {
+		t.Errorf("credit after 2 bytes = %d, want 0 (below half window)", got)
+	}
+	if _, err := q.pop(ctx); err != nil {
+		t.Fatalf("pop: %v", err)
+	}
+	if got := credited.Load(); got != 4 {
+		t.Errorf("credit after 4 bytes = %d, want 4", got)
+	}
+}
+
+// TestInboundQueueLegacyLimit verifies a legacy queue takes any one payload
+// when empty and never blocks a push, failing the stream instead once its
+// consumer falls a full queue behind.
+func TestInboundQueueLegacyLimit(t *testing.T) {
+	q := newInboundQueue(4, false, nil)
+	if err := q.push(inboundFrame{data: []byte("larger than the queue")}); err != nil {
+		t.Fatalf("push to an empty queue: %v", err)
+	}
+	if _, err := q.pop(context.Background()); err != nil {
+		t.Fatalf("pop: %v", err)
+	}
+
+	if err := q.push(inboundFrame{data: []byte("full")}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if err := q.push(inboundFrame{data: []byte("x")}); !errors.Is(err, errInboundStalled) {
+		t.Fatalf("push on a full queue = %v, want errInboundStalled", err)
+	}
+	if _, err := q.pop(context.Background()); err != nil {
+		t.Fatalf("pop of the queued payload: %v", err)
+	}
+	if _, err := q.pop(context.Background()); !errors.Is(err, errInboundStalled) {
+		t.Errorf("pop after overrun = %v, want errInboundStalled", err)
+	}
+}
@@ -4,16 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/transport"
+	"docker-bridge-tunnel-agent/internal/upstream"
 )
 
 // hopByHopHeaders is the list of headers that must be stripped per RFC 7230.
@@ -81,18 +86,33 @@ func addForwardedHeaders(h http.Header, host string) {
 // It forwards HTTPRequestMsg frames to local services and returns the response
 // as a slice of protocol messages (HTTPResponseMsg + optional BodyChunkMsg + BodyEndMsg).
 type HTTPProxy struct {
+	cfg          *config.Config
+	dialer       *upstream.Dialer
 	clients      sync.Map // key: int (port) -> value: *http.Client
+	errorPage    *template.Template
 	timeout      time.Duration
 	maxChunkSize int64
-	port         int
 }
 
+// defaultMaxChunkSize is the response chunk size used when the config does not set one.
+const defaultMaxChunkSize = 1024 * 1024
+
 // NewHTTPProxy creates an HTTPProxy configured from the given Config.
 func NewHTTPProxy(cfg *config.Config) *HTTPProxy {
+	maxChunkSize := cfg.MaxBodyChunkSize
+	if maxChunkSize <= 0 {
+		maxChunkSize = defaultMaxChunkSize
+	}
+	errorPage := cfg.ErrorPage
+	if errorPage == nil {
+		errorPage = defaultErrorPage
+	}
 	return &HTTPProxy{
+		cfg:          cfg,
+		dialer:       upstream.NewDialer(cfg, 5*time.Second),
 		timeout:      cfg.ProxyTimeout,
-		maxChunkSize: cfg.MaxBodyChunkSize,
-		port:         cfg.Ports[0],
+		maxChunkSize: maxChunkSize,
+		errorPage:    errorPage,
 	}
 }
 
@@ -112,9 +132,16 @@ func (p *HTTPProxy) clientFor(port int) *http.Client {
 		// AI completions) can run as long as upstream is sending; cancellation
 		// flows through the request context.
 		ResponseHeaderTimeout: p.timeout,
-		DialContext: (&net.Dialer{
-			Timeout: 5 * time.Second,
-		}).DialContext,
+		// Requests always name 127.0.0.1:{port}; the dialer sends them to the
+		// port's configured upstream or whichever loopback family answers.
+		DialContext: p.dialer.DialContext,
+	}
+
+	// h2c upstreams (gRPC dev servers and the like) get HTTP/2 with prior
+	// knowledge instead of HTTP/1.1.
+	if p.cfg.UsesH2C(port) {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
 	}
 
 	client := &http.Client{
@@ -137,12 +164,17 @@ type ResponseWriter interface {
 	WriteJSONThenBinary(envelope any, body []byte) error
 }
 
-// isStreamingResponse returns true if the response should be streamed
-// incrementally rather than buffered in full. This avoids blocking on
-// long-lived streams like SSE (text/event-stream) or chunked transfers.
+// isStreamingResponse returns true if the response body should be forwarded
+// as each read arrives rather than in full maxChunkSize chunks. This avoids
+// holding back events on long-lived streams like SSE (text/event-stream) or
+// chunked transfers.
 func isStreamingResponse(resp *http.Response) bool {
 	ct := resp.Header.Get("Content-Type")
-	if strings.HasPrefix(ct, "text/event-stream") {
+	if strings.HasPrefix(ct, "text/event-stream") || strings.HasPrefix(ct, "application/grpc") {
+		return true
+	}
+	// HTTP/2 has no chunked encoding; an unknown length means a stream.
+	if resp.ContentLength < 0 && resp.ProtoMajor >= 2 {
 		return true
 	}
 	// Chunked with unknown content length — stream it.
@@ -156,68 +188,178 @@ func isStreamingResponse(resp *http.Response) bool {
 	return false
 }
 
-// buildResponseHeaders extracts and strips hop-by-hop headers from the response.
-func buildResponseHeaders(resp *http.Response) map[string]string {
-	respHTTPHeaders := make(http.Header)
-	for k, vals := range resp.Header {
-		for _, v := range vals {
-			respHTTPHeaders.Add(k, v)
+// teAcceptsTrailers reports whether the TE request header includes "trailers".
+func teAcceptsTrailers(h http.Header) bool {
+	for _, v := range h.Values("Te") {
+		for _, token := range splitCommaSeparated(v) {
+			if strings.EqualFold(token, "trailers") {
+				return true
+			}
 		}
 	}
+	return false
+}
+
+// trailerNames returns the trailer names the upstream announced, sorted.
+func trailerNames(resp *http.Response) []string {
+	if len(resp.Trailer) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(resp.Trailer))
+	for name := range resp.Trailer {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// responseTrailers returns the upstream response trailers once the body has
+// been read to EOF, or nil when there are none.
+func responseTrailers(resp *http.Response) map[string][]string {
+	trailers := make(map[string][]string, len(resp.Trailer))
+	for name, vals := range resp.Trailer {
+		if len(vals) > 0 {
+			trailers[name] = append([]string(nil), vals...)
+		}
+	}
+	if len(trailers) == 0 {
+		return nil
+	}
+	return trailers
+}
+
+// buildResponseHeaders copies the response headers and strips hop-by-hop headers.
+func buildResponseHeaders(resp *http.Response) http.Header {
+	respHTTPHeaders := resp.Header.Clone()
+	if respHTTPHeaders == nil {
+		respHTTPHeaders = make(http.Header)
+	}
 	stripHopByHop(respHTTPHeaders)
-	strippedHeaders := make(map[string]string, len(respHTTPHeaders))
-	for k, vals := range respHTTPHeaders {
+	return respHTTPHeaders
+}
+
+// headersFromMsg builds an http.Header from the header maps of a bridge message.
+// When multi is non-nil the bridge has opted in to multi-value headers and the
+// flat map is ignored.
+func headersFromMsg(flat map[string]string, multi map[string][]string) http.Header {
+	if multi != nil {
+		h := make(http.Header, len(multi))
+		for k, vals := range multi {
+			for _, v := range vals {
+				h.Add(k, v)
+			}
+		}
+		return h
+	}
+	h := make(http.Header, len(flat))
+	for k, v := range flat {
+		h.Set(k, v)
+	}
+	return h
+}
+
+// flattenHeaders keeps the first value of each header for the legacy Headers field.
+func flattenHeaders(h http.Header) map[string]string {
+	flat := make(map[string]string, len(h))
+	for k, vals := range h {
 		if len(vals) > 0 {
-			strippedHeaders[k] = vals[0]
+			flat[k] = vals[0]
 		}
 	}
-	return strippedHeaders
+	return flat
 }
 
-// makeRequest creates and executes the proxied HTTP request. Returns the
-// upstream response, or a 502 response message slice on connection error.
-func (p *HTTPProxy) makeRequest(ctx context.Context, msg HTTPRequestMsg, bodyData []byte) (*http.Response, []any, error) {
-	targetURL := fmt.Sprintf("http://127.0.0.1:%d%s", p.port, msg.Path)
+// multiValueHeaders copies every value of h, in order, for the MultiHeaders field.
+func multiValueHeaders(h http.Header) map[string][]string {
+	multi := make(map[string][]string, len(h))
+	for k, vals := range h {
+		multi[k] = append([]string(nil), vals...)
+	}
+	return multi
+}
 
-	var reqBody io.Reader
-	if len(bodyData) > 0 {
-		reqBody = bytes.NewReader(bodyData)
+// newHTTPResponseMsg builds the http_response header message for msg. The
+// multi-value form is included only when the request opted in to it.
+func newHTTPResponseMsg(msg HTTPRequestMsg, statusCode int, headers http.Header) HTTPResponseMsg {
+	responseMsg := HTTPResponseMsg{
+		Envelope:   Envelope{Type: MsgHTTPResponse, StreamID: msg.StreamID},
+		StatusCode: statusCode,
+		Headers:    flattenHeaders(headers),
+	}
+	if msg.MultiHeaders != nil {
+		responseMsg.MultiHeaders = multiValueHeaders(headers)
 	}
+	return responseMsg
+}
+
+// makeRequest creates and executes the proxied HTTP request to port, as
+// resolved from msg.Port. Returns the upstream response, or a 502 response
+// message slice on connection error.
+//
+// body may be nil. A streamed body is sent with msg.BodyLen as its
+// Content-Length when known, and chunked otherwise.
+func (p *HTTPProxy) makeRequest(ctx context.Context, msg HTTPRequestMsg, port int, body io.Reader) (*http.Response, []any, error) {
+	targetURL := fmt.Sprintf("http://127.0.0.1:%d%s", port, msg.Path)
 
-	req, err := http.NewRequestWithContext(ctx, msg.Method, targetURL, reqBody)
+	req, err := http.NewRequestWithContext(ctx, msg.Method, targetURL, body)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create request: %w", err)
 	}
-
-	for k, v := range msg.Headers {
-		req.Header.Set(k, v)
+	if msg.BodyStream {
+		req.ContentLength = -1
+		if msg.BodyLen > 0 {
+			req.ContentLength = msg.BodyLen
+		}
 	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &countingBody{body: req.Body, counter: bytesIn.WithLabelValues(portLabel(port), protoHTTP)}
+	}
+
+	req.Header = headersFromMsg(msg.Headers, msg.MultiHeaders)
 
+	// "TE: trailers" is the one TE value a proxy forwards; gRPC servers
+	// reject requests without it.
+	acceptsTrailers := teAcceptsTrailers(req.Header)
 	stripHopByHop(req.Header)
-	addForwardedHeaders(req.Header, msg.Headers["host"])
+	if acceptsTrailers {
+		req.Header.Set("Te", "trailers")
+	}
+	addForwardedHeaders(req.Header, req.Header.Get("Host"))
 
-	client := p.clientFor(p.port)
+	client := p.clientFor(port)
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
 		var opErr *net.OpError
 		if isNetOpError(err, &opErr) {
-			return nil, p.build502Response(msg), nil
+			portUnreachableTotal.WithLabelValues(portLabel(port)).Inc()
+			return nil, p.build502Response(msg, port), nil
 		}
 		return nil, nil, fmt.Errorf("proxy request failed: %w", err)
 	}
+	upstreamLatency.WithLabelValues(portLabel(port)).Observe(time.Since(start).Seconds())
 
 	return resp, nil, nil
 }
 
 // Execute proxies the HTTP request described by msg (with optional body in bodyData)
-// to the local service at the configured port and returns the sequence of protocol messages
+// to the local service at the requested port and returns the sequence of protocol messages
 // that should be sent back to the bridge.
 //
 // On success: [HTTPResponseMsg, (optional) BodyChunkMsg..., BodyEndMsg]
 // On connection refused: [HTTPResponseMsg{502}, BodyChunkMsg{errorJSON}, BodyEndMsg]
-// Any other error is returned directly.
+// A port outside the configured allow-list yields an error wrapping
+// config.ErrPortNotAllowed. Any other error is returned directly.
 func (p *HTTPProxy) Execute(ctx context.Context, msg HTTPRequestMsg, bodyData []byte) ([]any, error) {
-	resp, errResp, err := p.makeRequest(ctx, msg, bodyData)
+	port, err := p.cfg.ResolvePort(msg.Port)
+	if err != nil {
+		return nil, err
+	}
+	var reqBody io.Reader
+	if len(bodyData) > 0 {
+		reqBody = bytes.NewReader(bodyData)
+	}
+	resp, errResp, err := p.makeRequest(ctx, msg, port, reqBody)
 	if err != nil {
 		return nil, err
 	}
@@ -232,114 +374,107 @@ func (p *HTTPProxy) Execute(ctx context.Context, msg HTTPRequestMsg, bodyData []
 	}
 
 	headers := buildResponseHeaders(resp)
-	return p.buildResponses(msg, resp.StatusCode, headers, body), nil
+	return p.buildResponses(msg, resp, headers, body), nil
 }
 
 // ExecuteStreaming proxies an HTTP request and streams the response body
-// incrementally via the ResponseWriter. This avoids buffering the entire
-// response for long-lived streams (SSE, chunked transfers).
+// incrementally via the ResponseWriter, so memory per stream stays bounded by
+// one maxChunkSize buffer whatever the response size.
+//
+// Bodies of known length are sent in full maxChunkSize chunks, with BodyLen
+// set from Content-Length. Streaming responses (SSE, chunked transfers, gRPC)
+// forward each read as soon as it arrives, in chunks of at most maxChunkSize.
 //
-// If the upstream response is not a streaming type, falls back to buffered
-// behaviour (reads full body, writes in one shot).
+// body is the request body (nil for none); it may be a streamed body that is
+// still being filled by the agent's read loop.
 //
-// Returns true if the response was handled (streamed or buffered), false if
-// makeRequest returned a 502 error response (already written to writer).
-func (p *HTTPProxy) ExecuteStreaming(ctx context.Context, msg HTTPRequestMsg, bodyData []byte, writer ResponseWriter) (bool, error) {
-	resp, errResp, err := p.makeRequest(ctx, msg, bodyData)
+// Returns true if the response was handled, including a 502 error response
+// when the port is unreachable. A read error after the response header has
+// been sent is returned so the stream is closed rather than ended cleanly.
+// A port outside the configured allow-list yields an error wrapping
+// config.ErrPortNotAllowed.
+func (p *HTTPProxy) ExecuteStreaming(ctx context.Context, msg HTTPRequestMsg, body io.Reader, writer ResponseWriter) (bool, error) {
+	port, err := p.cfg.ResolvePort(msg.Port)
 	if err != nil {
 		return false, err
 	}
+	resp, errResp, err := p.makeRequest(ctx, msg, port, body)
+	if err != nil {
+		requestsTotal.WithLabelValues(portLabel(port), "error").Inc()
+		return false, err
+	}
 	if errResp != nil {
+		requestsTotal.WithLabelValues(portLabel(port), statusClass(http.StatusBadGateway)).Inc()
 		// Write the 502 error responses directly
-		for _, r := range errResp {
-			switch v := r.(type) {
-			case HTTPResponseMsg:
-				if writeErr := writer.WriteJSON(v); writeErr != nil {
-					return false, writeErr
-				}
-			case BodyChunkMsg:
-				if writeErr := writer.WriteJSONThenBinary(v, v.Data); writeErr != nil {
-					return false, writeErr
-				}
-			case BodyEndMsg:
-				if writeErr := writer.WriteJSON(v); writeErr != nil {
-					return false, writeErr
-				}
-			}
+		if err := writeMessages(writer, errResp); err != nil {
+			return false, err
 		}
 		return true, nil
 	}
 	defer resp.Body.Close()
 
-	headers := buildResponseHeaders(resp)
+	requestsTotal.WithLabelValues(portLabel(port), statusClass(resp.StatusCode)).Inc()
+	sent := bytesOut.WithLabelValues(portLabel(port), protoHTTP)
 
-	if !isStreamingResponse(resp) {
-		// Not a streaming response — fall back to buffered behaviour
-		body, readErr := io.ReadAll(resp.Body)
-		if readErr != nil {
-			return false, fmt.Errorf("failed to read response body: %w", readErr)
-		}
-		responses := p.buildResponses(msg, resp.StatusCode, headers, body)
-		for _, r := range responses {
-			switch v := r.(type) {
-			case HTTPResponseMsg:
-				if writeErr := writer.WriteJSON(v); writeErr != nil {
-					return false, writeErr
-				}
-			case BodyChunkMsg:
-				if writeErr := writer.WriteJSONThenBinary(v, v.Data); writeErr != nil {
-					return false, writeErr
-				}
-			case BodyEndMsg:
-				if writeErr := writer.WriteJSON(v); writeErr != nil {
-					return false, writeErr
-				}
-			}
+	headers := buildResponseHeaders(resp)
+	responseMsg := newHTTPResponseMsg(msg, resp.StatusCode, headers)
+	responseMsg.TrailerNames = trailerNames(resp)
+
+	// HEAD, 204 and 304 responses (and empty bodies) carry no body; only a
+	// response that announced trailers still needs a body_end for them.
+	if (resp.Body == http.NoBody || resp.ContentLength == 0) && len(resp.Trailer) == 0 {
+		if err := writer.WriteJSON(responseMsg); err != nil {
+			return false, fmt.Errorf("failed to write response header: %w", err)
 		}
 		return true, nil
 	}
 
-	// Streaming response — send headers immediately, then stream body chunks.
-	responseMsg := HTTPResponseMsg{
-		Envelope:    Envelope{Type: MsgHTTPResponse, StreamID: msg.StreamID},
-		StatusCode:  resp.StatusCode,
-		Headers:     headers,
-		BodyFollows: true,
-		// BodyLen unknown for streams — leave at 0
+	// Send headers immediately, then stream body chunks. BodyLen is left at
+	// 0 when the length is unknown.
+	if resp.ContentLength > 0 {
+		responseMsg.BodyLen = resp.ContentLength
 	}
+	responseMsg.BodyFollows = true
 	if err := writer.WriteJSON(responseMsg); err != nil {
-		return false, fmt.Errorf("failed to write streaming response header: %w", err)
+		return false, fmt.Errorf("failed to write response header: %w", err)
 	}
 
-	// Read and forward body chunks as they arrive.
-	buf := make([]byte, 32*1024) // 32KB read buffer
+	streaming := isStreamingResponse(resp)
+	buf := transport.GetBuffer(int(p.maxChunkSize))
+	defer transport.PutBuffer(buf)
 	for {
-		n, readErr := resp.Body.Read(buf)
+		var n int
+		var readErr error
+		if streaming {
+			n, readErr = resp.Body.Read(buf)
+		} else {
+			n, readErr = io.ReadFull(resp.Body, buf)
+			if errors.Is(readErr, io.ErrUnexpectedEOF) {
+				readErr = io.EOF
+			}
+		}
 		if n > 0 {
-			chunk := make([]byte, n)
-			copy(chunk, buf[:n])
 			chunkMsg := BodyChunkMsg{
 				Envelope: Envelope{Type: MsgBodyChunk, StreamID: msg.StreamID},
-				Data:     chunk,
+				Data:     buf[:n],
 			}
-			if writeErr := writer.WriteJSONThenBinary(chunkMsg, chunk); writeErr != nil {
+			if writeErr := writer.WriteJSONThenBinary(chunkMsg, chunkMsg.Data); writeErr != nil {
 				return false, fmt.Errorf("failed to write body chunk: %w", writeErr)
 			}
+			sent.Add(float64(n))
 		}
-		if readErr != nil {
-			if readErr != io.EOF {
-				slog.Warn("streaming body read error",
-					"stream_id", msg.StreamID,
-					"error", readErr,
-				)
-			}
+		if errors.Is(readErr, io.EOF) {
 			break
 		}
+		if readErr != nil {
+			return false, fmt.Errorf("failed to read response body: %w", readErr)
+		}
 	}
 
-	// Signal end of body
+	// Signal end of body, with any trailers the upstream sent after it.
 	endMsg := BodyEndMsg{
 		Envelope: Envelope{Type: MsgBodyEnd, StreamID: msg.StreamID},
+		Trailers: responseTrailers(resp),
 	}
 	if err := writer.WriteJSON(endMsg); err != nil {
 		return false, fmt.Errorf("failed to write body_end: %w", err)
@@ -348,22 +483,51 @@ func (p *HTTPProxy) ExecuteStreaming(ctx context.Context, msg HTTPRequestMsg, bo
 	return true, nil
 }
 
-// buildResponses assembles the sequence of protocol messages for a successful response.
-func (p *HTTPProxy) buildResponses(msg HTTPRequestMsg, statusCode int, headers map[string]string, body []byte) []any {
+// writeMessages writes a sequence of protocol messages built by buildResponses
+// or build502Response.
+func writeMessages(writer ResponseWriter, messages []any) error {
+	for _, r := range messages {
+		switch v := r.(type) {
+		case HTTPResponseMsg:
+			if err := writer.WriteJSON(v); err != nil {
+				return err
+			}
+		case BodyChunkMsg:
+			if err := writer.WriteJSONThenBinary(v, v.Data); err != nil {
+				return err
+			}
+		case BodyEndMsg:
+			if err := writer.WriteJSON(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildResponses assembles the sequence of protocol messages for a successful
+// response whose body has been read in full. A response with trailers always
+// ends with a BodyEndMsg carrying them, even when the body is empty.
+func (p *HTTPProxy) buildResponses(msg HTTPRequestMsg, resp *http.Response, headers http.Header, body []byte) []any {
 	bodyLen := int64(len(body))
-	bodyFollows := bodyLen > 0
+	trailers := responseTrailers(resp)
+	bodyFollows := bodyLen > 0 || trailers != nil
 
-	responseMsg := HTTPResponseMsg{
-		Envelope:    Envelope{Type: MsgHTTPResponse, StreamID: msg.StreamID},
-		StatusCode:  statusCode,
-		Headers:     headers,
-		BodyLen:     bodyLen,
-		BodyFollows: bodyFollows,
-	}
+	responseMsg := newHTTPResponseMsg(msg, resp.StatusCode, headers)
+	responseMsg.TrailerNames = trailerNames(resp)
+	responseMsg.BodyLen = bodyLen
+	responseMsg.BodyFollows = bodyFollows
 
 	if !bodyFollows {
 		return []any{responseMsg}
 	}
+	endMsg := BodyEndMsg{
+		Envelope: Envelope{Type: MsgBodyEnd, StreamID: msg.StreamID},
+		Trailers: trailers,
+	}
+	if bodyLen == 0 {
+		return []any{responseMsg, endMsg}
+	}
 
 	// Single chunk: body fits within maxChunkSize.
 	if bodyLen <= p.maxChunkSize {
@@ -373,9 +537,7 @@ func (p *HTTPProxy) buildResponses(msg HTTPRequestMsg, statusCode int, headers m
 				Envelope: Envelope{Type: MsgBodyChunk, StreamID: msg.StreamID},
 				Data:     body,
 			},
-			BodyEndMsg{
-				Envelope: Envelope{Type: MsgBodyEnd, StreamID: msg.StreamID},
-			},
+			endMsg,
 		}
 	}
 
@@ -396,27 +558,66 @@ func (p *HTTPProxy) buildResponses(msg HTTPRequestMsg, statusCode int, headers m
 		offset = end
 	}
 
-	responses = append(responses, BodyEndMsg{
-		Envelope: Envelope{Type: MsgBodyEnd, StreamID: msg.StreamID},
-	})
+	responses = append(responses, endMsg)
 
 	return responses
 }
 
-// build502Response returns the protocol message sequence for a 502 (port unreachable) error.
-func (p *HTTPProxy) build502Response(msg HTTPRequestMsg) []any {
+// build502Response returns the protocol message sequence for a 502 (port
+// unreachable) error. Browsers asking for HTML get the error page, which
+// reloads until the port is back; other clients get a JSON body.
+func (p *HTTPProxy) build502Response(msg HTTPRequestMsg, port int) []any {
+	contentType := "application/json"
+	headers := map[string]string{}
 	errBody, _ := json.Marshal(map[string]any{
 		"error": "port_unreachable",
-		"port":  p.port,
+		"port":  port,
 	})
+	if acceptsHTML(headersFromMsg(msg.Headers, msg.MultiHeaders)) {
+		var page bytes.Buffer
+		data := errorPageData{Port: port, Method: msg.Method, Path: msg.Path, RefreshSeconds: errorPageRefreshSeconds}
+		if err := p.errorPage.Execute(&page, data); err != nil {
+			slog.Warn("failed to render error page", "stream_id", msg.StreamID, "error", err)
+		} else {
+			contentType = "text/html; charset=utf-8"
+			headers["cache-control"] = "no-store"
+			errBody = page.Bytes()
+		}
+	}
+	headers["content-type"] = contentType
+	return errorResponse(msg, http.StatusBadGateway, headers, errBody)
+}
 
+// buildBusyResponse returns the protocol message sequence for a 503 sent
+// when a request would exceed the agent's concurrency limits.
+func buildBusyResponse(msg HTTPRequestMsg, port int) []any {
+	errBody, _ := json.Marshal(map[string]any{
+		"error": "too_many_streams",
+		"port":  port,
+	})
+	headers := map[string]string{
+		"content-type": "application/json",
+		"retry-after":  "1",
+	}
+	return errorResponse(msg, http.StatusServiceUnavailable, headers, errBody)
+}
+
+// errorResponse returns the protocol message sequence for a response the
+// agent generates itself, with the whole body in one chunk.
+func errorResponse(msg HTTPRequestMsg, statusCode int, headers map[string]string, errBody []byte) []any {
 	responseMsg := HTTPResponseMsg{
 		Envelope:    Envelope{Type: MsgHTTPResponse, StreamID: msg.StreamID},
-		StatusCode:  http.StatusBadGateway,
-		Headers:     map[string]string{"content-type": "application/json"},
+		StatusCode:  statusCode,
+		Headers:     headers,
 		BodyLen:     int64(len(errBody)),
 		BodyFollows: true,
 	}
+	if msg.MultiHeaders != nil {
+		responseMsg.MultiHeaders = make(map[string][]string, len(headers))
+		for name, value := range headers {
+			responseMsg.MultiHeaders[name] = []string{value}
+		}
+	}
 
 	return []any{
 		responseMsg,
@@ -1,14 +1,22 @@
 package tunnel
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/transport"
 )
 
 func newTestProxyConfig(port int, maxChunk int64) *config.Config {
@@ -342,3 +350,531 @@ func TestHTTPProxyClientReuse(t *testing.T) {
 	}
 }
 
+// TestHTTPProxyRoutesToRequestedPort verifies msg.Port selects among the configured ports.
+func TestHTTPProxyRoutesToRequestedPort(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("app"))
+	}))
+	defer app.Close()
+	hmr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hmr"))
+	}))
+	defer hmr.Close()
+
+	appPort := app.Listener.Addr().(*net.TCPAddr).Port
+	hmrPort := hmr.Listener.Addr().(*net.TCPAddr).Port
+	cfg := newTestProxyConfig(appPort, 1048576)
+	cfg.Ports = append(cfg.Ports, hmrPort)
+	proxy := NewHTTPProxy(cfg)
+
+	for port, want := range map[int]string{0: "app", appPort: "app", hmrPort: "hmr"} {
+		msg := HTTPRequestMsg{
+			Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "stream-port"},
+			Port:     port,
+			Method:   "GET",
+			Path:     "/",
+			Headers:  map[string]string{"host": "localhost"},
+		}
+
+		responses, err := proxy.Execute(t.Context(), msg, nil)
+		if err != nil {
+			t.Fatalf("port %d: Execute returned error: %v", port, err)
+		}
+		var body []byte
+		for _, r := range responses {
+			if chunk, ok := r.(BodyChunkMsg); ok {
+				body = append(body, chunk.Data...)
+			}
+		}
+		if string(body) != want {
+			t.Errorf("port %d: body = %q, want %q", port, body, want)
+		}
+	}
+}
+
+// TestHTTPProxyRejectsPortNotAllowed verifies a port outside the allow-list is refused.
+func TestHTTPProxyRejectsPortNotAllowed(t *testing.T) {
+	proxy := NewHTTPProxy(newTestProxyConfig(3000, 1048576))
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "stream-denied"},
+		Port:     4000,
+		Method:   "GET",
+		Path:     "/",
+		Headers:  map[string]string{"host": "localhost"},
+	}
+
+	_, err := proxy.Execute(t.Context(), msg, nil)
+	if !errors.Is(err, config.ErrPortNotAllowed) {
+		t.Fatalf("expected ErrPortNotAllowed, got %v", err)
+	}
+}
+
+// TestHTTPProxyMultiValueHeaders verifies repeated request and response headers
+// survive the proxy in order when the bridge opts in with multi_headers.
+func TestHTTPProxyMultiValueHeaders(t *testing.T) {
+	var receivedAccept []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedAccept = r.Header.Values("Accept-Language")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	proxy := NewHTTPProxy(newTestProxyConfig(port, 1048576))
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "stream-multi"},
+		Method:   "GET",
+		Path:     "/",
+		MultiHeaders: map[string][]string{
+			"host":            {"localhost"},
+			"accept-language": {"en", "de"},
+		},
+	}
+
+	responses, err := proxy.Execute(t.Context(), msg, nil)
+	if err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	}
+
+	if strings.Join(receivedAccept, ",") != "en,de" {
+		t.Errorf("upstream Accept-Language = %v, want [en de]", receivedAccept)
+	}
+
+	resp := responses[0].(HTTPResponseMsg)
+	if got := resp.MultiHeaders["Set-Cookie"]; strings.Join(got, ";") != "a=1;b=2" {
+		t.Errorf("MultiHeaders[Set-Cookie] = %v, want [a=1 b=2]", got)
+	}
+	if got := resp.MultiHeaders["Vary"]; strings.Join(got, ",") != "Origin,Accept-Encoding" {
+		t.Errorf("MultiHeaders[Vary] = %v, want [Origin Accept-Encoding]", got)
+	}
+	if resp.Headers["Set-Cookie"] != "a=1" {
+		t.Errorf("Headers[Set-Cookie] = %q, want first value a=1", resp.Headers["Set-Cookie"])
+	}
+}
+
+// TestHTTPProxyLegacyHeadersOmitMultiValue verifies bridges that do not send
+// multi_headers keep receiving only the flat header map.
+func TestHTTPProxyLegacyHeadersOmitMultiValue(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	proxy := NewHTTPProxy(newTestProxyConfig(port, 1048576))
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "stream-legacy"},
+		Method:   "GET",
+		Path:     "/",
+		Headers:  map[string]string{"host": "localhost"},
+	}
+
+	responses, err := proxy.Execute(t.Context(), msg, nil)
+	if err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	}
+
+	data, err := json.Marshal(responses[0])
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if strings.Contains(string(data), "multi_headers") {
+		t.Errorf("legacy response should not carry multi_headers: %s", data)
+	}
+}
+
+// recordingWriter is a ResponseWriter that records every message written,
+// and a copy of every binary body.
+type recordingWriter struct {
+	mu       sync.Mutex
+	messages []any
+	bodies   [][]byte
+}
+
+func (w *recordingWriter) WriteJSON(v any) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages = append(w.messages, v)
+	return nil
+}
+
+func (w *recordingWriter) WriteJSONThenBinary(envelope any, body []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages = append(w.messages, envelope)
+	w.bodies = append(w.bodies, bytes.Clone(body))
+	return nil
+}
+
+// TestHTTPProxyH2CTrailers verifies an h2c port is proxied over HTTP/2 with
+// TE: trailers, and that response trailers are reported in body_end.
+func TestHTTPProxyH2CTrailers(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "expected HTTP/2", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		if r.Header.Get("Te") != "trailers" {
+			http.Error(w, "missing TE: trailers", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		_, _ = w.Write([]byte{0, 0, 0, 0, 2, 0x08, 0x01})
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "OK")
+	}))
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	cfg := newTestProxyConfig(port, 1048576)
+	cfg.H2CPorts = []int{port}
+	proxy := NewHTTPProxy(cfg)
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "grpc-1"},
+		Method:   "POST",
+		Path:     "/helloworld.Greeter/SayHello",
+		Headers:  map[string]string{"Content-Type": "application/grpc", "TE": "trailers"},
+	}
+	w := &recordingWriter{}
+	if _, err := proxy.ExecuteStreaming(t.Context(), msg, strings.NewReader("\x00\x00\x00\x00\x00"), w); err != nil {
+		t.Fatalf("ExecuteStreaming returned error: %v", err)
+	}
+
+	resp, ok := w.messages[0].(HTTPResponseMsg)
+	if !ok {
+		t.Fatalf("expected HTTPResponseMsg first, got %T", w.messages[0])
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if !slices.Equal(resp.TrailerNames, []string{"Grpc-Message", "Grpc-Status"}) {
+		t.Errorf("trailer_names = %v", resp.TrailerNames)
+	}
+
+	end, ok := w.messages[len(w.messages)-1].(BodyEndMsg)
+	if !ok {
+		t.Fatalf("expected BodyEndMsg last, got %T", w.messages[len(w.messages)-1])
+	}
+	if got := end.Trailers["Grpc-Status"]; len(got) != 1 || got[0] != "0" {
+		t.Errorf("Grpc-Status trailer = %v, want [0]", got)
+	}
+	if got := end.Trailers["Grpc-Message"]; len(got) != 1 || got[0] != "OK" {
+		t.Errorf("Grpc-Message trailer = %v, want [OK]", got)
+	}
+}
+
+// TestHTTPProxyTrailersWithEmptyBody verifies a buffered response whose only
+// content is trailers still ends with a body_end carrying them.
+func TestHTTPProxyTrailersWithEmptyBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer ts.Close()
+
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	proxy := NewHTTPProxy(newTestProxyConfig(port, 1048576))
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "trailer-1"},
+		Method:   "GET",
+		Path:     "/",
+		Headers:  map[string]string{},
+	}
+	responses, err := proxy.Execute(t.Context(), msg, nil)
+	if err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("expected response + body_end, got %d messages", len(responses))
+	}
+	if resp := responses[0].(HTTPResponseMsg); !resp.BodyFollows {
+		t.Error("expected BodyFollows=true so the bridge waits for body_end")
+	}
+	end := responses[1].(BodyEndMsg)
+	if got := end.Trailers["X-Checksum"]; len(got) != 1 || got[0] != "abc" {
+		t.Errorf("X-Checksum trailer = %v, want [abc]", got)
+	}
+}
+
+// TestHTTPProxyStreamsKnownLengthBody verifies a response with a
+// Content-Length is streamed in full maxChunkSize chunks with BodyLen set,
+// instead of being buffered before it is sent.
+func TestHTTPProxyStreamsKnownLengthBody(t *testing.T) {
+	bigBody := strings.Repeat("0123456789", 1000) // 10000 bytes
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10000")
+		_, _ = w.Write([]byte(bigBody))
+	}))
+	defer ts.Close()
+
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	proxy := NewHTTPProxy(newTestProxyConfig(port, 4096))
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "video-1"},
+		Method:   "GET",
+		Path:     "/video.mp4",
+		Headers:  map[string]string{},
+	}
+	w := &recordingWriter{}
+	if _, err := proxy.ExecuteStreaming(t.Context(), msg, nil, w); err != nil {
+		t.Fatalf("ExecuteStreaming returned error: %v", err)
+	}
+
+	resp := w.messages[0].(HTTPResponseMsg)
+	if resp.BodyLen != 10000 || !resp.BodyFollows {
+		t.Errorf("BodyLen=%d BodyFollows=%v, want 10000 true", resp.BodyLen, resp.BodyFollows)
+	}
+	wantSizes := []int{4096, 4096, 1808}
+	if len(w.bodies) != len(wantSizes) {
+		t.Fatalf("got %d chunks, want %d", len(w.bodies), len(wantSizes))
+	}
+	var assembled []byte
+	for i, chunk := range w.bodies {
+		if len(chunk) != wantSizes[i] {
+			t.Errorf("chunk %d is %d bytes, want %d", i, len(chunk), wantSizes[i])
+		}
+		assembled = append(assembled, chunk...)
+	}
+	if string(assembled) != bigBody {
+		t.Error("reassembled body does not match")
+	}
+	if _, ok := w.messages[len(w.messages)-1].(BodyEndMsg); !ok {
+		t.Errorf("expected BodyEndMsg last, got %T", w.messages[len(w.messages)-1])
+	}
+}
+
+// TestHTTPProxyHeadHasNoBody verifies a HEAD response is sent without a body
+// even though it carries the resource's Content-Length.
+func TestHTTPProxyHeadHasNoBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	proxy := NewHTTPProxy(newTestProxyConfig(port, 1048576))
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "head-1"},
+		Method:   "HEAD",
+		Path:     "/",
+		Headers:  map[string]string{},
+	}
+	w := &recordingWriter{}
+	if _, err := proxy.ExecuteStreaming(t.Context(), msg, nil, w); err != nil {
+		t.Fatalf("ExecuteStreaming returned error: %v", err)
+	}
+	if len(w.messages) != 1 {
+		t.Fatalf("expected only the response header, got %d messages", len(w.messages))
+	}
+	if resp := w.messages[0].(HTTPResponseMsg); resp.BodyFollows {
+		t.Error("expected BodyFollows=false for HEAD")
+	}
+}
+
+// TestHTTPProxyFallsBackToIPv6 verifies a dev server listening only on [::1]
+// is reached instead of answering port_unreachable.
+func TestHTTPProxyFallsBackToIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("vite"))
+	}))
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	proxy := NewHTTPProxy(newTestProxyConfig(port, 1048576))
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "v6-1"},
+		Method:   "GET",
+		Path:     "/",
+		Headers:  map[string]string{},
+	}
+	w := &recordingWriter{}
+	if _, err := proxy.ExecuteStreaming(t.Context(), msg, nil, w); err != nil {
+		t.Fatalf("ExecuteStreaming returned error: %v", err)
+	}
+	if resp := w.messages[0].(HTTPResponseMsg); resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if len(w.bodies) != 1 || string(w.bodies[0]) != "vite" {
+		t.Errorf("body = %q, want vite", w.bodies)
+	}
+}
+
+// TestHTTPProxyUnixSocketUpstream verifies a port configured with a Unix
+// socket upstream is proxied to that socket.
+func TestHTTPProxyUnixSocketUpstream(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen unix: %v", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("from socket " + r.URL.Path))
+	}))
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	cfg := newTestProxyConfig(3000, 1048576)
+	cfg.Upstreams = map[int]config.Upstream{3000: {Network: "unix", Address: sock}}
+	proxy := NewHTTPProxy(cfg)
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "unix-1"},
+		Method:   "GET",
+		Path:     "/app",
+		Headers:  map[string]string{},
+	}
+	w := &recordingWriter{}
+	if _, err := proxy.ExecuteStreaming(t.Context(), msg, nil, w); err != nil {
+		t.Fatalf("ExecuteStreaming returned error: %v", err)
+	}
+	if resp := w.messages[0].(HTTPResponseMsg); resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if len(w.bodies) != 1 || string(w.bodies[0]) != "from socket /app" {
+		t.Errorf("body = %q, want %q", w.bodies, "from socket /app")
+	}
+}
+
+// TestHTTPProxyWaitsForRestartingServer verifies a request that arrives while
+// the dev server is restarting is held until the port accepts, not answered
+// with a 502.
+func TestHTTPProxyWaitsForRestartingServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte("saved "), body...))
+	}))
+	defer ts.Close()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		restarted, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		ts.Listener = restarted
+		ts.Start()
+	}()
+
+	cfg := newTestProxyConfig(port, 1048576)
+	cfg.PortGrace = 5 * time.Second
+	proxy := NewHTTPProxy(cfg)
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "restart-1"},
+		Method:   "POST",
+		Path:     "/save",
+		Headers:  map[string]string{},
+	}
+	w := &recordingWriter{}
+	if _, err := proxy.ExecuteStreaming(t.Context(), msg, strings.NewReader("draft"), w); err != nil {
+		t.Fatalf("ExecuteStreaming returned error: %v", err)
+	}
+	if resp := w.messages[0].(HTTPResponseMsg); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if len(w.bodies) != 1 || string(w.bodies[0]) != "saved draft" {
+		t.Errorf("body = %q, want %q", w.bodies, "saved draft")
+	}
+}
+
+// TestHTTPProxy502AfterGrace verifies the 502 is sent once the grace period
+// runs out.
+func TestHTTPProxy502AfterGrace(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cfg := newTestProxyConfig(port, 1048576)
+	cfg.PortGrace = 200 * time.Millisecond
+	proxy := NewHTTPProxy(cfg)
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "restart-2"},
+		Method:   "GET",
+		Path:     "/",
+		Headers:  map[string]string{},
+	}
+	start := time.Now()
+	responses, err := proxy.Execute(t.Context(), msg, nil)
+	if err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	}
+	if resp := responses[0].(HTTPResponseMsg); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("502 after %v, before the grace period ran out", elapsed)
+	}
+}
+
+// BenchmarkHTTPProxyStreaming measures an SSE-style response written upstream
+// in 32 KB flushes and framed onto a discarded transport.
+func BenchmarkHTTPProxyStreaming(b *testing.B) {
+	const total = 4 * 1024 * 1024
+	chunk := bytes.Repeat([]byte("x"), 32*1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for sent := 0; sent < total; sent += len(chunk) {
+			_, _ = w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	proxy := NewHTTPProxy(newTestProxyConfig(port, 1048576))
+	writer := newWriteScheduler(transport.NewStdioTransportFromRW(nil, io.Discard))
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "stream-1"},
+		Method:   "GET",
+		Path:     "/events",
+		Headers:  map[string]string{"host": "localhost"},
+	}
+
+	b.SetBytes(total)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := proxy.ExecuteStreaming(b.Context(), msg, nil, writer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errTooManyStreams is reported when a stream would exceed the concurrency
+// limits.
+var errTooManyStreams = errors.New("too many concurrent streams")
+
+// Exec and file streams count against the limits like streams to a port,
+// each kind under its own key outside the port range.
+const (
+	execStreamKey = -1
+	fileStreamKey = -2
+)
+
+// streamLimiter bounds the streams open at once, in total and per port.
+type streamLimiter struct {
+	max     int // zero means no limit
+	perPort int // zero means no limit
+
+	mu    sync.Mutex
+	total int
+	ports map[int]int
+}
+
+func newStreamLimiter(max, perPort int) *streamLimiter {
+	return &streamLimiter{max: max, perPort: perPort, ports: make(map[int]int)}
+}
+
+// acquire reserves a stream to port, reporting false when a limit is
+// reached. Every successful acquire must be paired with a release.
+func (l *streamLimiter) acquire(port int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if (l.max > 0 && l.total >= l.max) || (l.perPort > 0 && l.ports[port] >= l.perPort) {
+		return false
+	}
+	l.total++
+	l.ports[port]++
+	return true
+}
+
+// release frees a stream reserved by acquire.
+func (l *streamLimiter) release(port int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.ports[port]--; l.ports[port] <= 0 {
+		delete(l.ports, port)
+	}
+}
+
+// idleTimer cancels a stream that carries no data for its timeout. It is
+// disarmed until the first touch. A nil *idleTimer never fires, so streams
+// without an idle timeout need no special casing.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   atomic.Bool
+}
+
+// newIdleTimer returns a timer that calls cancel once the stream has been
+// idle for timeout, or nil when timeout is not positive.
+func newIdleTimer(timeout time.Duration, cancel func()) *idleTimer {
+	if timeout <= 0 {
+		return nil
+	}
+	t := &idleTimer{timeout: timeout}
+	t.timer = time.AfterFunc(time.Hour, func() {
+		t.fired.Store(true)
+		cancel()
+	})
+	t.timer.Stop()
+	return t
+}
+
+// touch records activity on the stream, arming the timer if needed.
+func (t *idleTimer) touch() {
+	if t != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+// pause disarms the timer until the next touch, for phases bounded by
+// another timeout.
+func (t *idleTimer) pause() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// expired reports whether the timer cancelled the stream.
+func (t *idleTimer) expired() bool {
+	return t != nil && t.fired.Load()
+}
+
+// idleWriter touches an idle timer for every message written.
+type idleWriter struct {
+	ResponseWriter
+	idle *idleTimer
+}
+
+func (w *idleWriter) WriteJSON(v any) error {
+	w.idle.touch()
+	return w.ResponseWriter.WriteJSON(v)
+}
+
+func (w *idleWriter) WriteJSONThenBinary(envelope any, body []byte) error {
+	w.idle.touch()
+	return w.ResponseWriter.WriteJSONThenBinary(envelope, body)
+}
+
+// idleReader touches an idle timer while a request body is read from the
+// bridge, and pauses it at the end of the body: waiting for the response
+// headers is bounded by the proxy timeout instead.
+type idleReader struct {
+	r    io.Reader
+	idle *idleTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.idle.touch()
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.idle.pause()
+	} else {
+		r.idle.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamLimiter(t *testing.T) {
+	l := newStreamLimiter(3, 2)
+	for _, port := range []int{3000, 3000, 4000} {
+		if !l.acquire(port) {
+			t.Fatalf("acquire(%d) refused below the limits", port)
+		}
+	}
+	if l.acquire(4000) {
+		t.Error("acquire over the global limit succeeded")
+	}
+	l.release(4000)
+	if l.acquire(3000) {
+		t.Error("acquire over the per-port limit succeeded")
+	}
+	if !l.acquire(4000) {
+		t.Error("acquire refused after a release")
+	}
+
+	unlimited := newStreamLimiter(0, 0)
+	for range 100 {
+		if !unlimited.acquire(3000) {
+			t.Fatal("acquire refused without limits")
+		}
+	}
+}
+
+func TestIdleTimer(t *testing.T) {
+	if idle := newIdleTimer(0, func() {}); idle != nil {
+		t.Fatal("expected no timer without a timeout")
+	}
+
+	cancelled := make(chan struct{})
+	idle := newIdleTimer(50*time.Millisecond, func() { close(cancelled) })
+
+	// The timer stays disarmed until the first touch.
+	select {
+	case <-cancelled:
+		t.Fatal("timer fired before it was armed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Reading a body keeps it alive; its end pauses it.
+	r := &idleReader{r: newSlowReader(20 * time.Millisecond), idle: idle}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("timer fired while the body was being read or after its end")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if idle.expired() {
+		t.Fatal("expired() before the timer fired")
+	}
+
+	idle.touch()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("timer did not fire once idle")
+	}
+	if !idle.expired() {
+		t.Error("expired() = false after the timer fired")
+	}
+}
+
+// slowReader returns one byte per read, waiting before each.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func newSlowReader(delay time.Duration) io.Reader {
+	return &slowReader{r: strings.NewReader("abcdefgh"), delay: delay}
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p[:1])
+}
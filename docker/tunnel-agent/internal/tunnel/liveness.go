@@ -0,0 +1,167 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHeartbeatInterval is the heartbeat interval used when the config
+// does not set one.
+const DefaultHeartbeatInterval = 10 * time.Second
+
+// The heartbeat interval a bridge's hello may ask for is clamped to
+// [MinHeartbeatInterval, MaxHeartbeatInterval].
+const (
+	MinHeartbeatInterval = time.Second
+	MaxHeartbeatInterval = 5 * time.Minute
+)
+
+// ErrBridgeUnresponsive is returned by Agent.Run when a bridge that enabled
+// ping sends nothing for longer than the heartbeat timeout.
+var ErrBridgeUnresponsive = errors.New("bridge unresponsive")
+
+// liveness tracks when the bridge was last heard from and the round trip of
+// its answers to the agent's pings.
+type liveness struct {
+	interval atomic.Int64 // current heartbeat interval in nanoseconds
+	lastSeen atomic.Int64 // Unix nanoseconds of the last frame read
+	// reset wakes the heartbeat loop when the interval changes.
+	reset chan struct{}
+
+	mu     sync.Mutex
+	seq    uint64    // seq of the last ping sent
+	sentAt time.Time // when ping seq was sent
+	rtt    time.Duration
+	pongAt time.Time // when the last matching pong arrived
+}
+
+func newLiveness(interval time.Duration) *liveness {
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	l := &liveness{reset: make(chan struct{}, 1)}
+	l.interval.Store(int64(interval))
+	l.seen()
+	return l
+}
+
+// seen records that a frame arrived from the bridge.
+func (l *liveness) seen() {
+	l.lastSeen.Store(time.Now().UnixNano())
+}
+
+// silence returns how long since the bridge was last heard from.
+func (l *liveness) silence() time.Duration {
+	return time.Since(time.Unix(0, l.lastSeen.Load()))
+}
+
+// setInterval changes the heartbeat interval, clamped to the accepted range,
+// and returns the interval now in use.
+func (l *liveness) setInterval(d time.Duration) time.Duration {
+	d = min(max(d, MinHeartbeatInterval), MaxHeartbeatInterval)
+	l.interval.Store(int64(d))
+	select {
+	case l.reset <- struct{}{}:
+	default:
+	}
+	return d
+}
+
+// nextPing returns the seq of a new ping and records when it was sent.
+func (l *liveness) nextPing() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.sentAt = time.Now()
+	return l.seq
+}
+
+// pong records the answer to ping seq. Answers to older pings are ignored,
+// so a late pong does not shorten the measured round trip.
+func (l *liveness) pong(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seq != l.seq || l.sentAt.IsZero() {
+		return
+	}
+	l.pongAt = time.Now()
+	l.rtt = l.pongAt.Sub(l.sentAt)
+	l.sentAt = time.Time{}
+}
+
+// latency returns the last measured round trip and when it was measured, or
+// a zero time before the first pong.
+func (l *liveness) latency() (time.Duration, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rtt, l.pongAt
+}
+
+// BridgeLatency returns the round trip of the last ping the bridge answered
+// and when the answer arrived. The time is zero until the bridge enables ping
+// and answers one.
+func (a *Agent) BridgeLatency() (time.Duration, time.Time) {
+	return a.live.latency()
+}
+
+// heartbeatTimeout returns how long the bridge may stay silent before the
+// session is abandoned, or zero if it may stay silent forever. Without ping
+// the bridge has no reason to send anything, so silence means nothing.
+func (a *Agent) heartbeatTimeout() time.Duration {
+	if a.cfg.HeartbeatTimeout <= 0 || !a.features.Load().requested(CapPing) {
+		return 0
+	}
+	return max(a.cfg.HeartbeatTimeout, 2*time.Duration(a.live.interval.Load()))
+}
+
+// heartbeatLoop sends a heartbeat, or a ping once the bridge enables ping,
+// every heartbeat interval until ctx is cancelled.
+func (a *Agent) heartbeatLoop(ctx context.Context) {
+	timer := time.NewTimer(time.Duration(a.live.interval.Load()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.live.reset:
+		case <-timer.C:
+			var msg any = HeartbeatMsg{Envelope: Envelope{Type: MsgHeartbeat}}
+			if a.features.Load().requested(CapPing) {
+				msg = PingMsg{Envelope: Envelope{Type: MsgPing}, Seq: a.live.nextPing()}
+			}
+			if err := a.out.WriteJSON(msg); err != nil {
+				slog.Warn("heartbeat write failed", "error", err)
+				return
+			}
+		}
+		timer.Reset(time.Duration(a.live.interval.Load()))
+	}
+}
+
+// watchdog returns ErrBridgeUnresponsive once the bridge stays silent past
+// the heartbeat timeout, or nil when ctx is cancelled. It runs apart from
+// heartbeatLoop because a wedged bridge that stops reading blocks the
+// heartbeat writes too.
+func (a *Agent) watchdog(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Duration(a.live.interval.Load())):
+		}
+		timeout := a.heartbeatTimeout()
+		if timeout <= 0 {
+			continue
+		}
+		if silence := a.live.silence(); silence > timeout {
+			slog.Error("bridge stopped answering, closing all streams",
+				"silence", silence.Round(time.Millisecond), "timeout", timeout)
+			return ErrBridgeUnresponsive
+		}
+	}
+}
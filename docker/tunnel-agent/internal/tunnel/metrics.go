@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"docker-bridge-tunnel-agent/internal/metrics"
+)
+
+// Stream protocols used as the "protocol" label.
+const (
+	protoHTTP = "http"
+	protoWS   = "ws"
+	protoTCP  = "tcp"
+	protoExec = "exec"
+	protoFile = "file"
+)
+
+// Agent metrics, served on the health server's /metrics endpoint. "In" is
+// traffic from the bridge towards the dev server, "out" is traffic back to
+// the bridge.
+var (
+	requestsTotal = metrics.Default.NewCounterVec("tunnel_agent_http_requests_total",
+		"HTTP requests proxied, by port and response status class (2xx, 5xx, ...; \"error\" when no response was sent).",
+		"port", "code")
+	upstreamLatency = metrics.Default.NewHistogramVec("tunnel_agent_upstream_latency_seconds",
+		"Time from sending an HTTP request upstream to receiving its response headers.",
+		metrics.DefBuckets, "port")
+	bytesIn = metrics.Default.NewCounterVec("tunnel_agent_bytes_in_total",
+		"Body and frame payload bytes received from the bridge and written upstream.",
+		"port", "protocol")
+	bytesOut = metrics.Default.NewCounterVec("tunnel_agent_bytes_out_total",
+		"Body and frame payload bytes read from upstream and sent to the bridge.",
+		"port", "protocol")
+	activeStreams = metrics.Default.NewGaugeVec("tunnel_agent_active_streams",
+		"Streams currently open, by protocol.",
+		"protocol")
+	portUnreachableTotal = metrics.Default.NewCounterVec("tunnel_agent_port_unreachable_total",
+		"HTTP requests answered with a 502 port_unreachable because nothing was listening.",
+		"port")
+	wsDroppedFrames = metrics.Default.NewCounterVec("tunnel_agent_ws_dropped_frames_total",
+		"WebSocket frames from the bridge that could not be delivered, by reason.",
+		"reason")
+	streamsRejected = metrics.Default.NewCounterVec("tunnel_agent_streams_rejected_total",
+		"Streams refused because they would exceed the concurrency limits, by protocol.",
+		"protocol")
+	idleTimeouts = metrics.Default.NewCounterVec("tunnel_agent_idle_timeouts_total",
+		"Streams closed after carrying no data for the stream idle timeout, by protocol.",
+		"protocol")
+)
+
+// portLabel formats a port for use as a label value.
+func portLabel(port int) string {
+	return strconv.Itoa(port)
+}
+
+// statusClass returns the class label ("2xx", "4xx", ...) for an HTTP status.
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// countingBody counts the bytes read through a request body into a counter.
+type countingBody struct {
+	body    io.ReadCloser
+	counter *metrics.Counter
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if n > 0 {
+		c.counter.Add(float64(n))
+	}
+	return n, err
+}
+
+func (c *countingBody) Close() error {
+	return c.body.Close()
+}
+
+// dropReason returns the wsDroppedFrames reason label for a failed push.
+func dropReason(err error) string {
+	switch {
+	case errors.Is(err, errFlowControl):
+		return "flow_control"
+	case errors.Is(err, errInboundStalled):
+		return "stalled"
+	default:
+		return "closed"
+	}
+}
@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestHTTPProxyRecordsMetrics verifies a proxied request is counted by status
+// class and that its latency and body bytes in both directions are recorded.
+func TestHTTPProxyRecordsMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	}))
+	defer ts.Close()
+
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	label := portLabel(port)
+	proxy := NewHTTPProxy(newTestProxyConfig(port, 1048576))
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "metrics-1"},
+		Method:   "POST",
+		Path:     "/items",
+		Headers:  map[string]string{},
+	}
+	if _, err := proxy.ExecuteStreaming(t.Context(), msg, strings.NewReader("payload"), &recordingWriter{}); err != nil {
+		t.Fatalf("ExecuteStreaming returned error: %v", err)
+	}
+
+	if got := requestsTotal.WithLabelValues(label, "2xx").Value(); got != 1 {
+		t.Errorf("requests_total{code=2xx} = %v, want 1", got)
+	}
+	if got := upstreamLatency.WithLabelValues(label).Count(); got != 1 {
+		t.Errorf("upstream_latency count = %d, want 1", got)
+	}
+	if got := bytesIn.WithLabelValues(label, protoHTTP).Value(); got != float64(len("payload")) {
+		t.Errorf("bytes_in = %v, want %d", got, len("payload"))
+	}
+	if got := bytesOut.WithLabelValues(label, protoHTTP).Value(); got != float64(len("created")) {
+		t.Errorf("bytes_out = %v, want %d", got, len("created"))
+	}
+}
+
+// TestHTTPProxyCountsUnreachablePort verifies a 502 for a closed port is
+// counted as port_unreachable and as a 5xx response.
+func TestHTTPProxyCountsUnreachablePort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	label := portLabel(port)
+	proxy := NewHTTPProxy(newTestProxyConfig(port, 1048576))
+
+	msg := HTTPRequestMsg{
+		Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "metrics-502"},
+		Method:   "GET",
+		Path:     "/",
+		Headers:  map[string]string{},
+	}
+	if _, err := proxy.ExecuteStreaming(t.Context(), msg, nil, &recordingWriter{}); err != nil {
+		t.Fatalf("ExecuteStreaming returned error: %v", err)
+	}
+
+	if got := portUnreachableTotal.WithLabelValues(label).Value(); got != 1 {
+		t.Errorf("port_unreachable_total = %v, want 1", got)
+	}
+	if got := requestsTotal.WithLabelValues(label, "5xx").Value(); got != 1 {
+		t.Errorf("requests_total{code=5xx} = %v, want 1", got)
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{200, "2xx"},
+		{304, "3xx"},
+		{404, "4xx"},
+		{502, "5xx"},
+		{0, "other"},
+		{700, "other"},
+	}
+	for _, tc := range tests {
+		if got := statusClass(tc.code); got != tc.want {
+			t.Errorf("statusClass(%d) = %q, want %q", tc.code, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ProtocolVersion is the newest tunnel protocol version the agent speaks.
+// Version 1 is the original protocol, without negotiation.
+const ProtocolVersion = 2
+
+// MinProtocolVersion is the oldest protocol version the agent still speaks.
+const MinProtocolVersion = 1
+
+// AgentVersion identifies the agent build. It is set at build time with
+// -ldflags "-X docker-bridge-tunnel-agent/internal/tunnel.AgentVersion=...".
+var AgentVersion = "dev"
+
+// ErrIncompatiblePeer is returned by Agent.Run when the bridge's hello names
+// no protocol version the agent speaks.
+var ErrIncompatiblePeer = errors.New("incompatible bridge protocol")
+
+// ErrUnauthenticated is returned by Agent.Run when the agent requires
+// authentication and the bridge's first message is not a hello presenting the
+// shared secret.
+var ErrUnauthenticated = errors.New("bridge not authenticated")
+
+// Capability names an optional protocol feature.
+type Capability string
+
+const (
+	// CapMultiPort routes streams to any allowed port via the port field.
+	CapMultiPort Capability = "multi_port"
+	// CapMultiHeaders carries every value of repeated headers.
+	CapMultiHeaders Capability = "multi_headers"
+	// CapRequestBodyStream sends request bodies as body_chunk frames.
+	CapRequestBodyStream Capability = "request_body_stream"
+	// CapFlowControl enables per-stream windows and window_update.
+	CapFlowControl Capability = "flow_control"
+	// CapWSMessageTypes preserves WebSocket text/binary message types,
+	// close status and the selected subprotocol.
+	CapWSMessageTypes Capability = "ws_message_types"
+	// CapTCPStreams tunnels raw TCP streams via tcp_connect and tcp_data.
+	CapTCPStreams Capability = "tcp_streams"
+	// CapTrailers reports response trailers in body_end.
+	CapTrailers Capability = "trailers"
+	// CapPortStatus reports upstream port state changes via port_status. It
+	// is only sent to bridges whose hello asks for it.
+	CapPortStatus Capability = "port_status"
+	// CapPortDiscovery announces discovered ports via port_opened and
+	// port_closed. They are only sent to bridges whose hello asks for them.
+	CapPortDiscovery Capability = "port_discovery"
+	// CapMsgpack switches envelopes to MessagePack, each carried in one frame
+	// together with its payload.
+	CapMsgpack Capability = "msgpack"
+	// CapCompressGzip gzips large body_chunk and ws_data payloads sent by
+	// the agent, marking them with a compression field.
+	CapCompressGzip Capability = "compress_gzip"
+	// CapExec runs allow-listed commands, optionally on a pseudo-terminal,
+	// via exec_start and exec_data.
+	CapExec Capability = "exec"
+	// CapFiles reads, writes and lists files below the agent's file roots
+	// via file_read, file_write and file_list.
+	CapFiles Capability = "files"
+	// CapPing replaces heartbeats with pings the bridge must answer, so the
+	// agent can measure the round trip and give up on a bridge that stops
+	// answering.
+	CapPing Capability = "ping"
+	// CapProtocolErrors reports frames and messages the agent cannot
+	// process via protocol_error. It is only sent to bridges whose hello
+	// asks for it; other bridges' unknown message types are skipped.
+	CapProtocolErrors Capability = "protocol_errors"
+)
+
+// supportedCapabilities lists every capability this agent implements, in the
+// order advertised in ready.
+var supportedCapabilities = []Capability{
+	CapMultiPort,
+	CapMultiHeaders,
+	CapRequestBodyStream,
+	CapFlowControl,
+	CapWSMessageTypes,
+	CapTCPStreams,
+	CapTrailers,
+	CapPortStatus,
+	CapPortDiscovery,
+	CapMsgpack,
+	CapCompressGzip,
+	CapExec,
+	CapFiles,
+	CapPing,
+	CapProtocolErrors,
+}
+
+// Capabilities returns the capabilities this agent supports.
+func Capabilities() []Capability {
+	return slices.Clone(supportedCapabilities)
+}
+
+// featureSet is the set of capabilities enabled by the bridge's hello. A nil
+// *featureSet means no hello was received and every capability is available.
+type featureSet struct {
+	enabled map[Capability]bool
+}
+
+// has reports whether capability c is enabled.
+func (f *featureSet) has(c Capability) bool {
+	return f == nil || f.enabled[c]
+}
+
+// requested reports whether the bridge's hello asked for capability c. Unlike
+// has it is false without a hello, for features that change what the agent
+// sends unprompted and that a bridge predating them could not decode.
+func (f *featureSet) requested(c Capability) bool {
+	return f != nil && f.enabled[c]
+}
+
+// list returns the enabled capabilities in advertised order.
+func (f *featureSet) list() []Capability {
+	var caps []Capability
+	for _, c := range supportedCapabilities {
+		if f.has(c) {
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// negotiate checks a hello against the versions the agent speaks and returns
+// the protocol version to use and the features to enable. Capabilities the
+// agent does not know are left disabled.
+func negotiate(hello HelloMsg) (int, *featureSet, error) {
+	bridgeMin := hello.MinProtocolVersion
+	if bridgeMin == 0 {
+		bridgeMin = hello.ProtocolVersion
+	}
+	version := min(hello.ProtocolVersion, ProtocolVersion)
+	if version < max(bridgeMin, MinProtocolVersion) {
+		return 0, nil, fmt.Errorf("%w: bridge speaks versions %d-%d, agent speaks %d-%d",
+			ErrIncompatiblePeer, bridgeMin, hello.ProtocolVersion, MinProtocolVersion, ProtocolVersion)
+	}
+
+	features := &featureSet{enabled: make(map[Capability]bool)}
+	for _, c := range hello.Capabilities {
+		if slices.Contains(supportedCapabilities, c) {
+			features.enabled[c] = true
+		}
+	}
+	return version, features, nil
+}
+
+// restrictHTTPRequest clears the fields of msg that belong to disabled
+// features, so the request is handled as protocol version 1 would handle it.
+func (f *featureSet) restrictHTTPRequest(msg *HTTPRequestMsg) {
+	if !f.has(CapMultiPort) {
+		msg.Port = 0
+	}
+	if !f.has(CapMultiHeaders) {
+		msg.MultiHeaders = nil
+	}
+	if !f.has(CapRequestBodyStream) {
+		msg.BodyStream = false
+	}
+	if !f.has(CapFlowControl) {
+		msg.Window = 0
+	}
+}
+
+// restrictWSUpgrade is the ws_upgrade counterpart of restrictHTTPRequest.
+func (f *featureSet) restrictWSUpgrade(msg *WSUpgradeMsg) {
+	if !f.has(CapMultiPort) {
+		msg.Port = 0
+	}
+	if !f.has(CapMultiHeaders) {
+		msg.MultiHeaders = nil
+	}
+	if !f.has(CapFlowControl) {
+		msg.Window = 0
+	}
+}
+
+// restrictTCPConnect is the tcp_connect counterpart of restrictHTTPRequest.
+func (f *featureSet) restrictTCPConnect(msg *TCPConnectMsg) {
+	if !f.has(CapMultiPort) {
+		msg.Port = 0
+	}
+	if !f.has(CapFlowControl) {
+		msg.Window = 0
+	}
+}
+
+// restrictExecStart is the exec_start counterpart of restrictHTTPRequest.
+func (f *featureSet) restrictExecStart(msg *ExecStartMsg) {
+	if !f.has(CapFlowControl) {
+		msg.Window = 0
+	}
+}
+
+// restrictFileRequest is the file request counterpart of restrictHTTPRequest.
+func (f *featureSet) restrictFileRequest(msg *FileRequestMsg) {
+	if !f.has(CapFlowControl) {
+		msg.Window = 0
+	}
+}
+
+// restrictWSData drops the message type when ws_message_types is disabled.
+func (f *featureSet) restrictWSData(msg *WSDataMsg) {
+	if !f.has(CapWSMessageTypes) {
+		msg.Opcode = ""
+	}
+}
+
+// restrictStreamClose drops the close status when ws_message_types is disabled.
+func (f *featureSet) restrictStreamClose(msg *StreamCloseMsg) {
+	if !f.has(CapWSMessageTypes) {
+		msg.CloseCode = 0
+		msg.CloseReason = ""
+	}
+}
@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name        string
+		hello       HelloMsg
+		wantVersion int
+		wantCaps    []Capability
+		wantErr     bool
+	}{
+		{
+			name:        "same version",
+			hello:       HelloMsg{ProtocolVersion: ProtocolVersion, Capabilities: []Capability{CapMultiPort, CapFlowControl}},
+			wantVersion: ProtocolVersion,
+			wantCaps:    []Capability{CapMultiPort, CapFlowControl},
+		},
+		{
+			name:        "newer bridge falls back to agent version",
+			hello:       HelloMsg{ProtocolVersion: ProtocolVersion + 3, MinProtocolVersion: 1, Capabilities: []Capability{CapMultiHeaders}},
+			wantVersion: ProtocolVersion,
+			wantCaps:    []Capability{CapMultiHeaders},
+		},
+		{
+			name:        "unknown capabilities stay disabled",
+			hello:       HelloMsg{ProtocolVersion: ProtocolVersion, Capabilities: []Capability{"teleport", CapMultiPort}},
+			wantVersion: ProtocolVersion,
+			wantCaps:    []Capability{CapMultiPort},
+		},
+		{
+			name:    "bridge requires newer version",
+			hello:   HelloMsg{ProtocolVersion: ProtocolVersion + 2, MinProtocolVersion: ProtocolVersion + 1},
+			wantErr: true,
+		},
+		{
+			name:    "bridge too old",
+			hello:   HelloMsg{ProtocolVersion: MinProtocolVersion - 1},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, features, err := negotiate(tt.hello)
+			if tt.wantErr {
+				if !errors.Is(err, ErrIncompatiblePeer) {
+					t.Fatalf("expected ErrIncompatiblePeer, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("version = %d, want %d", version, tt.wantVersion)
+			}
+			if got := features.list(); !slices.Equal(got, tt.wantCaps) {
+				t.Errorf("capabilities = %v, want %v", got, tt.wantCaps)
+			}
+		})
+	}
+}
+
+func TestFeatureSetRestrictsDisabledFields(t *testing.T) {
+	features := &featureSet{enabled: map[Capability]bool{CapMultiPort: true}}
+	msg := HTTPRequestMsg{
+		Port:         3001,
+		MultiHeaders: map[string][]string{"Accept": {"a", "b"}},
+		BodyStream:   true,
+		Window:       1024,
+	}
+	features.restrictHTTPRequest(&msg)
+	if msg.Port != 3001 {
+		t.Errorf("port = %d, want 3001", msg.Port)
+	}
+	if msg.MultiHeaders != nil || msg.BodyStream || msg.Window != 0 {
+		t.Errorf("disabled fields were kept: %+v", msg)
+	}
+
+	var none *featureSet
+	msg = HTTPRequestMsg{Port: 3001, Window: 1024}
+	none.restrictHTTPRequest(&msg)
+	if msg.Port != 3001 || msg.Window != 1024 {
+		t.Errorf("without a hello every feature should stay enabled: %+v", msg)
+	}
+}
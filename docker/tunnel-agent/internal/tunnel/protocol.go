@@ -1,19 +1,41 @@
 package tunnel
 
+import "docker-bridge-tunnel-agent/internal/probe"
+
 // MessageType identifies the kind of message in the tunnel protocol.
 type MessageType string
 
 const (
-	MsgHTTPRequest  MessageType = "http_request"
-	MsgHTTPResponse MessageType = "http_response"
-	MsgWSUpgrade    MessageType = "ws_upgrade"
-	MsgWSUpgradeAck MessageType = "ws_upgrade_ack"
-	MsgWSData       MessageType = "ws_data"
-	MsgStreamClose  MessageType = "stream_close"
-	MsgBodyChunk    MessageType = "body_chunk"
-	MsgBodyEnd      MessageType = "body_end"
-	MsgReady        MessageType = "ready"
-	MsgHeartbeat    MessageType = "heartbeat"
+	MsgHTTPRequest   MessageType = "http_request"
+	MsgHTTPResponse  MessageType = "http_response"
+	MsgWSUpgrade     MessageType = "ws_upgrade"
+	MsgWSUpgradeAck  MessageType = "ws_upgrade_ack"
+	MsgWSData        MessageType = "ws_data"
+	MsgStreamClose   MessageType = "stream_close"
+	MsgBodyChunk     MessageType = "body_chunk"
+	MsgBodyEnd       MessageType = "body_end"
+	MsgReady         MessageType = "ready"
+	MsgHello         MessageType = "hello"
+	MsgHelloAck      MessageType = "hello_ack"
+	MsgHeartbeat     MessageType = "heartbeat"
+	MsgPing          MessageType = "ping"
+	MsgPong          MessageType = "pong"
+	MsgProtocolError MessageType = "protocol_error"
+	MsgWindowUpdate  MessageType = "window_update"
+	MsgTCPConnect    MessageType = "tcp_connect"
+	MsgTCPConnectAck MessageType = "tcp_connect_ack"
+	MsgTCPData       MessageType = "tcp_data"
+	MsgPortStatus    MessageType = "port_status"
+	MsgPortOpened    MessageType = "port_opened"
+	MsgPortClosed    MessageType = "port_closed"
+	MsgExecStart     MessageType = "exec_start"
+	MsgExecStartAck  MessageType = "exec_start_ack"
+	MsgExecData      MessageType = "exec_data"
+	MsgExecResize    MessageType = "exec_resize"
+	MsgFileRead      MessageType = "file_read"
+	MsgFileWrite     MessageType = "file_write"
+	MsgFileList      MessageType = "file_list"
+	MsgFileResult    MessageType = "file_result"
 )
 
 // Envelope is the base type embedded in all protocol messages.
@@ -24,73 +46,393 @@ type Envelope struct {
 }
 
 // HTTPRequestMsg is sent from the bridge to the agent to proxy an HTTP request
-// to a local dev server port.
+// to a local dev server port. Port selects one of the agent's configured ports;
+// when omitted the first configured port is used.
+//
+// Headers carries one value per name. A bridge that sends MultiHeaders (even
+// an empty object) opts in to multi-value headers: MultiHeaders replaces
+// Headers for the upstream request, and the response carries MultiHeaders too.
+//
+// The request body is sent one of two ways. With BodyFollows, the next frame
+// is a single BINARY frame holding the whole body. With BodyStream, the body
+// follows as BodyChunkMsg frames (each followed by a BINARY frame) terminated
+// by a BodyEndMsg, all on the request's stream ID; BodyLen may announce the
+// total length when it is known.
+//
+// A non-zero Window enables flow control for the stream: it is the number of
+// response body bytes the agent may send before waiting for a WindowUpdateMsg,
+// and the bridge in turn keeps streamed request body bytes within the window
+// advertised in ReadyMsg.
 type HTTPRequestMsg struct {
 	Envelope
-	Method      string            `json:"method"`
-	Path        string            `json:"path"`
-	Headers     map[string]string `json:"headers"`
-	BodyLen     int64             `json:"body_len,omitempty"`
-	BodyFollows bool              `json:"body_follows,omitempty"`
+	Port         int                 `json:"port,omitempty"`
+	Method       string              `json:"method"`
+	Path         string              `json:"path"`
+	Headers      map[string]string   `json:"headers"`
+	MultiHeaders map[string][]string `json:"multi_headers,omitempty"`
+	BodyLen      int64               `json:"body_len,omitempty"`
+	BodyFollows  bool                `json:"body_follows,omitempty"`
+	BodyStream   bool                `json:"body_stream,omitempty"`
+	Window       int64               `json:"window,omitempty"`
 }
 
 // HTTPResponseMsg is sent from the agent to the bridge with the proxied response.
+// Headers always holds the first value of each header; MultiHeaders holds every
+// value in order and is only set when the request opted in. TrailerNames lists
+// the trailers the upstream announced; their values arrive in BodyEndMsg.
 type HTTPResponseMsg struct {
 	Envelope
-	StatusCode  int               `json:"status_code"`
-	Headers     map[string]string `json:"headers"`
-	BodyLen     int64             `json:"body_len,omitempty"`
-	BodyFollows bool              `json:"body_follows,omitempty"`
+	StatusCode   int                 `json:"status_code"`
+	Headers      map[string]string   `json:"headers"`
+	MultiHeaders map[string][]string `json:"multi_headers,omitempty"`
+	TrailerNames []string            `json:"trailer_names,omitempty"`
+	BodyLen      int64               `json:"body_len,omitempty"`
+	BodyFollows  bool                `json:"body_follows,omitempty"`
 }
 
 // WSUpgradeMsg is sent from the bridge to the agent to request a WebSocket upgrade
-// to a local service.
+// to a local service. Port, MultiHeaders and Window follow the same rules as
+// the matching HTTPRequestMsg fields, with Window applying to ws_data payloads.
 type WSUpgradeMsg struct {
 	Envelope
-	Path    string            `json:"path"`
-	Headers map[string]string `json:"headers"`
+	Port         int                 `json:"port,omitempty"`
+	Path         string              `json:"path"`
+	Headers      map[string]string   `json:"headers"`
+	MultiHeaders map[string][]string `json:"multi_headers,omitempty"`
+	Window       int64               `json:"window,omitempty"`
 }
 
 // WSUpgradeAckMsg is sent from the agent to the bridge to confirm or reject a
-// WebSocket upgrade request.
+// WebSocket upgrade request. Subprotocol is the subprotocol the local server
+// selected, if any. MultiHeaders carries the upstream handshake response
+// headers when the upgrade request opted in to multi-value headers.
 type WSUpgradeAckMsg struct {
 	Envelope
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
+	Success      bool                `json:"success"`
+	Error        string              `json:"error,omitempty"`
+	Subprotocol  string              `json:"subprotocol,omitempty"`
+	MultiHeaders map[string][]string `json:"multi_headers,omitempty"`
 }
 
+// WSOpcode identifies the WebSocket message type carried by a WSDataMsg.
+type WSOpcode string
+
+const (
+	WSOpcodeText   WSOpcode = "text"
+	WSOpcodeBinary WSOpcode = "binary"
+)
+
 // WSDataMsg is sent in both directions to carry WebSocket frame data.
 // When BodyFollows is true, the next frame from the transport is a BINARY frame with data.
+// Opcode is the WebSocket message type; when omitted the message is binary.
+// Compression names the encoding of the data, as on BodyChunkMsg.
 type WSDataMsg struct {
 	Envelope
-	BodyFollows bool `json:"body_follows"`
+	BodyFollows bool     `json:"body_follows"`
+	Opcode      WSOpcode `json:"opcode,omitempty"`
+	Compression string   `json:"compression,omitempty"`
 }
 
-// StreamCloseMsg is sent to signal that a stream has ended.
+// StreamCloseMsg is sent to signal that a stream has ended. Reason describes
+// why the agent ended the stream. For WebSocket streams, CloseCode and
+// CloseReason carry the close status and reason in either direction: the
+// agent reports what the local server sent, and closes the local connection
+// with the status the bridge sends.
+//
+// For TCP streams, HalfClose means the sender has finished sending but still
+// reads, like a TCP FIN: the stream stays open until both sides half-close or
+// either side sends a stream_close without HalfClose.
+//
+// For exec streams, a HalfClose from the bridge ends the command's input, and
+// the agent's final stream_close reports how the command ended: ExitCode when
+// it exited, ExitSignal when a signal killed it.
 type StreamCloseMsg struct {
 	Envelope
-	Reason string `json:"reason,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	CloseCode   int    `json:"close_code,omitempty"`
+	CloseReason string `json:"close_reason,omitempty"`
+	HalfClose   bool   `json:"half_close,omitempty"`
+	ExitCode    *int   `json:"exit_code,omitempty"`
+	ExitSignal  int    `json:"exit_signal,omitempty"`
+}
+
+// TCPConnectMsg is sent from the bridge to the agent to open a raw TCP stream
+// to a local port, for services such as databases that do not speak HTTP.
+// Port and Window follow the same rules as the matching HTTPRequestMsg
+// fields, with Window applying to tcp_data payloads.
+type TCPConnectMsg struct {
+	Envelope
+	Port   int   `json:"port,omitempty"`
+	Window int64 `json:"window,omitempty"`
+}
+
+// TCPConnectAckMsg is sent from the agent to the bridge to confirm or reject
+// a TCP stream.
+type TCPConnectAckMsg struct {
+	Envelope
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// TCPDataMsg is sent in both directions to carry bytes on a TCP stream.
+// The bytes travel in the BINARY frame that follows.
+type TCPDataMsg struct {
+	Envelope
+	BodyFollows bool `json:"body_follows"`
+}
+
+// ExecStartMsg is sent from the bridge to the agent to run a command, such as
+// a shell, in the container. Command is the program and its arguments; the
+// program must be in the agent's exec allow-list. Env adds "KEY=value"
+// entries to the agent's environment; loader and shell startup variables such
+// as LD_PRELOAD, PATH and BASH_ENV are refused. Dir sets the working
+// directory and must lie within the agent's file roots.
+//
+// With TTY the command runs on a pseudo-terminal of Cols by Rows characters:
+// its output arrives as a single stream and the terminal can be resized with
+// ExecResizeMsg. Without TTY, standard output and error are kept apart.
+// Window follows the same rules as the matching HTTPRequestMsg field, with
+// Window applying to exec_data payloads.
+type ExecStartMsg struct {
+	Envelope
+	Command []string `json:"command"`
+	Env     []string `json:"env,omitempty"`
+	Dir     string   `json:"dir,omitempty"`
+	TTY     bool     `json:"tty,omitempty"`
+	Cols    int      `json:"cols,omitempty"`
+	Rows    int      `json:"rows,omitempty"`
+	Window  int64    `json:"window,omitempty"`
+}
+
+// ExecStartAckMsg is sent from the agent to the bridge to confirm that a
+// command started, or to report why it did not.
+type ExecStartAckMsg struct {
+	Envelope
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ExecDataMsg carries a command's standard streams, in the BINARY frame that
+// follows. FD is the stream: 0 (stdin) from the bridge, 1 (stdout) or 2
+// (stderr) from the agent. A command on a TTY only has output on FD 1.
+type ExecDataMsg struct {
+	Envelope
+	BodyFollows bool `json:"body_follows"`
+	FD          int  `json:"fd,omitempty"`
+}
+
+// ExecResizeMsg is sent from the bridge to the agent to change the terminal
+// size of a command started with TTY.
+type ExecResizeMsg struct {
+	Envelope
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+}
+
+// FileRequestMsg is sent from the bridge to the agent, as file_read,
+// file_write or file_list, to transfer a file or list a directory. Path is
+// absolute and must lie inside one of the agent's file roots once symlinks
+// are resolved. Each request is answered with a FileResultMsg:
+//
+//   - file_read: the result describes the file, then its content follows as
+//     BodyChunkMsg frames and a BodyEndMsg, as for an http_response
+//   - file_write: the content follows from the bridge as BodyChunkMsg frames
+//     and a BodyEndMsg, as for an http_request with body_stream. It goes to a
+//     temporary file that is renamed over Path once complete, so readers never
+//     see a partial file; the result is sent after the rename. Mode sets the
+//     permissions of the file (0644 when omitted), whose directory must exist
+//   - file_list: the result lists the directory's entries
+//
+// Window follows the same rules as the matching HTTPRequestMsg field.
+type FileRequestMsg struct {
+	Envelope
+	Path   string `json:"path"`
+	Mode   uint32 `json:"mode,omitempty"`
+	Window int64  `json:"window,omitempty"`
+}
+
+// FileResultMsg is sent from the agent to the bridge to answer a
+// FileRequestMsg. Info describes the file read or written, or the directory
+// listed, and Entries holds the directory's entries. Truncated is set when
+// the directory has more entries than a listing returns.
+type FileResultMsg struct {
+	Envelope
+	Success   bool       `json:"success"`
+	Error     string     `json:"error,omitempty"`
+	Info      *FileInfo  `json:"info,omitempty"`
+	Entries   []FileInfo `json:"entries,omitempty"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+// FileInfo describes a file. Type is "file", "dir", "symlink" or "other";
+// Mode holds the permission bits and ModTime is in Unix milliseconds.
+type FileInfo struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	Mode    uint32 `json:"mode"`
+	ModTime int64  `json:"mod_time"`
 }
 
-// BodyChunkMsg carries a chunk of a large response body.
-// Used when the body exceeds MaxBodyChunkSize and must be split across
-// multiple messages.
+// BodyChunkMsg carries a chunk of a body. The agent uses it for response
+// bodies; the bridge uses it for request bodies sent with body_stream.
+// The chunk data always travels in the BINARY frame that follows.
+//
+// When the compress_gzip capability is enabled, Compression is "gzip" on the
+// agent's chunks whose data is a gzip stream of its own; the bridge inflates
+// each such chunk separately. BodyLen counts the inflated bytes, while flow
+// control windows count the bytes as sent.
 type BodyChunkMsg struct {
 	Envelope
-	Data []byte `json:"-"` // Sent as separate BINARY frame, excluded from JSON envelope
+	Data        []byte `json:"-"` // Sent as separate BINARY frame, excluded from JSON envelope
+	Compression string `json:"compression,omitempty"`
 }
 
-// BodyEndMsg signals the end of a chunked body sequence.
+// BodyEndMsg signals the end of a chunked body sequence in either direction.
+// On responses, Trailers carries the upstream response trailers (such as
+// grpc-status and grpc-message), every value in order.
 type BodyEndMsg struct {
 	Envelope
+	Trailers map[string][]string `json:"trailers,omitempty"`
 }
 
-// ReadyMsg is sent by the agent on startup to signal readiness.
+// ReadyMsg is sent by the agent on startup to signal readiness. Window is the
+// agent's initial receive window for each flow-controlled stream: the number
+// of body_chunk or ws_data payload bytes the bridge may send on a stream
+// before waiting for a WindowUpdateMsg.
+//
+// ProtocolVersion and MinProtocolVersion bound the protocol versions the agent
+// speaks, and Capabilities lists the optional features it supports.
+// HeartbeatInterval is the agent's default heartbeat interval in
+// milliseconds, which a hello may change. Bridges that predate negotiation
+// ignore these fields.
 type ReadyMsg struct {
 	Envelope
+	Window             int64        `json:"window,omitempty"`
+	ProtocolVersion    int          `json:"protocol_version,omitempty"`
+	MinProtocolVersion int          `json:"min_protocol_version,omitempty"`
+	AgentVersion       string       `json:"agent_version,omitempty"`
+	Capabilities       []Capability `json:"capabilities,omitempty"`
+	HeartbeatInterval  int64        `json:"heartbeat_interval_ms,omitempty"`
+}
+
+// HelloMsg is optionally sent by the bridge as its first message after ready.
+// It states the protocol versions the bridge speaks and the capabilities it
+// wants enabled. Without a hello every capability the agent advertises stays
+// available, each one opted in to per message as before.
+//
+// HeartbeatInterval, in milliseconds, asks the agent to send its heartbeats
+// or pings at that interval instead of the one advertised in ReadyMsg. It is
+// clamped to the range the agent accepts.
+//
+// An agent listening on a socket requires a hello carrying AuthToken, the
+// shared secret it was configured with, before anything else.
+type HelloMsg struct {
+	Envelope
+	ProtocolVersion    int          `json:"protocol_version"`
+	MinProtocolVersion int          `json:"min_protocol_version,omitempty"`
+	BridgeVersion      string       `json:"bridge_version,omitempty"`
+	Capabilities       []Capability `json:"capabilities"`
+	HeartbeatInterval  int64        `json:"heartbeat_interval_ms,omitempty"`
+	AuthToken          string       `json:"auth_token,omitempty"`
+}
+
+// HelloAckMsg answers a HelloMsg. On success ProtocolVersion is the version in
+// use and Capabilities lists the features enabled: those both sides support.
+// HeartbeatInterval is the heartbeat interval in use, in milliseconds.
+// On failure Error explains the mismatch and the agent exits.
+type HelloAckMsg struct {
+	Envelope
+	Success           bool         `json:"success"`
+	Error             string       `json:"error,omitempty"`
+	ProtocolVersion   int          `json:"protocol_version,omitempty"`
+	Capabilities      []Capability `json:"capabilities,omitempty"`
+	HeartbeatInterval int64        `json:"heartbeat_interval_ms,omitempty"`
+}
+
+// WindowUpdateMsg grants the receiver Increment more bytes of send window on
+// a flow-controlled stream. Both sides send it as they consume stream data.
+type WindowUpdateMsg struct {
+	Envelope
+	Increment int64 `json:"increment"`
+}
+
+// PortStatusMsg is sent by the agent when background probing sees a port
+// change state, and once per probed port when the bridge's hello enables
+// port_status. Status is
+// "up" when something accepts connections on the port and "down" otherwise;
+// Error is the last dial error of a port that is down.
+type PortStatusMsg struct {
+	Envelope
+	Port   int          `json:"port"`
+	Status probe.Status `json:"status"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// PortOpenedMsg is sent by the agent when port discovery finds a new port
+// listening inside the container, and once per discovered port when the
+// bridge's hello enables port_discovery. Routable reports whether the bridge may send streams to it.
+type PortOpenedMsg struct {
+	Envelope
+	Port     int  `json:"port"`
+	Routable bool `json:"routable"`
+}
+
+// PortClosedMsg is sent by the agent when a port announced by PortOpenedMsg
+// stops listening. It is no longer routable.
+type PortClosedMsg struct {
+	Envelope
+	Port int `json:"port"`
 }
 
 // HeartbeatMsg is sent periodically by the agent to confirm liveness.
 type HeartbeatMsg struct {
 	Envelope
 }
+
+// PingMsg asks the peer to answer with a PongMsg carrying the same Seq. Once
+// the bridge enables ping the agent sends one every heartbeat interval in
+// place of a heartbeat, measuring the round trip from the pong. The agent
+// answers pings from the bridge whether or not ping is enabled.
+type PingMsg struct {
+	Envelope
+	Seq uint64 `json:"seq"`
+}
+
+// PongMsg answers a PingMsg, echoing its Seq.
+type PongMsg struct {
+	Envelope
+	Seq uint64 `json:"seq"`
+}
+
+// ProtocolErrorCode classifies a fault reported by ProtocolErrorMsg.
+type ProtocolErrorCode string
+
+const (
+	// ProtocolErrMalformedEnvelope: a TEXT or FrameMsgpack frame whose
+	// envelope could not be decoded.
+	ProtocolErrMalformedEnvelope ProtocolErrorCode = "malformed_envelope"
+	// ProtocolErrMalformedMessage: a message of a known type whose fields
+	// could not be decoded.
+	ProtocolErrMalformedMessage ProtocolErrorCode = "malformed_message"
+	// ProtocolErrUnknownType: a message of a type the agent does not know.
+	ProtocolErrUnknownType ProtocolErrorCode = "unknown_message_type"
+	// ProtocolErrUnexpectedBinary: a BINARY frame that follows no message
+	// announcing a payload.
+	ProtocolErrUnexpectedBinary ProtocolErrorCode = "unexpected_binary"
+	// ProtocolErrMissingPayload: a message announcing a payload that was
+	// followed by a frame other than BINARY.
+	ProtocolErrMissingPayload ProtocolErrorCode = "missing_payload"
+	// ProtocolErrUnknownFrame: a frame of a type the agent does not know.
+	ProtocolErrUnknownFrame ProtocolErrorCode = "unknown_frame_type"
+)
+
+// ProtocolErrorMsg is sent by the agent when a bridge that enabled
+// protocol_errors sends something it cannot process. StreamID names the stream the fault belongs to, when known;
+// that stream is then closed with a stream_close with reason protocol_error.
+// Description explains the fault for logs.
+type ProtocolErrorMsg struct {
+	Envelope
+	Code        ProtocolErrorCode `json:"code"`
+	Description string            `json:"description"`
+}
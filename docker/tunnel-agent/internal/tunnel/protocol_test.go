@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"testing"
 
+	"docker-bridge-tunnel-agent/internal/transport"
 	"docker-bridge-tunnel-agent/internal/tunnel"
 )
 
@@ -275,3 +277,17 @@ func TestStreamRegistry(t *testing.T) {
 		}
 	})
 }
+
+func BenchmarkWriteBodyChunk(b *testing.B) {
+	tr := transport.NewStdioTransportFromRW(nil, io.Discard)
+	data := make([]byte, 32*1024)
+	msg := tunnel.BodyChunkMsg{Envelope: tunnel.Envelope{Type: tunnel.MsgBodyChunk, StreamID: "0b6f2c1e-4d5a-4e8b-9f3c-7a1d2e3f4b5c"}, Data: data}
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := tr.WriteJSONThenBinary(msg, msg.Data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+// errRequestBodyClosed is returned once the upstream request has finished
+// with the body (or the stream has ended) and no more chunks are accepted.
+var errRequestBodyClosed = errors.New("request body closed")
+
+// requestBody is the upstream request body for an http_request sent with
+// body_stream. The read loop pushes body_chunk payloads into its queue as they
+// arrive and the upstream HTTP client reads them out, so uploads are never
+// buffered in full and are not bounded by transport.MaxFrameSize.
+type requestBody struct {
+	queue   *inboundQueue
+	frame   []byte // payload of the chunk being read, returned to the pool once read
+	pending []byte
+}
+
+// newRequestBody creates an empty streamed request body backed by queue.
+func newRequestBody(queue *inboundQueue) *requestBody {
+	return &requestBody{queue: queue}
+}
+
+// Read implements io.Reader for the upstream HTTP client.
+func (b *requestBody) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if b.frame != nil {
+			transport.PutBuffer(b.frame)
+			b.frame = nil
+		}
+		frame, err := b.queue.pop(context.Background())
+		if err != nil {
+			return 0, err
+		}
+		b.frame, b.pending = frame.data, frame.data
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+// Close implements io.Closer. The HTTP client calls it once it is done with
+// the body, which unblocks any push waiting on a full queue.
+func (b *requestBody) Close() error {
+	b.queue.abort(errRequestBodyClosed)
+	return nil
+}
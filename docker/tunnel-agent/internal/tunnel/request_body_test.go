@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+// TestRequestBodyReadsChunksInOrder verifies pushed chunks are read back in
+// order and the body ends with io.EOF after the queue is closed.
+func TestRequestBodyReadsChunksInOrder(t *testing.T) {
+	queue := newInboundQueue(1024, false, nil)
+	body := newRequestBody(queue)
+
+	go func() {
+		for _, part := range []string{"a", "bc", "def"} {
+			if err := queue.push(inboundFrame{data: []byte(part)}); err != nil {
+				t.Errorf("push: %v", err)
+			}
+		}
+		queue.close()
+	}()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(data) != "abcdef" {
+		t.Errorf("body = %q, want %q", data, "abcdef")
+	}
+}
+
+// TestRequestBodyCloseFailsPush verifies that closing the body (as the HTTP
+// client does when it is finished) makes further pushes fail.
+func TestRequestBodyCloseFailsPush(t *testing.T) {
+	queue := newInboundQueue(1024, false, nil)
+	body := newRequestBody(queue)
+	_ = body.Close()
+
+	if err := queue.push(inboundFrame{data: []byte("more")}); !errors.Is(err, errRequestBodyClosed) {
+		t.Errorf("push error = %v, want errRequestBodyClosed", err)
+	}
+}
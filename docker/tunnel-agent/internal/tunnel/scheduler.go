@@ -0,0 +1,178 @@
+package tunnel
+
+import (
+	"slices"
+	"sync"
+
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+// writeScheduler is the single writer of an agent's outbound messages. Callers
+// queue a message on its stream and block until it has been written, so write
+// errors and backpressure reach them exactly as with direct transport writes.
+//
+// Messages without a BINARY payload (acks, stream_close, heartbeats, window
+// updates, response headers) are control messages and always go first:
+// connection-level ones such as heartbeats, then any stream whose next message
+// is a control message. Streams with pending data are otherwise served round
+// robin, one message per turn, so a download sent as 1 MB body_chunk frames
+// delays a WebSocket frame by at most one chunk instead of by the whole
+// download.
+//
+// Messages of one stream are written in the order they were queued; a
+// stream_close never overtakes the data before it.
+type writeScheduler struct {
+	tr transport.Transport
+
+	mu      sync.Mutex
+	control []*outboundMessage            // queued messages without a stream ID
+	streams map[string][]*outboundMessage // queued messages per stream ID
+	ring    []string                      // stream IDs with queued messages, in round-robin order
+	next    int                           // index in ring of the stream whose data goes next
+	writing bool                          // a drain goroutine is running
+}
+
+// outboundMessage is one queued write: a TEXT frame, optionally followed by a
+// BINARY frame.
+type outboundMessage struct {
+	envelope  any
+	body      []byte
+	hasBinary bool
+	done      chan error
+}
+
+// control reports whether m has no BINARY payload and so is scheduled ahead
+// of stream data.
+func (m *outboundMessage) control() bool {
+	return !m.hasBinary
+}
+
+// newWriteScheduler creates a writeScheduler that writes to tr.
+func newWriteScheduler(tr transport.Transport) *writeScheduler {
+	return &writeScheduler{tr: tr, streams: make(map[string][]*outboundMessage)}
+}
+
+// WriteJSON queues v as a TEXT frame and waits until it is written.
+func (w *writeScheduler) WriteJSON(v any) error {
+	return w.submit(&outboundMessage{envelope: v})
+}
+
+// WriteJSONThenBinary queues envelope and body as adjacent TEXT and BINARY
+// frames and waits until both are written.
+func (w *writeScheduler) WriteJSONThenBinary(envelope any, body []byte) error {
+	return w.submit(&outboundMessage{envelope: envelope, body: body, hasBinary: true})
+}
+
+// submit queues m and blocks until the drain goroutine has written it,
+// starting one if none is running.
+func (w *writeScheduler) submit(m *outboundMessage) error {
+	m.done = make(chan error, 1)
+	id := streamIDOf(m.envelope)
+
+	w.mu.Lock()
+	if id == "" {
+		w.control = append(w.control, m)
+	} else {
+		if _, ok := w.streams[id]; !ok {
+			w.ring = append(w.ring, id)
+		}
+		w.streams[id] = append(w.streams[id], m)
+	}
+	if !w.writing {
+		w.writing = true
+		go w.drain()
+	}
+	w.mu.Unlock()
+
+	return <-m.done
+}
+
+// drain writes queued messages in scheduling order until none are left.
+func (w *writeScheduler) drain() {
+	for {
+		w.mu.Lock()
+		m := w.nextLocked()
+		if m == nil {
+			w.writing = false
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+
+		var err error
+		if m.hasBinary {
+			err = w.tr.WriteJSONThenBinary(m.envelope, m.body)
+		} else {
+			err = w.tr.WriteJSON(m.envelope)
+		}
+		m.done <- err
+	}
+}
+
+// nextLocked dequeues the message to write next, or returns nil when nothing
+// is queued. w.mu must be held.
+func (w *writeScheduler) nextLocked() *outboundMessage {
+	if len(w.control) > 0 {
+		m := w.control[0]
+		w.control[0] = nil
+		w.control = w.control[1:]
+		return m
+	}
+	if len(w.ring) == 0 {
+		return nil
+	}
+	// A stream's control message jumps ahead of every stream's data without
+	// costing the stream whose turn it is.
+	for i := range len(w.ring) {
+		pos := (w.next + i) % len(w.ring)
+		if w.streams[w.ring[pos]][0].control() {
+			return w.popLocked(pos, false)
+		}
+	}
+	return w.popLocked(w.next, true)
+}
+
+// popLocked dequeues the first message of the stream at ring index pos. When
+// turn is set the stream was served in its round-robin turn and the turn
+// passes to the next stream. w.mu must be held.
+func (w *writeScheduler) popLocked(pos int, turn bool) *outboundMessage {
+	id := w.ring[pos]
+	queue := w.streams[id]
+	m := queue[0]
+	if len(queue) > 1 {
+		queue[0] = nil
+		w.streams[id] = queue[1:]
+		if turn {
+			w.next = pos + 1
+		}
+	} else {
+		delete(w.streams, id)
+		w.ring = slices.Delete(w.ring, pos, pos+1)
+		if pos < w.next {
+			w.next--
+		}
+	}
+	if len(w.ring) == 0 {
+		w.next = 0
+	} else {
+		w.next %= len(w.ring)
+	}
+	return m
+}
+
+// hasEnvelope is implemented by every protocol message through its embedded
+// Envelope.
+type hasEnvelope interface {
+	envelope() Envelope
+}
+
+func (e Envelope) envelope() Envelope { return e }
+
+// streamIDOf returns the stream ID of a protocol message, or "" for
+// connection-level messages and values that are not protocol messages.
+func streamIDOf(v any) string {
+	if m, ok := v.(hasEnvelope); ok {
+		return m.envelope().StreamID
+	}
+	return ""
+}
@@ -0,0 +1,178 @@
+package tunnel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+// recordingTransport records the envelopes written to it. Its first write
+// closes entered and blocks until release is closed, so tests can queue
+// messages behind it.
+type recordingTransport struct {
+	transport.Transport
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	written []any
+}
+
+func newRecordingTransport() *recordingTransport {
+	return &recordingTransport{entered: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (r *recordingTransport) record(v any) error {
+	r.once.Do(func() {
+		close(r.entered)
+		<-r.release
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.written = append(r.written, v)
+	return nil
+}
+
+func (r *recordingTransport) WriteJSON(v any) error { return r.record(v) }
+
+func (r *recordingTransport) WriteJSONThenBinary(envelope any, body []byte) error {
+	return r.record(envelope)
+}
+
+// queued returns how many messages wait in w.
+func (w *writeScheduler) queued() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(w.control)
+	for _, q := range w.streams {
+		n += len(q)
+	}
+	return n
+}
+
+// blockScheduler starts a write that holds the scheduler's writer until the
+// transport is released, and returns a WaitGroup for the writes queued after it.
+func blockScheduler(w *writeScheduler, tr *recordingTransport) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = w.WriteJSONThenBinary(TCPDataMsg{Envelope: Envelope{Type: MsgTCPData, StreamID: "blocker"}}, nil)
+	}()
+	<-tr.entered
+	return &wg
+}
+
+// waitQueued waits until n messages are queued in w.
+func waitQueued(t *testing.T, w *writeScheduler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for w.queued() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d queued messages, have %d", n, w.queued())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteSchedulerControlFirst(t *testing.T) {
+	tr := newRecordingTransport()
+	w := newWriteScheduler(tr)
+	wg := blockScheduler(w, tr)
+
+	queue := func(write func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := write(); err != nil {
+				t.Errorf("write: %v", err)
+			}
+		}()
+	}
+	chunk := BodyChunkMsg{Envelope: Envelope{Type: MsgBodyChunk, StreamID: "download"}}
+	for i := range 3 {
+		queue(func() error { return w.WriteJSONThenBinary(chunk, make([]byte, 1024)) })
+		waitQueued(t, w, i+1)
+	}
+	queue(func() error {
+		return w.WriteJSON(StreamCloseMsg{Envelope: Envelope{Type: MsgStreamClose, StreamID: "ws"}})
+	})
+	queue(func() error { return w.WriteJSON(HeartbeatMsg{Envelope: Envelope{Type: MsgHeartbeat}}) })
+	waitQueued(t, w, 5)
+
+	close(tr.release)
+	wg.Wait()
+
+	var types []MessageType
+	for _, v := range tr.written[1:] {
+		types = append(types, v.(hasEnvelope).envelope().Type)
+	}
+	want := []MessageType{MsgHeartbeat, MsgStreamClose, MsgBodyChunk, MsgBodyChunk, MsgBodyChunk}
+	if len(types) != len(want) {
+		t.Fatalf("wrote %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("wrote %v, want %v", types, want)
+		}
+	}
+}
+
+func TestWriteSchedulerRoundRobin(t *testing.T) {
+	tr := newRecordingTransport()
+	w := newWriteScheduler(tr)
+	wg := blockScheduler(w, tr)
+
+	for i, id := range []string{"a", "a", "a", "b", "b", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = w.WriteJSONThenBinary(BodyChunkMsg{Envelope: Envelope{Type: MsgBodyChunk, StreamID: id}}, nil)
+		}()
+		waitQueued(t, w, i+1)
+	}
+
+	close(tr.release)
+	wg.Wait()
+
+	var order string
+	for _, v := range tr.written[1:] {
+		order += streamIDOf(v)
+	}
+	if order != "ababab" {
+		t.Errorf("streams written in order %q, want ababab", order)
+	}
+}
+
+func TestWriteSchedulerKeepsStreamOrder(t *testing.T) {
+	tr := newRecordingTransport()
+	w := newWriteScheduler(tr)
+	wg := blockScheduler(w, tr)
+
+	// The stream_close is a control message but must not overtake the data
+	// queued before it on the same stream.
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = w.WriteJSONThenBinary(WSDataMsg{Envelope: Envelope{Type: MsgWSData, StreamID: "ws"}}, nil)
+	}()
+	waitQueued(t, w, 1)
+	go func() {
+		defer wg.Done()
+		_ = w.WriteJSON(StreamCloseMsg{Envelope: Envelope{Type: MsgStreamClose, StreamID: "ws"}})
+	}()
+	waitQueued(t, w, 2)
+
+	close(tr.release)
+	wg.Wait()
+
+	if got := tr.written[1].(hasEnvelope).envelope().Type; got != MsgWSData {
+		t.Errorf("first message on the stream = %s, want ws_data", got)
+	}
+	if got := tr.written[2].(hasEnvelope).envelope().Type; got != MsgStreamClose {
+		t.Errorf("second message on the stream = %s, want stream_close", got)
+	}
+}
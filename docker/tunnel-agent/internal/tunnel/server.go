@@ -0,0 +1,188 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/discovery"
+	"docker-bridge-tunnel-agent/internal/probe"
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+// HelloTimeout is how long a connection may take to authenticate with its
+// hello before it is closed.
+const HelloTimeout = 10 * time.Second
+
+// Server runs a long-lived agent that bridges connect to over a Unix socket or
+// TCP listener instead of starting one per docker exec. Each connection is a
+// session served by its own Agent. When the config sets an AuthToken, a
+// connection is served only once its hello presents it.
+//
+// A new connection replaces the current session once it has authenticated,
+// so a bridge that reconnects after a network failure does not wait for the
+// old session to notice it is gone.
+type Server struct {
+	cfg       *config.Config
+	ln        *transport.Listener
+	startTime time.Time
+	running   atomic.Bool
+	prober    *probe.Prober
+	watcher   *discovery.Watcher
+
+	mu            sync.Mutex
+	current       *Agent
+	cancelCurrent context.CancelFunc
+	sessions      sync.WaitGroup
+}
+
+// NewServer creates a Server that accepts bridge connections from ln.
+func NewServer(cfg *config.Config, ln *transport.Listener) *Server {
+	return &Server{
+		cfg:       cfg,
+		ln:        ln,
+		startTime: time.Now(),
+	}
+}
+
+// WatchPorts makes every session report the port state changes seen by p.
+// It must be called before Serve.
+func (s *Server) WatchPorts(p *probe.Prober) {
+	s.prober = p
+}
+
+// WatchListeners makes every session announce the ports found by w.
+// It must be called before Serve.
+func (s *Server) WatchListeners(w *discovery.Watcher) {
+	s.watcher = w
+}
+
+// IsRunning returns true while the server is accepting connections.
+func (s *Server) IsRunning() bool {
+	return s.running.Load()
+}
+
+// Uptime returns how long since the server was created.
+func (s *Server) Uptime() time.Duration {
+	return time.Since(s.startTime)
+}
+
+// ActiveStreams returns the number of active streams in the current session.
+func (s *Server) ActiveStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return 0
+	}
+	return s.current.ActiveStreams()
+}
+
+// BridgeLatency returns the last ping round trip measured by the current
+// session and when it was measured, or a zero time without one.
+func (s *Server) BridgeLatency() (time.Duration, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return 0, time.Time{}
+	}
+	return s.current.BridgeLatency()
+}
+
+// Serve accepts connections until ctx is cancelled, then closes the listener
+// and waits for the current session to shut down.
+func (s *Server) Serve(ctx context.Context) error {
+	s.running.Store(true)
+	defer s.running.Store(false)
+
+	go func() {
+		<-ctx.Done()
+		_ = s.ln.Close()
+	}()
+	defer s.sessions.Wait()
+
+	slog.Info("listening for bridge connections", "addr", s.ln.Addr().String())
+	for {
+		tr, err := s.ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return ctx.Err()
+			}
+			return err
+		}
+		s.startSession(ctx, tr)
+	}
+}
+
+// startSession runs an Agent for tr. The session replaces the current one as
+// soon as it has authenticated, or at once when no AuthToken is configured.
+func (s *Server) startSession(ctx context.Context, tr *transport.ConnTransport) {
+	sessionCtx, cancel := context.WithCancel(ctx)
+	agent := NewAgent(s.cfg, tr)
+	agent.WatchPorts(s.prober)
+	agent.WatchListeners(s.watcher)
+
+	remote := tr.RemoteAddr().String()
+	slog.Info("bridge connected", "remote", remote)
+
+	if s.cfg.AuthToken == "" {
+		s.promote(agent, cancel)
+	} else {
+		// Whichever comes first, the hello or the timeout, settles the
+		// connection.
+		var settled atomic.Bool
+		timer := time.AfterFunc(HelloTimeout, func() {
+			if settled.CompareAndSwap(false, true) {
+				slog.Warn("bridge did not authenticate in time", "remote", remote)
+				cancel()
+			}
+		})
+		agent.RequireAuth(s.cfg.AuthToken, func() {
+			if settled.CompareAndSwap(false, true) {
+				timer.Stop()
+				s.promote(agent, cancel)
+			}
+		})
+	}
+
+	// Closing the connection unblocks the agent's read loop when the
+	// session is replaced or the server stops.
+	go func() {
+		<-sessionCtx.Done()
+		_ = tr.Close()
+	}()
+
+	s.sessions.Add(1)
+	go func() {
+		defer s.sessions.Done()
+		defer cancel()
+		if err := agent.Run(sessionCtx); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Warn("bridge session ended with error", "remote", remote, "error", err)
+		} else {
+			slog.Info("bridge disconnected", "remote", remote)
+		}
+
+		s.mu.Lock()
+		if s.current == agent {
+			s.current = nil
+			s.cancelCurrent = nil
+		}
+		s.mu.Unlock()
+	}()
+}
+
+// promote makes agent the current session, ending the one it replaces.
+func (s *Server) promote(agent *Agent, cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancelCurrent != nil {
+		slog.Info("new bridge connection replaces the current session")
+		s.cancelCurrent()
+	}
+	s.current = agent
+	s.cancelCurrent = cancel
+}
@@ -0,0 +1,186 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+// dialTestServer connects to the server and returns a transport for the bridge side.
+func dialTestServer(t *testing.T, addr net.Addr) *transport.ConnTransport {
+	t.Helper()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return transport.NewConnTransport(conn)
+}
+
+// TestServerSessionOverTCP verifies a bridge connecting over TCP gets a ready
+// message and its requests are served.
+func TestServerSessionOverTCP(t *testing.T) {
+	ln, err := transport.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	server := NewServer(newTestAgentConfig([]int{3000}), ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx)
+	}()
+
+	bridge := dialTestServer(t, ln.Addr())
+	readMessage(t, bridge, MsgReady)
+	if !server.IsRunning() {
+		t.Error("expected IsRunning() = true while serving")
+	}
+
+	hello := HelloMsg{Envelope: Envelope{Type: MsgHello}, ProtocolVersion: ProtocolVersion}
+	if err := bridge.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+	var ack HelloAckMsg
+	if err := json.Unmarshal(readMessage(t, bridge, MsgHelloAck), &ack); err != nil {
+		t.Fatalf("unmarshal hello_ack: %v", err)
+	}
+	if !ack.Success {
+		t.Errorf("expected a successful hello_ack, got %+v", ack)
+	}
+
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(ShutdownDrainTimeout + time.Second):
+		t.Fatal("Serve() did not exit after context cancel")
+	}
+	if server.IsRunning() {
+		t.Error("expected IsRunning() = false after Serve returns")
+	}
+}
+
+// TestServerNewConnectionReplacesSession verifies a second bridge connection
+// ends the first session.
+func TestServerNewConnectionReplacesSession(t *testing.T) {
+	ln, err := transport.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	server := NewServer(newTestAgentConfig([]int{3000}), ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		_ = server.Serve(ctx)
+	}()
+
+	first := dialTestServer(t, ln.Addr())
+	readMessage(t, first, MsgReady)
+
+	second := dialTestServer(t, ln.Addr())
+	readMessage(t, second, MsgReady)
+
+	// The first connection is closed by the agent once it is replaced.
+	for {
+		if _, _, err := first.ReadFrame(); err != nil {
+			break
+		}
+	}
+}
+
+// sendHello writes a hello presenting token and returns the agent's hello_ack.
+func sendHello(t *testing.T, bridge *transport.ConnTransport, token string) HelloAckMsg {
+	t.Helper()
+	hello := HelloMsg{Envelope: Envelope{Type: MsgHello}, ProtocolVersion: ProtocolVersion, AuthToken: token}
+	if err := bridge.WriteJSON(hello); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+	var ack HelloAckMsg
+	if err := json.Unmarshal(readMessage(t, bridge, MsgHelloAck), &ack); err != nil {
+		t.Fatalf("unmarshal hello_ack: %v", err)
+	}
+	return ack
+}
+
+// waitClosed reads from bridge until the agent closes the connection.
+func waitClosed(t *testing.T, bridge *transport.ConnTransport) {
+	t.Helper()
+	for {
+		if _, _, err := bridge.ReadFrame(); err != nil {
+			return
+		}
+	}
+}
+
+// TestServerRequiresAuth verifies that with an auth token, connections that
+// do not authenticate are closed without disturbing the current session, and
+// only an authenticated connection replaces it.
+func TestServerRequiresAuth(t *testing.T) {
+	ln, err := transport.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	cfg := newTestAgentConfig([]int{3000})
+	cfg.AuthToken = "s3cret"
+	server := NewServer(cfg, ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		_ = server.Serve(ctx)
+	}()
+
+	current := func() *Agent {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.current
+	}
+
+	first := dialTestServer(t, ln.Addr())
+	readMessage(t, first, MsgReady)
+	if ack := sendHello(t, first, "s3cret"); !ack.Success {
+		t.Fatalf("hello with the right token refused: %+v", ack)
+	}
+	session := current()
+	if session == nil {
+		t.Fatal("authenticated connection did not become the current session")
+	}
+
+	// A message before hello ends the connection.
+	skipper := dialTestServer(t, ln.Addr())
+	readMessage(t, skipper, MsgReady)
+	req := HTTPRequestMsg{Envelope: Envelope{Type: MsgHTTPRequest, StreamID: "s1"}, Method: "GET", Path: "/"}
+	if err := skipper.WriteJSON(req); err != nil {
+		t.Fatalf("write http_request: %v", err)
+	}
+	waitClosed(t, skipper)
+
+	// A wrong token is refused.
+	guesser := dialTestServer(t, ln.Addr())
+	readMessage(t, guesser, MsgReady)
+	if ack := sendHello(t, guesser, "guess"); ack.Success || ack.Error == "" {
+		t.Errorf("hello with a wrong token = %+v, want an error", ack)
+	}
+	waitClosed(t, guesser)
+
+	if current() != session {
+		t.Fatal("an unauthenticated connection replaced the current session")
+	}
+
+	second := dialTestServer(t, ln.Addr())
+	readMessage(t, second, MsgReady)
+	if ack := sendHello(t, second, "s3cret"); !ack.Success {
+		t.Fatalf("hello with the right token refused: %+v", ack)
+	}
+	waitClosed(t, first)
+	if current() == session {
+		t.Error("an authenticated connection did not replace the current session")
+	}
+}
@@ -0,0 +1,205 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/config"
+	"docker-bridge-tunnel-agent/internal/transport"
+	"docker-bridge-tunnel-agent/internal/upstream"
+)
+
+// tcpReadBufferSize is the largest tcp_data payload read from a local connection at once.
+const tcpReadBufferSize = 32 * 1024
+
+// TCPProxy handles raw TCP streams between the bridge and a local service
+// such as Postgres, Redis or a gRPC server.
+type TCPProxy struct {
+	cfg    *config.Config
+	dialer *upstream.Dialer
+}
+
+// NewTCPProxy creates a new TCPProxy that dials the ports allowed by cfg.
+func NewTCPProxy(cfg *config.Config) *TCPProxy {
+	return &TCPProxy{cfg: cfg, dialer: upstream.NewDialer(cfg, 10*time.Second)}
+}
+
+// Handle proxies a TCP stream described by msg.
+//
+// It dials the upstream for port the way HTTPProxy does, where port is
+// msg.Port (or the first configured port when unset), sends a TCPConnectAckMsg via the transport, then copies
+// bytes in both directions:
+//
+//   - bridge->local: payloads arrive via the inbound queue and are written to the
+//     connection; when the bridge half-closes, the queue ends and the agent
+//     shuts down the write side of the connection
+//   - local->bridge: bytes read from the connection are sent as TCPDataMsg +
+//     binary body; when the local service shuts down its write side, the agent
+//     sends a half-closing StreamCloseMsg
+//
+// The stream ends once both directions are finished, when either side fails,
+// or when the context is cancelled. On exit, StreamCloseMsg is sent and the
+// stream is removed from registry.
+func (p *TCPProxy) Handle(
+	ctx context.Context,
+	msg TCPConnectMsg,
+	inbound *inboundQueue,
+	tr ResponseWriter,
+	registry *StreamRegistry,
+) {
+	port, err := p.cfg.ResolvePort(msg.Port)
+	if err != nil {
+		slog.Warn("tcp_proxy: rejected connect", "stream_id", msg.StreamID, "error", err)
+		writeTCPConnectFailure(tr, msg.StreamID, err, "port_not_allowed")
+		return
+	}
+	// Register stream for cancellation support before dialing, so that a
+	// bridge closing the stream also stops a dial waiting for the port.
+	proxyCtx, cancel := context.WithCancel(ctx)
+	stream := NewStream(msg.StreamID, cancel)
+	registry.Register(msg.StreamID, stream)
+	defer func() {
+		cancel()
+		registry.Remove(msg.StreamID)
+	}()
+
+	conn, err := p.dialer.DialWait(proxyCtx, port)
+	if err != nil {
+		slog.Warn("tcp_proxy: dial failed",
+			"stream_id", msg.StreamID,
+			"port", port,
+			"error", err,
+		)
+		writeTCPConnectFailure(tr, msg.StreamID, err, "dial_failed")
+		return
+	}
+	defer conn.Close()
+
+	activeStreams.WithLabelValues(protoTCP).Inc()
+	defer activeStreams.WithLabelValues(protoTCP).Dec()
+	received := bytesIn.WithLabelValues(portLabel(port), protoTCP)
+	sent := bytesOut.WithLabelValues(portLabel(port), protoTCP)
+
+	tr = bindWriter(tr, proxyCtx)
+	defer func() {
+		cancel()
+		// Always send stream_close when Handle() exits.
+		closeMsg := StreamCloseMsg{
+			Envelope: Envelope{Type: MsgStreamClose, StreamID: msg.StreamID},
+			Reason:   "stream_ended",
+		}
+		_ = tr.WriteJSON(closeMsg)
+	}()
+
+	// Closing the connection unblocks a pending read when the stream is cancelled.
+	stop := context.AfterFunc(proxyCtx, func() { _ = conn.Close() })
+	defer stop()
+
+	ack := TCPConnectAckMsg{
+		Envelope: Envelope{Type: MsgTCPConnectAck, StreamID: msg.StreamID},
+		Success:  true,
+	}
+	if err := tr.WriteJSON(ack); err != nil {
+		slog.Warn("tcp_proxy: failed to send ack", "stream_id", msg.StreamID, "error", err)
+		return
+	}
+
+	// Each direction reports nil when it finished with a half-close, or the
+	// error that ended it. An error in either direction ends the stream.
+	results := make(chan error, 2)
+
+	// Goroutine 1: bridge -> local.
+	go func() {
+		for {
+			frame, err := inbound.pop(proxyCtx)
+			if errors.Is(err, io.EOF) {
+				results <- closeWrite(conn)
+				return
+			}
+			if err != nil {
+				results <- err
+				return
+			}
+			if _, err := conn.Write(frame.data); err != nil {
+				results <- err
+				return
+			}
+			received.Add(float64(len(frame.data)))
+			transport.PutBuffer(frame.data)
+		}
+	}()
+
+	// Goroutine 2: local -> bridge.
+	go func() {
+		buf := transport.GetBuffer(tcpReadBufferSize)
+		defer transport.PutBuffer(buf)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				dataMsg := TCPDataMsg{
+					Envelope:    Envelope{Type: MsgTCPData, StreamID: msg.StreamID},
+					BodyFollows: true,
+				}
+				if werr := tr.WriteJSONThenBinary(dataMsg, buf[:n]); werr != nil {
+					results <- werr
+					return
+				}
+				sent.Add(float64(n))
+			}
+			if errors.Is(err, io.EOF) {
+				halfClose := StreamCloseMsg{
+					Envelope:  Envelope{Type: MsgStreamClose, StreamID: msg.StreamID},
+					HalfClose: true,
+				}
+				results <- tr.WriteJSON(halfClose)
+				return
+			}
+			if err != nil {
+				results <- err
+				return
+			}
+		}
+	}()
+
+	// Wait for both directions; a failure cancels the other one.
+	for range 2 {
+		if err := <-results; err != nil {
+			if proxyCtx.Err() == nil {
+				slog.Debug("tcp_proxy: stream failed",
+					"stream_id", msg.StreamID,
+					"error", err,
+				)
+			}
+			cancel()
+		}
+	}
+}
+
+// closeWrite shuts down the write side of conn, signalling EOF to the local
+// service while its response can still be read.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// writeTCPConnectFailure sends a failed TCPConnectAckMsg followed by a
+// StreamCloseMsg carrying reason.
+func writeTCPConnectFailure(tr ResponseWriter, streamID string, cause error, reason string) {
+	ack := TCPConnectAckMsg{
+		Envelope: Envelope{Type: MsgTCPConnectAck, StreamID: streamID},
+		Success:  false,
+		Error:    cause.Error(),
+	}
+	_ = tr.WriteJSON(ack)
+	closeMsg := StreamCloseMsg{
+		Envelope: Envelope{Type: MsgStreamClose, StreamID: streamID},
+		Reason:   reason,
+	}
+	_ = tr.WriteJSON(closeMsg)
+}
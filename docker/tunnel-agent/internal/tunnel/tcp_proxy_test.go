@@ -0,0 +1,266 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/transport"
+)
+
+// tcpTestServer starts a TCP listener that hands each accepted connection to handle.
+func tcpTestServer(t *testing.T, handle func(net.Conn)) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// readTCPEvent reads the next message from the agent, returning the payload of
+// a tcp_data message or the decoded stream_close.
+func readTCPEvent(t *testing.T, bridgeR *transport.StdioTransport) (data []byte, closeMsg *StreamCloseMsg) {
+	t.Helper()
+	_, raw, err := bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		t.Fatalf("unmarshal envelope: %v", err)
+	}
+	switch env.Type {
+	case MsgTCPData:
+		_, body, err := bridgeR.ReadFrame()
+		if err != nil {
+			t.Fatalf("read tcp_data body: %v", err)
+		}
+		return body, nil
+	case MsgStreamClose:
+		var msg StreamCloseMsg
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			t.Fatalf("unmarshal stream_close: %v", err)
+		}
+		return nil, &msg
+	default:
+		t.Fatalf("unexpected message %q", env.Type)
+		return nil, nil
+	}
+}
+
+// TestTCPProxyHalfClose verifies bytes flow both ways and that half-closes are
+// relayed: the local server sees EOF after the bridge half-closes, can still
+// answer, and its own EOF reaches the bridge as a half-closing stream_close.
+func TestTCPProxyHalfClose(t *testing.T) {
+	port := tcpTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		request, err := io.ReadAll(conn) // until the bridge half-closes
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write(append([]byte("got:"), request...))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := TCPConnectMsg{Envelope: Envelope{Type: MsgTCPConnect, StreamID: "s-tcp"}}
+	inbound := newInboundQueue(1048576, false, nil)
+	registry := &StreamRegistry{}
+	proxy := NewTCPProxy(newTestProxyConfig(port, 1048576))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(ctx, msg, inbound, tp.agentTr, registry)
+	}()
+
+	var ack TCPConnectAckMsg
+	_, raw, err := tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+	if err := json.Unmarshal(raw, &ack); err != nil {
+		t.Fatalf("unmarshal ack: %v", err)
+	}
+	if !ack.Success {
+		t.Fatalf("expected Success=true, got error=%q", ack.Error)
+	}
+
+	_ = inbound.push(inboundFrame{data: []byte("PING ")})
+	_ = inbound.push(inboundFrame{data: []byte("PONG")})
+	inbound.close()
+
+	var received []byte
+	var halfClosed bool
+	for {
+		data, closeMsg := readTCPEvent(t, tp.bridgeR)
+		if closeMsg == nil {
+			received = append(received, data...)
+			continue
+		}
+		if closeMsg.HalfClose {
+			halfClosed = true
+			continue
+		}
+		if closeMsg.Reason != "stream_ended" {
+			t.Errorf("final stream_close reason = %q, want stream_ended", closeMsg.Reason)
+		}
+		break
+	}
+	if string(received) != "got:PING PONG" {
+		t.Errorf("received %q, want %q", received, "got:PING PONG")
+	}
+	if !halfClosed {
+		t.Error("expected a half-closing stream_close before the final one")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() did not exit after both sides closed")
+	}
+	if registry.Count() != 0 {
+		t.Errorf("expected registry to be empty, got %d streams", registry.Count())
+	}
+}
+
+// TestTCPProxyCancel verifies cancelling the stream closes the local connection.
+func TestTCPProxyCancel(t *testing.T) {
+	localClosed := make(chan struct{})
+	port := tcpTestServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+		close(localClosed)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := TCPConnectMsg{Envelope: Envelope{Type: MsgTCPConnect, StreamID: "s-tcp-cancel"}}
+	registry := &StreamRegistry{}
+	proxy := NewTCPProxy(newTestProxyConfig(port, 1048576))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(ctx, msg, newInboundQueue(1048576, false, nil), tp.agentTr, registry)
+	}()
+
+	if _, _, err := tp.bridgeR.ReadFrame(); err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+	tp.drain()
+
+	stream, ok := registry.Get("s-tcp-cancel")
+	if !ok {
+		t.Fatal("stream was not registered")
+	}
+	stream.Cancel()
+
+	select {
+	case <-localClosed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("local connection was not closed")
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() did not exit after cancel")
+	}
+}
+
+// TestTCPProxyCancelWhileWaitingForPort verifies the stream is registered
+// while the dial waits for a refused port, so that cancelling it stops the dial.
+func TestTCPProxyCancelWhileWaitingForPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := TCPConnectMsg{Envelope: Envelope{Type: MsgTCPConnect, StreamID: "s-tcp-wait"}}
+	registry := &StreamRegistry{}
+	cfg := newTestProxyConfig(port, 1048576)
+	cfg.PortGrace = time.Minute
+	proxy := NewTCPProxy(cfg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(context.Background(), msg, newInboundQueue(1048576, false, nil), tp.agentTr, registry)
+	}()
+	tp.drain()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if stream, ok := registry.Get("s-tcp-wait"); ok {
+			stream.Cancel()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream was not registered while dialing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() kept dialing after cancel")
+	}
+	if registry.Count() != 0 {
+		t.Errorf("expected registry to be empty, got %d streams", registry.Count())
+	}
+}
+
+// TestTCPProxyRejectsPortNotAllowed verifies Handle() refuses a port outside
+// the allow-list with a failed ack and a port_not_allowed stream_close.
+func TestTCPProxyRejectsPortNotAllowed(t *testing.T) {
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := TCPConnectMsg{
+		Envelope: Envelope{Type: MsgTCPConnect, StreamID: "s-tcp-denied"},
+		Port:     5432,
+	}
+	proxy := NewTCPProxy(newTestProxyConfig(3000, 1048576))
+
+	go proxy.Handle(context.Background(), msg, newInboundQueue(1048576, false, nil), tp.agentTr, &StreamRegistry{})
+
+	var ack TCPConnectAckMsg
+	_, raw, err := tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+	if err := json.Unmarshal(raw, &ack); err != nil {
+		t.Fatalf("unmarshal ack: %v", err)
+	}
+	if ack.Success {
+		t.Error("expected Success=false for port not in allow-list")
+	}
+	_, closeMsg := readTCPEvent(t, tp.bridgeR)
+	if closeMsg == nil || closeMsg.Reason != "port_not_allowed" {
+		t.Errorf("expected stream_close reason=port_not_allowed, got %+v", closeMsg)
+	}
+}
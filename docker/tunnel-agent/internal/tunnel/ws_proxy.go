@@ -2,13 +2,16 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
-	"strings"
 	"time"
 
+	"docker-bridge-tunnel-agent/internal/config"
 	"docker-bridge-tunnel-agent/internal/transport"
+	"docker-bridge-tunnel-agent/internal/upstream"
 
 	"nhooyr.io/websocket"
 )
@@ -16,41 +19,68 @@ import (
 // WSProxy handles bidirectional WebSocket proxying between the bridge
 // and a local WebSocket server.
 type WSProxy struct {
-	port int
+	cfg    *config.Config
+	client *http.Client
 }
 
-// NewWSProxy creates a new WSProxy with the given target port.
-func NewWSProxy(port int) *WSProxy {
-	return &WSProxy{port: port}
+// NewWSProxy creates a new WSProxy that dials the ports allowed by cfg.
+func NewWSProxy(cfg *config.Config) *WSProxy {
+	dialer := upstream.NewDialer(cfg, 10*time.Second)
+	return &WSProxy{
+		cfg:    cfg,
+		client: &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}},
+	}
 }
 
 // Handle proxies a WebSocket connection described by msg.
 //
-// It dials the local WebSocket server at ws://127.0.0.1:{p.port}{msg.Path},
-// sends a WSUpgradeAckMsg via the transport, then forwards frames bidirectionally:
+// It dials the local WebSocket server at ws://127.0.0.1:{port}{msg.Path}, where
+// port is msg.Port (or the first configured port when unset), falling back to
+// [::1] or using the port's configured upstream like HTTPProxy does. It then
+// sends a WSUpgradeAckMsg via the transport and forwards frames bidirectionally:
 //
-//   - bridge->local: frames arrive via the inbound channel and are written to localConn
+//   - bridge->local: frames arrive via the inbound queue and are written to localConn
 //   - local->bridge: frames from localConn are sent as WSDataMsg + binary body via transport
 //
-// The connection terminates when either side closes or the context is cancelled.
-// On exit, StreamCloseMsg is sent and the stream is removed from registry.
+// The connection terminates when either side closes, the context is cancelled
+// or no frame passes in either direction for the stream idle timeout. On exit,
+// StreamCloseMsg is sent, with reason idle_timeout after an idle timeout, and
+// the stream is removed from registry.
 func (p *WSProxy) Handle(
 	ctx context.Context,
 	msg WSUpgradeMsg,
-	inbound <-chan []byte,
-	tr *transport.StdioTransport,
+	inbound *inboundQueue,
+	tr ResponseWriter,
 	registry *StreamRegistry,
 ) {
-	dialURL := fmt.Sprintf("ws://127.0.0.1:%d%s", p.port, msg.Path)
+	port, err := p.cfg.ResolvePort(msg.Port)
+	if err != nil {
+		slog.Warn("ws_proxy: rejected upgrade", "stream_id", msg.StreamID, "error", err)
+		writeWSUpgradeFailure(tr, msg.StreamID, err, "port_not_allowed")
+		return
+	}
+	dialURL := fmt.Sprintf("ws://127.0.0.1:%d%s", port, msg.Path)
 
 	// Subprotocols go via DialOptions, not the (reserved) Sec-WebSocket-Protocol header.
+	reqHeaders := headersFromMsg(msg.Headers, msg.MultiHeaders)
 	dialOpts := &websocket.DialOptions{
-		HTTPHeader:   buildWSDialHeaders(msg.Headers),
-		Subprotocols: extractSubprotocols(msg.Headers),
+		HTTPClient:   p.client,
+		HTTPHeader:   buildWSDialHeaders(reqHeaders),
+		Subprotocols: extractSubprotocols(reqHeaders),
 	}
 
-	dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
-	localConn, _, dialErr := websocket.Dial(dialCtx, dialURL, dialOpts)
+	// Register stream for cancellation support before dialing, so that a
+	// bridge closing the stream also stops a dial waiting for the port.
+	proxyCtx, cancel := context.WithCancel(ctx)
+	stream := NewStream(msg.StreamID, cancel)
+	registry.Register(msg.StreamID, stream)
+	defer func() {
+		cancel()
+		registry.Remove(msg.StreamID)
+	}()
+
+	dialCtx, dialCancel := context.WithTimeout(proxyCtx, 10*time.Second+p.cfg.PortGrace)
+	localConn, handshakeResp, dialErr := websocket.Dial(dialCtx, dialURL, dialOpts)
 	dialCancel()
 
 	if dialErr != nil {
@@ -59,74 +89,92 @@ func (p *WSProxy) Handle(
 			"url", dialURL,
 			"error", dialErr,
 		)
-		// Send failure ack
-		ack := WSUpgradeAckMsg{
-			Envelope: Envelope{Type: MsgWSUpgradeAck, StreamID: msg.StreamID},
-			Success:  false,
-			Error:    dialErr.Error(),
-		}
-		_ = tr.WriteJSON(ack)
-		// Send stream_close
-		closeMsg := StreamCloseMsg{
-			Envelope: Envelope{Type: MsgStreamClose, StreamID: msg.StreamID},
-			Reason:   "dial_failed",
-		}
-		_ = tr.WriteJSON(closeMsg)
+		writeWSUpgradeFailure(tr, msg.StreamID, dialErr, "dial_failed")
 		return
 	}
 	defer localConn.CloseNow()
 
-	// Register stream for cancellation support.
-	proxyCtx, cancel := context.WithCancel(ctx)
-	stream := NewStream(msg.StreamID, cancel)
-	registry.Register(msg.StreamID, stream)
+	activeStreams.WithLabelValues(protoWS).Inc()
+	defer activeStreams.WithLabelValues(protoWS).Dec()
+	received := bytesIn.WithLabelValues(portLabel(port), protoWS)
+	sent := bytesOut.WithLabelValues(portLabel(port), protoWS)
+
+	tr = bindWriter(tr, proxyCtx)
+	idle := newIdleTimer(p.cfg.StreamIdleTimeout, cancel)
+
+	// localClose receives the close status sent by the local server, if any.
+	localClose := make(chan websocket.CloseError, 1)
 	defer func() {
 		cancel()
-		registry.Remove(msg.StreamID)
-		// Always send stream_close when Handle() exits.
+		idle.pause()
+		// Always send stream_close when Handle() exits, relaying the local
+		// server's close status when it sent one.
 		closeMsg := StreamCloseMsg{
 			Envelope: Envelope{Type: MsgStreamClose, StreamID: msg.StreamID},
 			Reason:   "stream_ended",
 		}
+		select {
+		case ce := <-localClose:
+			closeMsg.CloseCode = int(ce.Code)
+			closeMsg.CloseReason = ce.Reason
+		default:
+		}
+		if idle.expired() {
+			closeMsg.Reason = "idle_timeout"
+			idleTimeouts.WithLabelValues(protoWS).Inc()
+		}
 		_ = tr.WriteJSON(closeMsg)
 	}()
 
 	// Send success ack.
 	ack := WSUpgradeAckMsg{
-		Envelope: Envelope{Type: MsgWSUpgradeAck, StreamID: msg.StreamID},
-		Success:  true,
+		Envelope:    Envelope{Type: MsgWSUpgradeAck, StreamID: msg.StreamID},
+		Success:     true,
+		Subprotocol: localConn.Subprotocol(),
+	}
+	if msg.MultiHeaders != nil && handshakeResp != nil {
+		ack.MultiHeaders = multiValueHeaders(buildWSHandshakeHeaders(handshakeResp.Header))
 	}
 	if err := tr.WriteJSON(ack); err != nil {
 		slog.Warn("ws_proxy: failed to send ack", "stream_id", msg.StreamID, "error", err)
 		return
 	}
+	idle.touch()
 
 	// Use an errgroup-style done channel: either goroutine finishing cancels the other.
 	done := make(chan struct{}, 2)
 
-	// Goroutine 1: bridge -> local (drain inbound channel, write to localConn).
+	// Goroutine 1: bridge -> local (drain inbound queue, write to localConn).
 	go func() {
 		defer func() { done <- struct{}{} }()
 		for {
-			select {
-			case <-proxyCtx.Done():
+			frame, err := inbound.pop(proxyCtx)
+			if errors.Is(err, io.EOF) {
+				// The bridge closed the stream without a close status.
+				closeLocal(localConn, websocket.StatusNormalClosure, "")
+				return
+			}
+			if err != nil {
+				// Stream cancelled or failed.
+				return
+			}
+			idle.touch()
+			if frame.closeCode != 0 {
+				closeLocal(localConn, websocket.StatusCode(frame.closeCode), frame.closeReason)
+				return
+			}
+			writeCtx, writeCancel := context.WithTimeout(proxyCtx, 10*time.Second)
+			err = localConn.Write(writeCtx, messageTypeFor(frame.opcode), frame.data)
+			writeCancel()
+			if err != nil {
+				slog.Debug("ws_proxy: write to local failed",
+					"stream_id", msg.StreamID,
+					"error", err,
+				)
 				return
-			case frame, ok := <-inbound:
-				if !ok {
-					// Inbound channel closed.
-					return
-				}
-				writeCtx, writeCancel := context.WithTimeout(proxyCtx, 10*time.Second)
-				err := localConn.Write(writeCtx, websocket.MessageBinary, frame)
-				writeCancel()
-				if err != nil {
-					slog.Debug("ws_proxy: write to local failed",
-						"stream_id", msg.StreamID,
-						"error", err,
-					)
-					return
-				}
 			}
+			received.Add(float64(len(frame.data)))
+			transport.PutBuffer(frame.data)
 		}
 	}()
 
@@ -134,8 +182,12 @@ func (p *WSProxy) Handle(
 	go func() {
 		defer func() { done <- struct{}{} }()
 		for {
-			_, frameData, err := localConn.Read(proxyCtx)
+			msgType, frameData, err := localConn.Read(proxyCtx)
 			if err != nil {
+				var ce websocket.CloseError
+				if errors.As(err, &ce) {
+					localClose <- ce
+				}
 				if proxyCtx.Err() == nil {
 					slog.Debug("ws_proxy: read from local closed",
 						"stream_id", msg.StreamID,
@@ -145,9 +197,11 @@ func (p *WSProxy) Handle(
 				return
 			}
 
+			idle.touch()
 			dataMsg := WSDataMsg{
 				Envelope:    Envelope{Type: MsgWSData, StreamID: msg.StreamID},
 				BodyFollows: true,
+				Opcode:      opcodeFor(msgType),
 			}
 			if err := tr.WriteJSONThenBinary(dataMsg, frameData); err != nil {
 				slog.Debug("ws_proxy: write to bridge failed",
@@ -156,6 +210,7 @@ func (p *WSProxy) Handle(
 				)
 				return
 			}
+			sent.Add(float64(len(frameData)))
 		}
 	}()
 
@@ -174,29 +229,85 @@ func (p *WSProxy) Handle(
 	}
 }
 
-// buildWSDialHeaders converts the message headers into http.Header, stripping
-// hop-by-hop headers and the Sec-WebSocket-* handshake headers the dialer owns.
-func buildWSDialHeaders(msgHeaders map[string]string) http.Header {
-	h := make(http.Header, len(msgHeaders))
-	for k, v := range msgHeaders {
-		h.Set(k, v)
+// closeLocal performs the close handshake with the local server, falling back
+// to an abrupt close for statuses that may not be sent on the wire (such as
+// 1005 or 1006) or when the handshake fails.
+func closeLocal(conn *websocket.Conn, code websocket.StatusCode, reason string) {
+	if err := conn.Close(code, reason); err != nil {
+		_ = conn.CloseNow()
+	}
+}
+
+// messageTypeFor maps a protocol opcode to a WebSocket message type.
+// Frames without an opcode are binary, matching bridges that predate opcodes.
+func messageTypeFor(op WSOpcode) websocket.MessageType {
+	if op == WSOpcodeText {
+		return websocket.MessageText
+	}
+	return websocket.MessageBinary
+}
+
+// opcodeFor maps a WebSocket message type to its protocol opcode.
+func opcodeFor(typ websocket.MessageType) WSOpcode {
+	if typ == websocket.MessageText {
+		return WSOpcodeText
 	}
+	return WSOpcodeBinary
+}
+
+// writeWSUpgradeFailure sends a failed WSUpgradeAckMsg followed by a
+// StreamCloseMsg carrying reason.
+func writeWSUpgradeFailure(tr ResponseWriter, streamID string, cause error, reason string) {
+	ack := WSUpgradeAckMsg{
+		Envelope: Envelope{Type: MsgWSUpgradeAck, StreamID: streamID},
+		Success:  false,
+		Error:    cause.Error(),
+	}
+	_ = tr.WriteJSON(ack)
+	closeMsg := StreamCloseMsg{
+		Envelope: Envelope{Type: MsgStreamClose, StreamID: streamID},
+		Reason:   reason,
+	}
+	_ = tr.WriteJSON(closeMsg)
+}
+
+// buildWSDialHeaders copies the request headers, stripping hop-by-hop headers
+// and the Sec-WebSocket-* handshake headers the dialer owns.
+func buildWSDialHeaders(reqHeaders http.Header) http.Header {
+	h := reqHeaders.Clone()
+	stripWSHandshakeHeaders(h)
+	return h
+}
+
+// buildWSHandshakeHeaders copies the upstream 101 response headers, stripping
+// the same hop-by-hop and handshake headers so only application headers
+// (Set-Cookie and the like) are reported back to the bridge.
+func buildWSHandshakeHeaders(respHeaders http.Header) http.Header {
+	h := respHeaders.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	stripWSHandshakeHeaders(h)
+	return h
+}
+
+// stripWSHandshakeHeaders removes hop-by-hop headers and the Sec-WebSocket-*
+// headers that belong to a single handshake.
+func stripWSHandshakeHeaders(h http.Header) {
 	stripHopByHop(h)
 	h.Del("Sec-Websocket-Protocol")
 	h.Del("Sec-Websocket-Key")
 	h.Del("Sec-Websocket-Version")
 	h.Del("Sec-Websocket-Extensions")
 	h.Del("Sec-Websocket-Accept")
-	return h
 }
 
-// extractSubprotocols returns the requested subprotocols from the forwarded
-// Sec-WebSocket-Protocol header.
-func extractSubprotocols(msgHeaders map[string]string) []string {
-	for k, v := range msgHeaders {
-		if strings.EqualFold(k, "Sec-WebSocket-Protocol") {
-			return splitCommaSeparated(v)
-		}
+// extractSubprotocols returns the requested subprotocols from every forwarded
+// Sec-WebSocket-Protocol header value.
+func extractSubprotocols(reqHeaders http.Header) []string {
+	var protocols []string
+	for _, v := range reqHeaders.Values("Sec-WebSocket-Protocol") {
+		protocols = append(protocols, splitCommaSeparated(v)...)
 	}
-	return nil
+	return protocols
 }
@@ -3,7 +3,9 @@ package tunnel
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -143,9 +145,9 @@ func TestWSProxyDialSuccess(t *testing.T) {
 		Path:     path,
 		Headers:  map[string]string{},
 	}
-	inbound := make(chan []byte, 10)
+	inbound := newInboundQueue(1048576, false, nil)
 	registry := &StreamRegistry{}
-	proxy := NewWSProxy(port)
+	proxy := NewWSProxy(newTestProxyConfig(port, 1048576))
 
 	done := make(chan struct{})
 	go func() {
@@ -196,9 +198,9 @@ func TestWSProxyDialFailure(t *testing.T) {
 		Path:     "/",
 		Headers:  map[string]string{},
 	}
-	inbound := make(chan []byte, 10)
+	inbound := newInboundQueue(1048576, false, nil)
 	registry := &StreamRegistry{}
-	proxy := NewWSProxy(19987)
+	proxy := NewWSProxy(newTestProxyConfig(19987, 1048576))
 
 	// Run Handle() in goroutine since it writes to pipe synchronously
 	done := make(chan struct{})
@@ -243,7 +245,58 @@ func TestWSProxyDialFailure(t *testing.T) {
 	}
 }
 
-// TestWSProxyPlatformToLocal verifies that bytes sent via the inbound channel
+// TestWSProxyCancelWhileWaitingForPort verifies a stream cancelled while its
+// upgrade waits for a refusing port stops waiting.
+func TestWSProxyCancelWhileWaitingForPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := WSUpgradeMsg{
+		Envelope: Envelope{Type: MsgWSUpgrade, StreamID: "s-ws-wait"},
+		Path:     "/",
+		Headers:  map[string]string{},
+	}
+	registry := &StreamRegistry{}
+	cfg := newTestProxyConfig(port, 1048576)
+	cfg.PortGrace = time.Minute
+	proxy := NewWSProxy(cfg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(context.Background(), msg, newInboundQueue(1048576, false, nil), tp.agentTr, registry)
+	}()
+	tp.drain()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if stream, ok := registry.Get("s-ws-wait"); ok {
+			stream.Cancel()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream was not registered while dialing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() kept dialing after cancel")
+	}
+	if registry.Count() != 0 {
+		t.Errorf("expected registry to be empty, got %d streams", registry.Count())
+	}
+}
+
+// TestWSProxyPlatformToLocal verifies that bytes sent via the inbound queue
 // are forwarded to the local WebSocket server.
 func TestWSProxyPlatformToLocal(t *testing.T) {
 	wsURL, received, mu, cleanup := echoWSServer(t)
@@ -260,9 +313,9 @@ func TestWSProxyPlatformToLocal(t *testing.T) {
 		Path:     path,
 		Headers:  map[string]string{},
 	}
-	inbound := make(chan []byte, 10)
+	inbound := newInboundQueue(1048576, false, nil)
 	registry := &StreamRegistry{}
-	proxy := NewWSProxy(port)
+	proxy := NewWSProxy(newTestProxyConfig(port, 1048576))
 
 	done := make(chan struct{})
 	go func() {
@@ -276,9 +329,11 @@ func TestWSProxyPlatformToLocal(t *testing.T) {
 		t.Fatalf("read ack: %v", err)
 	}
 
-	// Send frame via inbound channel (bridge -> local)
+	// Send frame via inbound queue (bridge -> local)
 	testPayload := []byte("hello from bridge")
-	inbound <- testPayload
+	if err := inbound.push(inboundFrame{data: testPayload}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
 
 	// Wait for local server to receive it
 	deadline := time.Now().Add(3 * time.Second)
@@ -343,9 +398,9 @@ func TestWSProxyLocalToPlatform(t *testing.T) {
 		Path:     path,
 		Headers:  map[string]string{},
 	}
-	inbound := make(chan []byte, 10)
+	inbound := newInboundQueue(1048576, false, nil)
 	registry := &StreamRegistry{}
-	proxy := NewWSProxy(port)
+	proxy := NewWSProxy(newTestProxyConfig(port, 1048576))
 
 	done := make(chan struct{})
 	go func() {
@@ -389,6 +444,9 @@ func TestWSProxyLocalToPlatform(t *testing.T) {
 	if !dataMsg.BodyFollows {
 		t.Error("expected BodyFollows=true in WSDataMsg")
 	}
+	if dataMsg.Opcode != WSOpcodeText {
+		t.Errorf("expected opcode %q, got %q", WSOpcodeText, dataMsg.Opcode)
+	}
 
 	// Then binary frame with actual data
 	ft2, binData, err := tp.bridgeR.ReadFrame()
@@ -429,9 +487,9 @@ func TestWSProxyContextCancel(t *testing.T) {
 		Path:     path,
 		Headers:  map[string]string{},
 	}
-	inbound := make(chan []byte, 10)
+	inbound := newInboundQueue(1048576, false, nil)
 	registry := &StreamRegistry{}
-	proxy := NewWSProxy(port)
+	proxy := NewWSProxy(newTestProxyConfig(port, 1048576))
 
 	done := make(chan struct{})
 	go func() {
@@ -487,9 +545,9 @@ func TestWSProxyForwardsSubprotocol(t *testing.T) {
 		Path:     path,
 		Headers:  map[string]string{"Sec-WebSocket-Protocol": "vite-hmr"},
 	}
-	inbound := make(chan []byte, 10)
+	inbound := newInboundQueue(1048576, false, nil)
 	registry := &StreamRegistry{}
-	proxy := NewWSProxy(port)
+	proxy := NewWSProxy(newTestProxyConfig(port, 1048576))
 
 	done := make(chan struct{})
 	go func() {
@@ -509,6 +567,10 @@ func TestWSProxyForwardsSubprotocol(t *testing.T) {
 		t.Fatalf("expected Success=true, got error=%q", ack.Error)
 	}
 
+	if ack.Subprotocol != "vite-hmr" {
+		t.Errorf("ack subprotocol = %q, want %q", ack.Subprotocol, "vite-hmr")
+	}
+
 	mu.Lock()
 	if gotProto != "vite-hmr" {
 		t.Errorf("upstream Sec-WebSocket-Protocol = %q, want %q", gotProto, "vite-hmr")
@@ -524,3 +586,483 @@ func TestWSProxyForwardsSubprotocol(t *testing.T) {
 		t.Fatal("Handle() did not exit after context cancel")
 	}
 }
+
+// TestWSProxyRejectsPortNotAllowed verifies Handle() refuses a port outside the
+// allow-list with a failed ack and a port_not_allowed stream_close.
+func TestWSProxyRejectsPortNotAllowed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := newTestTransportPair()
+	msg := WSUpgradeMsg{
+		Envelope: Envelope{Type: MsgWSUpgrade, StreamID: "s-denied"},
+		Port:     4000,
+		Path:     "/",
+		Headers:  map[string]string{},
+	}
+	inbound := newInboundQueue(1048576, false, nil)
+	proxy := NewWSProxy(newTestProxyConfig(3000, 1048576))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(ctx, msg, inbound, tp.agentTr, &StreamRegistry{})
+	}()
+
+	var ack WSUpgradeAckMsg
+	_, data, err := tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+	if err := json.Unmarshal(data, &ack); err != nil {
+		t.Fatalf("unmarshal ack: %v", err)
+	}
+	if ack.Success {
+		t.Error("expected Success=false for port not in allow-list")
+	}
+
+	var closeMsg StreamCloseMsg
+	_, data, err = tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read stream_close: %v", err)
+	}
+	if err := json.Unmarshal(data, &closeMsg); err != nil {
+		t.Fatalf("unmarshal stream_close: %v", err)
+	}
+	if closeMsg.Reason != "port_not_allowed" {
+		t.Errorf("expected reason=port_not_allowed, got %q", closeMsg.Reason)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() did not exit")
+	}
+}
+
+// TestWSProxyAckCarriesHandshakeHeaders verifies the upstream 101 response
+// headers are reported in the ack when the upgrade opted in to multi_headers.
+func TestWSProxyAckCarriesHandshakeHeaders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc")
+		w.Header().Add("Set-Cookie", "theme=dark")
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	port, path := parseWSTestURL(t, "ws"+srv.URL[len("http"):]+"/")
+
+	tp := newTestTransportPair()
+	msg := WSUpgradeMsg{
+		Envelope:     Envelope{Type: MsgWSUpgrade, StreamID: "s-multi"},
+		Path:         path,
+		MultiHeaders: map[string][]string{},
+	}
+	proxy := NewWSProxy(newTestProxyConfig(port, 1048576))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(ctx, msg, newInboundQueue(1048576, false, nil), tp.agentTr, &StreamRegistry{})
+	}()
+
+	var ack WSUpgradeAckMsg
+	_, data, err := tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+	if err := json.Unmarshal(data, &ack); err != nil {
+		t.Fatalf("unmarshal ack: %v", err)
+	}
+	if !ack.Success {
+		t.Fatalf("expected Success=true, got error=%q", ack.Error)
+	}
+	cookies := ack.MultiHeaders["Set-Cookie"]
+	if len(cookies) != 2 || cookies[0] != "session=abc" || cookies[1] != "theme=dark" {
+		t.Errorf("ack Set-Cookie = %v, want [session=abc theme=dark]", cookies)
+	}
+	if _, found := ack.MultiHeaders["Sec-Websocket-Accept"]; found {
+		t.Error("handshake headers should not be reported in the ack")
+	}
+
+	tp.drain()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() did not exit after context cancel")
+	}
+}
+
+// TestWSProxyPreservesTextOpcode verifies text messages stay text in both
+// directions instead of being coerced to binary.
+func TestWSProxyPreservesTextOpcode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	gotType := make(chan websocket.MessageType, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		msgType, data, err := conn.Read(r.Context())
+		if err != nil {
+			return
+		}
+		gotType <- msgType
+		_ = conn.Write(r.Context(), msgType, data)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	port, path := parseWSTestURL(t, "ws"+srv.URL[len("http"):]+"/")
+
+	tp := newTestTransportPair()
+	msg := WSUpgradeMsg{
+		Envelope: Envelope{Type: MsgWSUpgrade, StreamID: "s-text"},
+		Path:     path,
+	}
+	inbound := newInboundQueue(1048576, false, nil)
+	proxy := NewWSProxy(newTestProxyConfig(port, 1048576))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(ctx, msg, inbound, tp.agentTr, &StreamRegistry{})
+	}()
+
+	if _, _, err := tp.bridgeR.ReadFrame(); err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+	if err := inbound.push(inboundFrame{data: []byte(`{"type":"ping"}`), opcode: WSOpcodeText}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	select {
+	case typ := <-gotType:
+		if typ != websocket.MessageText {
+			t.Errorf("local server got message type %v, want text", typ)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("local server did not receive the message")
+	}
+
+	var dataMsg WSDataMsg
+	_, data, err := tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read WSDataMsg: %v", err)
+	}
+	if err := json.Unmarshal(data, &dataMsg); err != nil {
+		t.Fatalf("unmarshal WSDataMsg: %v", err)
+	}
+	if dataMsg.Opcode != WSOpcodeText {
+		t.Errorf("echoed opcode = %q, want %q", dataMsg.Opcode, WSOpcodeText)
+	}
+
+	tp.drain()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() did not exit after context cancel")
+	}
+}
+
+// TestWSProxyRelaysBridgeCloseStatus verifies a close code and reason from the
+// bridge are used in the close handshake with the local server.
+func TestWSProxyRelaysBridgeCloseStatus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	gotClose := make(chan websocket.CloseError, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		_, _, err = conn.Read(r.Context())
+		var ce websocket.CloseError
+		if errors.As(err, &ce) {
+			gotClose <- ce
+		}
+	}))
+	defer srv.Close()
+
+	port, path := parseWSTestURL(t, "ws"+srv.URL[len("http"):]+"/")
+
+	tp := newTestTransportPair()
+	tp.drain()
+	defer tp.close()
+	msg := WSUpgradeMsg{
+		Envelope: Envelope{Type: MsgWSUpgrade, StreamID: "s-bridge-close"},
+		Path:     path,
+	}
+	inbound := newInboundQueue(1048576, false, nil)
+	proxy := NewWSProxy(newTestProxyConfig(port, 1048576))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(ctx, msg, inbound, tp.agentTr, &StreamRegistry{})
+	}()
+
+	if err := inbound.push(inboundFrame{closeCode: 4001, closeReason: "session expired"}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	inbound.close()
+
+	select {
+	case ce := <-gotClose:
+		if ce.Code != 4001 || ce.Reason != "session expired" {
+			t.Errorf("local close = %d %q, want 4001 %q", ce.Code, ce.Reason, "session expired")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("local server did not receive a close frame")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() did not exit after close")
+	}
+}
+
+// TestWSProxyRelaysLocalCloseStatus verifies the local server's close code and
+// reason are reported in the stream_close sent to the bridge.
+func TestWSProxyRelaysLocalCloseStatus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.Close(websocket.StatusPolicyViolation, "not allowed")
+	}))
+	defer srv.Close()
+
+	port, path := parseWSTestURL(t, "ws"+srv.URL[len("http"):]+"/")
+
+	tp := newTestTransportPair()
+	msg := WSUpgradeMsg{
+		Envelope: Envelope{Type: MsgWSUpgrade, StreamID: "s-local-close"},
+		Path:     path,
+	}
+	proxy := NewWSProxy(newTestProxyConfig(port, 1048576))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(ctx, msg, newInboundQueue(1048576, false, nil), tp.agentTr, &StreamRegistry{})
+	}()
+
+	if _, _, err := tp.bridgeR.ReadFrame(); err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+
+	var closeMsg StreamCloseMsg
+	_, data, err := tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read stream_close: %v", err)
+	}
+	if err := json.Unmarshal(data, &closeMsg); err != nil {
+		t.Fatalf("unmarshal stream_close: %v", err)
+	}
+	if closeMsg.Type != MsgStreamClose {
+		t.Fatalf("expected %q, got %q", MsgStreamClose, closeMsg.Type)
+	}
+	if closeMsg.CloseCode != int(websocket.StatusPolicyViolation) || closeMsg.CloseReason != "not allowed" {
+		t.Errorf("stream_close status = %d %q, want %d %q",
+			closeMsg.CloseCode, closeMsg.CloseReason, websocket.StatusPolicyViolation, "not allowed")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() did not exit after local close")
+	}
+}
+
+// TestWSProxyIdleTimeout verifies a WebSocket stream that carries no frames
+// for the idle timeout is closed with reason idle_timeout.
+func TestWSProxyIdleTimeout(t *testing.T) {
+	wsURL, _, _, cleanup := echoWSServer(t)
+	defer cleanup()
+
+	port, path := parseWSTestURL(t, wsURL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := newTestTransportPair()
+	msg := WSUpgradeMsg{
+		Envelope: Envelope{Type: MsgWSUpgrade, StreamID: "s-idle"},
+		Path:     path,
+	}
+	cfg := newTestProxyConfig(port, 1048576)
+	cfg.StreamIdleTimeout = 200 * time.Millisecond
+	proxy := NewWSProxy(cfg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(ctx, msg, newInboundQueue(1048576, false, nil), tp.agentTr, &StreamRegistry{})
+	}()
+
+	if _, _, err := tp.bridgeR.ReadFrame(); err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+
+	var closeMsg StreamCloseMsg
+	_, data, err := tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read stream_close: %v", err)
+	}
+	if err := json.Unmarshal(data, &closeMsg); err != nil {
+		t.Fatalf("unmarshal stream_close: %v", err)
+	}
+	if closeMsg.Type != MsgStreamClose || closeMsg.Reason != "idle_timeout" {
+		t.Errorf("got %s with reason %q, want stream_close with reason idle_timeout", closeMsg.Type, closeMsg.Reason)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Handle() did not exit after the idle timeout")
+	}
+}
+
+// TestWSProxyFallsBackToIPv6 verifies the upgrade reaches a WebSocket server
+// listening only on [::1].
+func TestWSProxyFallsBackToIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		_, _, _ = conn.Read(r.Context())
+	}))
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := WSUpgradeMsg{
+		Envelope: Envelope{Type: MsgWSUpgrade, StreamID: "s-v6"},
+		Path:     "/hmr",
+		Headers:  map[string]string{},
+	}
+	proxy := NewWSProxy(newTestProxyConfig(ln.Addr().(*net.TCPAddr).Port, 1048576))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(ctx, msg, newInboundQueue(1048576, false, nil), tp.agentTr, &StreamRegistry{})
+	}()
+
+	var ack WSUpgradeAckMsg
+	_, data, err := tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+	if err := json.Unmarshal(data, &ack); err != nil {
+		t.Fatalf("unmarshal ack: %v", err)
+	}
+	if !ack.Success {
+		t.Errorf("expected Success=true, got error=%q", ack.Error)
+	}
+
+	tp.drain()
+	cancel()
+	<-done
+}
+
+// TestWSProxyWaitsForRestartingServer verifies an upgrade that arrives while
+// the dev server is restarting succeeds once the port accepts again.
+func TestWSProxyWaitsForRestartingServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		_, _, _ = conn.Read(r.Context())
+	}))
+	defer srv.Close()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		restarted, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		srv.Listener = restarted
+		srv.Start()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := newTestTransportPair()
+	defer tp.close()
+	msg := WSUpgradeMsg{
+		Envelope: Envelope{Type: MsgWSUpgrade, StreamID: "s-restart"},
+		Path:     "/hmr",
+		Headers:  map[string]string{},
+	}
+	cfg := newTestProxyConfig(port, 1048576)
+	cfg.PortGrace = 5 * time.Second
+	proxy := NewWSProxy(cfg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Handle(ctx, msg, newInboundQueue(1048576, false, nil), tp.agentTr, &StreamRegistry{})
+	}()
+
+	var ack WSUpgradeAckMsg
+	_, data, err := tp.bridgeR.ReadFrame()
+	if err != nil {
+		t.Fatalf("read ack: %v", err)
+	}
+	if err := json.Unmarshal(data, &ack); err != nil {
+		t.Fatalf("unmarshal ack: %v", err)
+	}
+	if !ack.Success {
+		t.Errorf("expected Success=true, got error=%q", ack.Error)
+	}
+
+	tp.drain()
+	cancel()
+	<-done
+}
@@ -0,0 +1,133 @@
+// Package upstream dials the local services the agent proxies to.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/config"
+)
+
+// Loopback addresses tried, in order, for ports without a configured upstream.
+// Dev servers that bind to "localhost" often listen on ::1 only.
+const (
+	loopbackIPv4 = "127.0.0.1"
+	loopbackIPv6 = "::1"
+)
+
+// Dialer connects to the upstream of a port. Ports with an upstream in
+// config.Config.Upstreams are dialed at that address; other ports are dialed on
+// 127.0.0.1 and then on [::1] when IPv4 is refused. The loopback address that
+// worked is remembered per port and tried first next time.
+type Dialer struct {
+	cfg     *config.Config
+	timeout time.Duration
+
+	loopback sync.Map // port (int) -> loopback address (string) that last accepted
+}
+
+// NewDialer creates a Dialer for the upstreams in cfg. Each connection attempt
+// is bounded by timeout.
+func NewDialer(cfg *config.Config, timeout time.Duration) *Dialer {
+	return &Dialer{cfg: cfg, timeout: timeout}
+}
+
+// Backoff between dials of a port that refuses connections.
+const (
+	initialRetryDelay = 50 * time.Millisecond
+	maxRetryDelay     = time.Second
+)
+
+// DialWait connects to the upstream for port like Dial, but while the port
+// refuses connections it retries with exponential backoff for up to
+// cfg.PortGrace. A refused dial sends nothing, so any request can wait for a
+// restarting dev server this way. It returns the last dial error once the
+// grace period runs out.
+func (d *Dialer) DialWait(ctx context.Context, port int) (net.Conn, error) {
+	conn, err := d.Dial(ctx, port)
+	if err == nil || !isRefused(err) || d.cfg.PortGrace <= 0 {
+		return conn, err
+	}
+
+	slog.Debug("upstream refused connection, waiting for port", "port", port, "grace", d.cfg.PortGrace)
+	deadline := time.Now().Add(d.cfg.PortGrace)
+	delay := initialRetryDelay
+	for {
+		wait := min(delay, time.Until(deadline))
+		if wait <= 0 {
+			return nil, err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		delay = min(delay*2, maxRetryDelay)
+
+		conn, err = d.Dial(ctx, port)
+		if err == nil || !isRefused(err) {
+			return conn, err
+		}
+	}
+}
+
+// isRefused reports whether err means nothing is accepting connections yet:
+// a refused TCP connection, or a Unix socket that does not exist.
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT)
+}
+
+// Dial connects to the upstream for port, trying once.
+func (d *Dialer) Dial(ctx context.Context, port int) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.timeout}
+	if u, ok := d.cfg.UpstreamFor(port); ok {
+		return dialer.DialContext(ctx, u.Network, u.Address)
+	}
+
+	first, second := loopbackIPv4, loopbackIPv6
+	if v, ok := d.loopback.Load(port); ok && v.(string) == loopbackIPv6 {
+		first, second = second, first
+	}
+	portStr := strconv.Itoa(port)
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(first, portStr))
+	if err == nil {
+		d.loopback.Store(port, first)
+		return conn, nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, err
+	}
+	conn, fallbackErr := dialer.DialContext(ctx, "tcp", net.JoinHostPort(second, portStr))
+	if fallbackErr != nil {
+		// Report the preferred address's error; the fallback usually fails
+		// the same way, or because IPv6 is not available at all.
+		return nil, err
+	}
+	slog.Debug("upstream reachable on the other loopback family", "port", port, "addr", second)
+	d.loopback.Store(port, second)
+	return conn, nil
+}
+
+// DialContext dials the upstream for the port in addr with DialWait, ignoring
+// the host. It lets an http.Transport whose URLs name 127.0.0.1:{port} reach
+// upstreams elsewhere and wait out a restart.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: invalid port in %q: %w", addr, err)
+	}
+	return d.DialWait(ctx, port)
+}
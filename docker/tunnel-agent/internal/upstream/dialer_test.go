@@ -0,0 +1,200 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"docker-bridge-tunnel-agent/internal/config"
+)
+
+// echoServer accepts connections on ln and writes greeting to each.
+func echoServer(t *testing.T, ln net.Listener, greeting string) {
+	t.Helper()
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(greeting))
+			conn.Close()
+		}
+	}()
+}
+
+// readGreeting dials port with d and returns what the server wrote.
+func readGreeting(t *testing.T, d *Dialer, port int) string {
+	t.Helper()
+	conn, err := d.Dial(context.Background(), port)
+	if err != nil {
+		t.Fatalf("Dial(%d): %v", port, err)
+	}
+	defer conn.Close()
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(b)
+}
+
+func TestDialerFallsBackToIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	echoServer(t, ln, "v6")
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	d := NewDialer(&config.Config{}, time.Second)
+	if got := readGreeting(t, d, port); got != "v6" {
+		t.Errorf("got %q, want v6", got)
+	}
+	if v, _ := d.loopback.Load(port); v != loopbackIPv6 {
+		t.Errorf("cached loopback = %v, want %s", v, loopbackIPv6)
+	}
+	// The cached family is tried first from now on.
+	if got := readGreeting(t, d, port); got != "v6" {
+		t.Errorf("got %q on second dial, want v6", got)
+	}
+}
+
+func TestDialerPrefersIPv4(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	echoServer(t, ln, "v4")
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	d := NewDialer(&config.Config{}, time.Second)
+	if got := readGreeting(t, d, port); got != "v4" {
+		t.Errorf("got %q, want v4", got)
+	}
+	if v, _ := d.loopback.Load(port); v != loopbackIPv4 {
+		t.Errorf("cached loopback = %v, want %s", v, loopbackIPv4)
+	}
+}
+
+func TestDialerRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	d := NewDialer(&config.Config{}, time.Second)
+	_, err = d.Dial(context.Background(), port)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("expected connection refused, got %v", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("expected a *net.OpError, got %T", err)
+	}
+}
+
+func TestDialerConfiguredUpstreams(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	unixLn, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen unix: %v", err)
+	}
+	echoServer(t, unixLn, "unix")
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	echoServer(t, tcpLn, "tcp")
+
+	cfg := &config.Config{Upstreams: map[int]config.Upstream{
+		3000: {Network: "unix", Address: sock},
+		8080: {Network: "tcp", Address: tcpLn.Addr().String()},
+	}}
+	d := NewDialer(cfg, time.Second)
+	if got := readGreeting(t, d, 3000); got != "unix" {
+		t.Errorf("port 3000: got %q, want unix", got)
+	}
+	if got := readGreeting(t, d, 8080); got != "tcp" {
+		t.Errorf("port 8080: got %q, want tcp", got)
+	}
+
+	// DialContext routes by the port in the address, whatever its host.
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(3000)))
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	conn.Close()
+}
+
+// freePort returns a loopback port with nothing listening on it.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+func TestDialWaitForRestartingServer(t *testing.T) {
+	port := freePort(t)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			return
+		}
+		echoServer(t, ln, "back")
+	}()
+
+	d := NewDialer(&config.Config{PortGrace: 5 * time.Second}, time.Second)
+	conn, err := d.DialWait(context.Background(), port)
+	if err != nil {
+		t.Fatalf("DialWait: %v", err)
+	}
+	defer conn.Close()
+	if b, _ := io.ReadAll(conn); string(b) != "back" {
+		t.Errorf("got %q, want back", b)
+	}
+}
+
+func TestDialWaitGivesUpAfterGrace(t *testing.T) {
+	port := freePort(t)
+	d := NewDialer(&config.Config{PortGrace: 200 * time.Millisecond}, time.Second)
+
+	start := time.Now()
+	_, err := d.DialWait(context.Background(), port)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("expected connection refused, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("DialWait returned after %v, want about the 200ms grace", elapsed)
+	}
+}
+
+func TestDialWaitStopsOnCancel(t *testing.T) {
+	port := freePort(t)
+	d := NewDialer(&config.Config{PortGrace: time.Minute}, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := d.DialWait(ctx, port); err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("DialWait ignored cancellation, returned after %v", elapsed)
+	}
+}